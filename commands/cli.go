@@ -2,8 +2,10 @@ package commands
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 
@@ -13,6 +15,17 @@ import (
 )
 
 func ParseClone(args []string, config *core.MachineConfig) (string, error) {
+	flags := flag.NewFlagSet("clone", flag.ContinueOnError)
+	generateKey := flags.Bool("generate-key", false, "generate an SSH key for the clone and install it in the guest")
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+	args = flags.Args()
+
+	if *generateKey {
+		config.SSH.GenerateKey = true
+	}
+
 	// We accept 0 or 1 arguments because we can use the clone source already
 	// configured in machine.lovm (if it exists). If machine.Source is empty and
 	// there is no user input, we'll complain.
@@ -32,12 +45,48 @@ func ParseClone(args []string, config *core.MachineConfig) (string, error) {
 	return source, nil
 }
 
+// CloneMachine clones the machine if it isn't cloned yet, then sets up its
+// hardware and its SSH key. Both lovm clone and lovm start use it, so the key
+// can be installed before the machine first boots if the engine can do that.
+func CloneMachine(machine core.VirtualizationEngine, config *core.MachineConfig, source, dir string) error {
+	if err := machine.Clone(source); err != nil {
+		return err
+	}
+	if err := ApplyHardware(machine, config); err != nil {
+		return err
+	}
+	return SetupSSHKey(machine, config, dir)
+}
+
+// SaveCloned saves the config after lovm start failed, if the machine has been
+// cloned. Main only saves when the command succeeds, but start can clone the
+// machine and then fail later, e.g. if --wait times out.
+// Without this machine.lovm would lose the clone's path, and the next start
+// would try to clone into the same directory again.
+func SaveCloned(machine core.VirtualizationEngine, config *core.MachineConfig, dir string) {
+	if !machine.Found() {
+		return
+	}
+	if err := config.Save(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing changes to %s: %s\n", core.MachineFile, err)
+	}
+}
+
 func ParseMounts(args []string, machine *core.MachineConfig) error {
 	if len(args) != 2 {
 		return errors.New("expected args <host path to mount> <target path in guest>")
 	}
 
-	machine.Mounts[args[0]] = args[1]
+	// The VM doesn't know where we are, so hand it an absolute path
+	hostPath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+
+	if machine.Mounts == nil {
+		machine.Mounts = map[string]string{}
+	}
+	machine.Mounts[hostPath] = args[1]
 
 	return nil
 }
@@ -67,6 +116,12 @@ Misc
 `
 
 func Main() error {
+	args, err := ChangeDir(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	os.Args = append(os.Args[:1], args...)
+
 	pwd, err := os.Getwd()
 	if err != nil {
 		return err
@@ -81,7 +136,7 @@ func Main() error {
 
 	commands := map[string]*cli.Command{
 		"clone": {
-			Summary: "Clone a VM. Start here!",
+			Summary: "Clone a VM (--generate-key to give it its own SSH key). Start here!",
 			Run: func(args []string) error {
 				source, err := ParseClone(args, config)
 				if err != nil {
@@ -92,44 +147,135 @@ func Main() error {
 				if source != "" {
 					machine = engine.Engine(source, config)
 				}
-				if err := machine.Clone(source); err != nil {
-					return err
-				}
-				return nil
+				return CloneMachine(machine, config, source, pwd)
 			},
 		},
 		"start": {
-			Summary: "Start the VM",
-			Run: func(args []string) error {
+			Summary: "Start the VM (--wait to block until it is ready for SSH)",
+			Run: func(args []string) (err error) {
+				defer func() {
+					if err != nil {
+						SaveCloned(machine, config, pwd)
+					}
+				}()
+				wait, timeout, err := ParseWait("start", args)
+				if err != nil {
+					return err
+				}
+				if config.SSH.GenerateKey {
+					// Clone first, so the key can be given to the guest
+					// before it boots if the engine supports that
+					if err := CloneMachine(machine, config, "", pwd); err != nil {
+						return err
+					}
+				}
 				if err := machine.Start(); err != nil {
 					return err
 				}
+				if err := MarkStarted(pwd); err != nil {
+					return err
+				}
+				// Some engines can only install the key once the guest is
+				// running, in which case it wasn't installed above
+				if config.SSH.GenerateKey && !config.SSH.KeyInstalled {
+					if err := SetupSSHKey(machine, config, pwd); err != nil {
+						return err
+					}
+				}
 				fmt.Printf("machine %q running (%s)\n", config.Path, config.Engine)
-				return nil
+				if wait {
+					ip, err := Wait(machine, config, timeout)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("machine ready at %s\n", ip)
+					ReapplyForwards(machine, config)
+				}
+				return SyncSSHConfig(machine, config, pwd)
 			},
 		},
 		"stop": {
 			Summary: "Stop the VM",
 			Run: func(args []string) error {
-				return machine.Stop()
+				if err := machine.Stop(); err != nil {
+					return err
+				}
+				if err := ClearStarted(pwd); err != nil {
+					return err
+				}
+				return SyncSSHConfig(machine, config, pwd)
+			},
+		},
+		"suspend": {
+			Summary: "Save the VM's memory to disk and stop it",
+			Run: func(args []string) error {
+				if err := machine.Suspend(); err != nil {
+					return err
+				}
+				if err := ClearStarted(pwd); err != nil {
+					return err
+				}
+				return SyncSSHConfig(machine, config, pwd)
+			},
+		},
+		"resume": {
+			Summary: "Resume a suspended VM",
+			Run: func(args []string) error {
+				if err := machine.Resume(); err != nil {
+					return err
+				}
+				if err := MarkStarted(pwd); err != nil {
+					return err
+				}
+				return SyncSSHConfig(machine, config, pwd)
 			},
 		},
 		"restart": {
 			Summary: "Start / stop the VM",
 			Run: func(args []string) error {
-				return machine.Restart()
+				if err := machine.Restart(); err != nil {
+					return err
+				}
+				if err := MarkStarted(pwd); err != nil {
+					return err
+				}
+				return SyncSSHConfig(machine, config, pwd)
 			},
 		},
 		"ssh": {
 			Summary: "Open an SSH session to the VM",
 			Run: func(args []string) error {
-				return SSH(args, machine, config)
+				// If the machine was only just started it may still be
+				// booting, so give it a chance to come up.
+				return SSH(args, machine, config, JustStarted(pwd, DefaultWaitTimeout))
 			},
 		},
-		"ip": {
-			Summary: "Write the VM's IP address to stdout",
+		"ssh-config": {
+			Summary: "Write an OpenSSH config Host block for the VM (--write to keep one in ~/.ssh/lovm.d)",
+			Run: func(args []string) error {
+				return ShowSSHConfig(args, machine, config, pwd)
+			},
+		},
+		"exec": {
+			Summary: "Run a command in the VM, e.g. lovm exec --workdir /srv -- make test",
+			Run: func(args []string) error {
+				return Exec(args, machine, config, JustStarted(pwd, DefaultWaitTimeout))
+			},
+		},
+		"proxy": {
+			Summary: "Connect stdin and stdout to a port in the VM, for use as an SSH ProxyCommand",
+			Run: func(args []string) error {
+				return Proxy(args, machine, config)
+			},
+		},
+		"wait": {
+			Summary: "Wait until the VM is ready for SSH, then write its IP address to stdout",
 			Run: func(args []string) error {
-				ip, err := machine.IP()
+				_, timeout, err := ParseWait("wait", args)
+				if err != nil {
+					return err
+				}
+				ip, err := Wait(machine, config, timeout)
 				if err != nil {
 					return err
 				}
@@ -137,8 +283,46 @@ func Main() error {
 				return nil
 			},
 		},
+		"ip": {
+			Summary: "Write the VM's IP address to stdout; --all lists every address",
+			Run: func(args []string) error {
+				return IP(args, machine)
+			},
+		},
+		"status": {
+			Summary: "Show whether the VM is cloned, running, stopped, etc.",
+			Run: func(args []string) error {
+				return Status(machine, config)
+			},
+		},
+		"snapshot": {
+			Summary: "Save, restore, list, or delete snapshots of the VM",
+			Run: func(args []string) error {
+				return Snapshot(args, machine)
+			},
+		},
+		"cp": {
+			Summary: "Copy files to or from the VM, e.g. lovm cp ./dist :/srv/app",
+			Run: func(args []string) error {
+				return Copy(args, machine, config)
+			},
+		},
+		"forward": {
+			Summary: "Forward a host port to the VM, e.g. lovm forward 8080:80 (or list, remove <host port>); " +
+				"VMware's forwarding listens on every interface, needs root, and restarts its NAT service, " +
+				"so lovm only uses it with expose-forwards in machine.lovm",
+			Run: func(args []string) error {
+				return Forward(args, machine, config)
+			},
+		},
+		"set": {
+			Summary: "Change the VM's hardware, e.g. lovm set cpus=4 memory=8G networks=nat,hostonly",
+			Run: func(args []string) error {
+				return Set(args, machine, config)
+			},
+		},
 		"mount": {
-			Summary: "Mount a hold folder into the VM",
+			Summary: "Mount a host folder into the VM",
 			Run: func(args []string) error {
 				if err := ParseMounts(args, config); err != nil {
 					return err
@@ -152,7 +336,16 @@ func Main() error {
 		"delete": {
 			Summary: "Stop and delete the VM",
 			Run: func(args []string) error {
-				return machine.Delete()
+				if err := machine.Delete(); err != nil {
+					return err
+				}
+				if err := RemoveSSHKey(config, pwd); err != nil {
+					return err
+				}
+				if err := ClearStarted(pwd); err != nil {
+					return err
+				}
+				return SyncSSHConfig(machine, config, pwd)
 			},
 		},
 	}
@@ -0,0 +1,46 @@
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+// CloneEngine is found once it has been cloned
+type CloneEngine struct {
+	core.VirtualizationEngine
+	Cloned bool
+}
+
+func (e *CloneEngine) Found() bool {
+	return e.Cloned
+}
+
+func TestSaveCloned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lovm-save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &core.MachineConfig{Path: filepath.Join(dir, ".lovm", "example", "example.vmx")}
+	machine := &CloneEngine{}
+
+	SaveCloned(machine, config, dir)
+	if _, err := os.Stat(filepath.Join(dir, core.MachineFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be saved before the machine is cloned, found %v", err)
+	}
+
+	machine.Cloned = true
+	SaveCloned(machine, config, dir)
+	saved, err := core.ConfigFromFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Path != config.Path {
+		t.Errorf("Expected path %q to be saved, found %q", config.Path, saved.Path)
+	}
+}
@@ -0,0 +1,260 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cbednarski/lovm/core"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ParseCopy parses the arguments for lovm cp. Like docker cp, guest paths
+// start with a colon, e.g. lovm cp ./dist :/srv/app. One of the paths must be
+// in the guest and the other on the host.
+func ParseCopy(args []string) (src, dst string, toGuest bool, err error) {
+	if len(args) != 2 {
+		return "", "", false, errors.New("expected args <src> <dst>; prefix the guest path with :, e.g. :/tmp")
+	}
+
+	src, dst = args[0], args[1]
+	srcGuest := strings.HasPrefix(src, ":")
+	dstGuest := strings.HasPrefix(dst, ":")
+
+	if srcGuest == dstGuest {
+		return "", "", false, errors.New("one path must be in the guest and the other on the host; prefix the guest path with :")
+	}
+
+	src = strings.TrimPrefix(src, ":")
+	dst = strings.TrimPrefix(dst, ":")
+	if src == "" || dst == "" {
+		return "", "", false, errors.New("paths must not be empty")
+	}
+
+	return src, dst, dstGuest, nil
+}
+
+// UploadSFTP copies src on the host to dst in the guest. If dst is an existing
+// directory src is copied into it, like cp. Directories are copied
+// recursively and file modes are kept.
+func UploadSFTP(client *sftp.Client, src, dst string) error {
+	src = filepath.Clean(src)
+	if fi, err := client.Stat(dst); err == nil && fi.IsDir() {
+		dst = path.Join(dst, filepath.Base(src))
+	}
+
+	// Directory modes are set at the end, in case they aren't writable
+	dirModes := map[string]os.FileMode{}
+
+	err := filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, filepath.ToSlash(rel))
+
+		switch {
+		case fi.IsDir():
+			if err := client.MkdirAll(target); err != nil {
+				return err
+			}
+			dirModes[target] = fi.Mode().Perm()
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			client.Remove(target)
+			return client.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			if err := uploadFile(client, file, target); err != nil {
+				return err
+			}
+			return client.Chmod(target, fi.Mode().Perm())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for dir, mode := range dirModes {
+		if err := client.Chmod(dir, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func uploadFile(client *sftp.Client, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := client.Create(dst)
+	if err != nil {
+		return fmt.Errorf("%s: %s", dst, err)
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// DownloadSFTP copies src in the guest to dst on the host. It works the same
+// way as UploadSFTP, in reverse.
+func DownloadSFTP(client *sftp.Client, src, dst string) error {
+	src = path.Clean(src)
+	dst = core.CopyDestination(path.Base(src), dst)
+
+	dirModes := map[string]os.FileMode{}
+
+	walker := client.Walk(src)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+
+		fi := walker.Stat()
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), src), "/")
+		target := filepath.Join(dst, filepath.FromSlash(rel))
+
+		// The guest's own symlinks are copied as symlinks, so make sure we
+		// don't write anything through them
+		if err := core.CheckParents(dst, target); err != nil {
+			return err
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirModes[target] = fi.Mode().Perm()
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := client.ReadLink(walker.Path())
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			if err := core.RemoveSymlink(target); err != nil {
+				return err
+			}
+			if err := downloadFile(client, walker.Path(), target); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+	}
+
+	for dir, mode := range dirModes {
+		if err := os.Chmod(dir, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func downloadFile(client *sftp.Client, src, dst string) error {
+	in, err := client.Open(src)
+	if err != nil {
+		return fmt.Errorf("%s: %s", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// DialSFTP opens an SFTP session to the machine using the built-in SSH
+// client and the machine's SSHConfig. Close both clients when you're done.
+func DialSFTP(machine core.VirtualizationEngine, config *core.MachineConfig) (*sftp.Client, *ssh.Client, error) {
+	ip, err := machine.IP()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts, err := ParseClientOptions(nil, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := DialSSH(opts, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return client, conn, nil
+}
+
+// Copy implements lovm cp. Files are copied over SFTP if we can connect to
+// the machine with SSH. Otherwise we use the virtualization engine's guest
+// tools instead (see VirtualizationEngine.CopyToGuest).
+func Copy(args []string, machine core.VirtualizationEngine, config *core.MachineConfig) error {
+	src, dst, toGuest, err := ParseCopy(args)
+	if err != nil {
+		return err
+	}
+
+	client, conn, sshErr := DialSFTP(machine, config)
+	if sshErr == nil {
+		defer conn.Close()
+		defer client.Close()
+
+		if toGuest {
+			return UploadSFTP(client, src, dst)
+		}
+		return DownloadSFTP(client, src, dst)
+	}
+
+	fmt.Fprintf(os.Stderr, "unable to copy over SSH (%s); using guest tools instead\n", sshErr)
+
+	if toGuest {
+		err = machine.CopyToGuest(src, dst)
+	} else {
+		err = machine.CopyFromGuest(src, dst)
+	}
+
+	// If the engine has no other way to copy files, the SSH error is more
+	// useful to the user.
+	if err == core.ErrNotImplemented {
+		return sshErr
+	}
+
+	return err
+}
@@ -0,0 +1,138 @@
+package commands
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestParseCopy(t *testing.T) {
+	src, dst, toGuest, err := ParseCopy([]string{"./dist", ":/srv/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src != "./dist" || dst != "/srv/app" || !toGuest {
+		t.Errorf("Expected ./dist to /srv/app in the guest, found %s %s %t", src, dst, toGuest)
+	}
+
+	src, dst, toGuest, err = ParseCopy([]string{":/var/log/messages", "."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src != "/var/log/messages" || dst != "." || toGuest {
+		t.Errorf("Expected /var/log/messages from the guest to ., found %s %s %t", src, dst, toGuest)
+	}
+
+	for _, args := range [][]string{{"a"}, {"a", "b"}, {":a", ":b"}, {":", "b"}, {"a", "b", ":c"}} {
+		if _, _, _, err := ParseCopy(args); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
+
+// PipeSFTP returns an SFTP client connected to an in-process SFTP server that
+// serves the local filesystem, and a function to shut them both down
+func PipeSFTP(t *testing.T) (*sftp.Client, func()) {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverIn, serverOut})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientIn, clientOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client waits for the server to hang up, so close the server first
+	return client, func() {
+		server.Close()
+		client.Close()
+	}
+}
+
+func WriteTestFile(t *testing.T, file string, mode os.FileMode) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(filepath.Base(file)), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(file, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func CheckMode(t *testing.T, file string, mode os.FileMode) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fi.Mode() != mode {
+		t.Errorf("Expected %s to have mode %s, found %s", file, mode, fi.Mode())
+	}
+}
+
+func TestSFTPCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lovm-cp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	WriteTestFile(t, filepath.Join(dir, "dist", "run.sh"), 0755)
+	WriteTestFile(t, filepath.Join(dir, "dist", "config", "secret"), 0600)
+	if err := os.Chmod(filepath.Join(dir, "dist", "config"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	client, done := PipeSFTP(t)
+	defer done()
+
+	guest := filepath.ToSlash(filepath.Join(dir, "guest"))
+
+	// Into a new path
+	if err := UploadSFTP(client, filepath.Join(dir, "dist"), guest); err != nil {
+		t.Fatal(err)
+	}
+	CheckMode(t, filepath.Join(dir, "guest", "run.sh"), 0755)
+	CheckMode(t, filepath.Join(dir, "guest", "config"), 0700|os.ModeDir)
+	CheckMode(t, filepath.Join(dir, "guest", "config", "secret"), 0600)
+
+	// Into an existing directory
+	if err := UploadSFTP(client, filepath.Join(dir, "dist"), guest); err != nil {
+		t.Fatal(err)
+	}
+	CheckMode(t, filepath.Join(dir, "guest", "dist", "config", "secret"), 0600)
+
+	// And back again
+	if err := DownloadSFTP(client, guest+"/dist", filepath.Join(dir, "host")); err != nil {
+		t.Fatal(err)
+	}
+	CheckMode(t, filepath.Join(dir, "host", "run.sh"), 0755)
+	CheckMode(t, filepath.Join(dir, "host", "config"), 0700|os.ModeDir)
+	CheckMode(t, filepath.Join(dir, "host", "config", "secret"), 0600)
+
+	// A single file into an existing directory
+	if err := DownloadSFTP(client, guest+"/run.sh", filepath.Join(dir, "host")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "host", "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "run.sh" {
+		t.Errorf("Unexpected contents in run.sh: %q", data)
+	}
+}
@@ -0,0 +1,196 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/cbednarski/lovm/core"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+var reEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ExitError is returned when a command in the guest exits with a non-zero
+// status, so lovm can exit with the same status.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Code)
+}
+
+// envFlag collects repeated --env K=V flags
+type envFlag []string
+
+func (e *envFlag) String() string {
+	return strings.Join(*e, " ")
+}
+
+func (e *envFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || !reEnvName.MatchString(parts[0]) {
+		return fmt.Errorf("expected NAME=value, found %q", value)
+	}
+	*e = append(*e, value)
+	return nil
+}
+
+// ExecOptions are the flags and command for lovm exec
+type ExecOptions struct {
+	Env        []string
+	Workdir    string
+	GuestTools bool
+	Command    []string
+}
+
+// ParseExec parses the arguments for lovm exec. Everything after the flags
+// (or after --) is the command to run in the guest.
+func ParseExec(args []string) (*ExecOptions, error) {
+	opts := &ExecOptions{}
+	env := envFlag{}
+
+	flags := flag.NewFlagSet("exec", flag.ContinueOnError)
+	flags.Var(&env, "env", "set an environment variable, e.g. --env GOFLAGS=-v (may be repeated)")
+	flags.StringVar(&opts.Workdir, "workdir", "", "directory in the guest to run the command in")
+	flags.BoolVar(&opts.GuestTools, "guest-tools", false, "run the command with the engine's guest tools instead of SSH")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	opts.Env = env
+	opts.Command = flags.Args()
+	if len(opts.Command) == 0 {
+		return nil, errors.New("expected a command to run, e.g. lovm exec -- make test")
+	}
+
+	return opts, nil
+}
+
+// ExecScript builds the /bin/sh script that runs the command in the guest.
+// Each argument is quoted, so the command gets exactly the arguments that
+// were passed to lovm exec, spaces and all.
+func ExecScript(opts *ExecOptions) string {
+	var words []string
+
+	if opts.Workdir != "" {
+		words = append(words, "cd", core.ShellQuote(opts.Workdir), "&&")
+	}
+
+	words = append(words, "exec")
+
+	if len(opts.Env) > 0 {
+		words = append(words, "env")
+		for _, value := range opts.Env {
+			words = append(words, core.ShellQuote(value))
+		}
+	}
+
+	for _, arg := range opts.Command {
+		words = append(words, core.ShellQuote(arg))
+	}
+
+	return strings.Join(words, " ")
+}
+
+// ExecSSH runs the script over SSH and returns its exit code. stdout and
+// stderr are streamed separately. stdin is passed along if it is a pipe or
+// file, but not if it's a terminal since the command is not interactive.
+func ExecSSH(script string, ip net.IP, config *core.MachineConfig) (int, error) {
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+
+	if !UseBuiltinSSH(config) {
+		cmd, err := BuildSSHCommand([]string{"-T", "--", script}, ip, config)
+		if err != nil {
+			return 0, err
+		}
+		if !interactive {
+			cmd.Stdin = os.Stdin
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		// ssh exits with the remote command's exit code, or 255 if it
+		// couldn't connect, in which case it has already said why.
+		err = cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), nil
+		}
+		return 0, err
+	}
+
+	opts, err := ParseClientOptions(nil, config)
+	if err != nil {
+		return 0, err
+	}
+
+	client, err := DialSSH(opts, ip)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	if !interactive {
+		session.Stdin = os.Stdin
+	}
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	err = session.Run(script)
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus(), nil
+	}
+	return 0, err
+}
+
+// Exec implements lovm exec. The command is run over SSH, or with the
+// engine's guest tools if --guest-tools is set (see
+// VirtualizationEngine.Exec). If the command fails the error is an ExitError
+// with its exit code. If wait is true we'll wait for the VM to be ready for
+// SSH first (see Wait).
+func Exec(args []string, machine core.VirtualizationEngine, config *core.MachineConfig, wait bool) error {
+	opts, err := ParseExec(args)
+	if err != nil {
+		return err
+	}
+
+	script := ExecScript(opts)
+
+	var code int
+	if opts.GuestTools {
+		code, err = machine.Exec(script, os.Stdout, os.Stderr)
+	} else {
+		var ip net.IP
+		if wait {
+			ip, err = Wait(machine, config, DefaultWaitTimeout)
+		} else {
+			ip, err = machine.IP()
+		}
+		if err != nil {
+			return err
+		}
+		code, err = ExecSSH(script, ip, config)
+	}
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return &ExitError{Code: code}
+	}
+	return nil
+}
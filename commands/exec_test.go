@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+func TestParseExec(t *testing.T) {
+	opts, err := ParseExec([]string{"--env", "A=1", "--env", "B=two words", "--workdir", "/srv/app", "--", "make", "-j4", "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareLists(opts.Env, []string{"A=1", "B=two words"}) {
+		t.Errorf("Unexpected env %q", opts.Env)
+	}
+	if opts.Workdir != "/srv/app" || opts.GuestTools {
+		t.Errorf("Unexpected options %#v", opts)
+	}
+	if !CompareLists(opts.Command, []string{"make", "-j4", "test"}) {
+		t.Errorf("Unexpected command %q", opts.Command)
+	}
+
+	opts, err = ParseExec([]string{"--guest-tools", "uptime"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.GuestTools || !CompareLists(opts.Command, []string{"uptime"}) {
+		t.Errorf("Unexpected options %#v", opts)
+	}
+
+	for _, args := range [][]string{{}, {"--"}, {"--env", "A"}, {"--env", "1A=b", "--", "true"}, {"--nope", "--", "true"}} {
+		if _, err := ParseExec(args); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
+
+func TestExecScript(t *testing.T) {
+	opts := &ExecOptions{
+		Env:     []string{"GREETING=hello world"},
+		Workdir: "/tmp",
+		Command: []string{"printf", "%s|%s|%s", "$GREETING", "it's", "$(pwd)"},
+	}
+
+	expected := `cd '/tmp' && exec env 'GREETING=hello world' 'printf' '%s|%s|%s' '$GREETING' 'it'\''s' '$(pwd)'`
+	script := ExecScript(opts)
+	if script != expected {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expected, script)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	// The arguments should get to the command exactly as they were given
+	out, err := exec.Command("/bin/sh", "-c", script).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "$GREETING|it's|$(pwd)" {
+		t.Errorf("Unexpected output %q", out)
+	}
+
+	opts.Command = []string{"sh", "-c", `echo "$GREETING from $(pwd)"; exit 3`}
+	out, err = exec.Command("/bin/sh", "-c", ExecScript(opts)).Output()
+	if string(out) != "hello world from /tmp\n" {
+		t.Errorf("Unexpected output %q", out)
+	}
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Errorf("Expected exit status 3, found %v", err)
+	}
+}
+
+func TestExitError(t *testing.T) {
+	err := &ExitError{Code: 42}
+	if err.Error() != "command exited with status 42" {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+}
@@ -0,0 +1,329 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+const forwardUsage = "expected args <host port>:<guest port>, list, or remove <host port>"
+
+// ProxyDialTimeout is how long the proxy waits to connect to the guest
+const ProxyDialTimeout = 10 * time.Second
+
+// ForwardOptions are the action and flags for lovm forward
+type ForwardOptions struct {
+	// Action is add, apply, list, or remove. apply sets up the forwards that
+	// are already configured.
+	Action string
+
+	Forward core.Forward
+
+	// Proxy skips the engine's port forwarding and runs the proxy
+	Proxy bool
+}
+
+// ParsePort parses a TCP port number
+func ParsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// ParseForward parses a forward like 8080:80, from host port 8080 to guest
+// port 80
+func ParseForward(s string) (core.Forward, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return core.Forward{}, fmt.Errorf("expected <host port>:<guest port>, found %q", s)
+	}
+
+	hostPort, err := ParsePort(parts[0])
+	if err != nil {
+		return core.Forward{}, err
+	}
+	guestPort, err := ParsePort(parts[1])
+	if err != nil {
+		return core.Forward{}, err
+	}
+
+	return core.Forward{HostPort: hostPort, GuestPort: guestPort}, nil
+}
+
+// ParseForwardArgs parses the arguments for lovm forward. With no arguments
+// it sets up the forwards that are already configured.
+func ParseForwardArgs(args []string) (*ForwardOptions, error) {
+	opts := &ForwardOptions{}
+
+	flags := flag.NewFlagSet("forward", flag.ContinueOnError)
+	flags.BoolVar(&opts.Proxy, "proxy", false, "use lovm's proxy instead of the engine's port forwarding")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	args = flags.Args()
+
+	switch {
+	case len(args) == 0:
+		opts.Action = "apply"
+	case args[0] == "list":
+		if len(args) != 1 {
+			return nil, errors.New("too many arguments")
+		}
+		opts.Action = "list"
+	case args[0] == "remove":
+		if len(args) != 2 {
+			return nil, errors.New("expected args remove <host port>")
+		}
+		port, err := ParsePort(args[1])
+		if err != nil {
+			return nil, err
+		}
+		opts.Action = "remove"
+		opts.Forward.HostPort = port
+	case len(args) == 1 && strings.Contains(args[0], ":"):
+		forward, err := ParseForward(args[0])
+		if err != nil {
+			return nil, err
+		}
+		opts.Action = "add"
+		opts.Forward = forward
+	default:
+		return nil, errors.New(forwardUsage)
+	}
+
+	if opts.Proxy && (opts.Action == "list" || opts.Action == "remove") {
+		return nil, fmt.Errorf("--proxy can't be used with %s", opts.Action)
+	}
+
+	return opts, nil
+}
+
+// ForwardProxy forwards TCP connections from the host to the guest in
+// userspace. It's used when the engine can't forward ports itself. The guest's
+// IP is looked up when the first connection comes in, and again whenever we
+// can't connect to it, so the proxy keeps working if the IP changes.
+type ForwardProxy struct {
+	// Lookup returns the guest's current IP, e.g. VirtualizationEngine.IP
+	Lookup func() (net.IP, error)
+
+	mu sync.Mutex
+	ip net.IP
+}
+
+func (p *ForwardProxy) guestIP(refresh bool) (net.IP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ip == nil || refresh {
+		ip, err := p.Lookup()
+		if err != nil {
+			return nil, err
+		}
+		p.ip = ip
+	}
+
+	return p.ip, nil
+}
+
+func (p *ForwardProxy) dial(ip net.IP, port int) (net.Conn, error) {
+	return net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), ProxyDialTimeout)
+}
+
+// Dial connects to port in the guest
+func (p *ForwardProxy) Dial(port int) (net.Conn, error) {
+	if ip, err := p.guestIP(false); err == nil {
+		if conn, err := p.dial(ip, port); err == nil {
+			return conn, nil
+		}
+	}
+
+	// The IP may have changed, so look it up again before we give up
+	ip, err := p.guestIP(true)
+	if err != nil {
+		return nil, err
+	}
+	return p.dial(ip, port)
+}
+
+// Serve accepts connections on listener and forwards them to guestPort until
+// the listener is closed
+func (p *ForwardProxy) Serve(listener net.Listener, guestPort int) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handle(conn, guestPort)
+	}
+}
+
+func (p *ForwardProxy) handle(conn net.Conn, guestPort int) {
+	defer conn.Close()
+
+	guest, err := p.Dial(guestPort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to connect to port %d in the guest: %s\n", guestPort, err)
+		return
+	}
+	defer guest.Close()
+
+	// Copy in both directions, passing on half-closes so protocols that wait
+	// for EOF still work
+	done := make(chan struct{})
+	go func() {
+		io.Copy(guest, conn)
+		closeWrite(guest)
+		close(done)
+	}()
+	io.Copy(conn, guest)
+	closeWrite(conn)
+	<-done
+}
+
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+}
+
+// RunProxy listens on the host's loopback address for each forward and proxies
+// connections to the guest until lovm is interrupted.
+func RunProxy(forwards []core.Forward, machine core.VirtualizationEngine) error {
+	proxy := &ForwardProxy{Lookup: machine.IP}
+
+	var listeners []net.Listener
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	for _, forward := range forwards {
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(forward.HostPort)))
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	errs := make(chan error, len(forwards))
+	for i, forward := range forwards {
+		fmt.Printf("forwarding 127.0.0.1:%d to port %d in the guest\n", forward.HostPort, forward.GuestPort)
+		go func(listener net.Listener, port int) {
+			errs <- proxy.Serve(listener, port)
+		}(listeners[i], forward.GuestPort)
+	}
+	fmt.Println("press Ctrl-C to stop")
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	select {
+	case <-interrupt:
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
+
+// ListenHost returns the host address the forwards listen on. That's
+// 127.0.0.1 unless the engine's port forwarding listens on every interface
+// (see core.PublicForwarder) and the user allowed it to be used.
+func ListenHost(machine core.VirtualizationEngine, config *core.MachineConfig) string {
+	if public, ok := machine.(core.PublicForwarder); ok && public.PublicForwards() && config.ExposeForwards {
+		return "0.0.0.0"
+	}
+	return "127.0.0.1"
+}
+
+// Forward implements lovm forward. Forwards are saved in machine.lovm and set
+// up with the engine's own port forwarding if it has any (see
+// VirtualizationEngine.Forward), so they keep working after lovm exits. If it
+// doesn't, or it fails, we run a proxy in the foreground instead.
+func Forward(args []string, machine core.VirtualizationEngine, config *core.MachineConfig) error {
+	opts, err := ParseForwardArgs(args)
+	if err != nil {
+		return err
+	}
+
+	switch opts.Action {
+	case "list":
+		for _, forward := range config.Forwards {
+			fmt.Printf("%s:%d -> %d\n", ListenHost(machine, config), forward.HostPort, forward.GuestPort)
+		}
+		return nil
+	case "remove":
+		if !config.RemoveForward(opts.Forward.HostPort) {
+			return fmt.Errorf("host port %d is not forwarded", opts.Forward.HostPort)
+		}
+		if err := machine.Forward(); err != nil && err != core.ErrNotImplemented && err != core.ErrForwardPublic {
+			return err
+		}
+		return nil
+	case "add":
+		config.AddForward(opts.Forward)
+	}
+
+	if len(config.Forwards) == 0 {
+		return errors.New("no ports are forwarded; " + forwardUsage)
+	}
+
+	if !machine.Found() {
+		return errors.New("the machine is not cloned yet; run lovm start first")
+	}
+
+	if !opts.Proxy {
+		err := machine.Forward()
+		switch err {
+		case nil:
+			host := ListenHost(machine, config)
+			for _, forward := range config.Forwards {
+				fmt.Printf("forwarding %s:%d to port %d in the guest (%s)\n",
+					host, forward.HostPort, forward.GuestPort, machine.Type())
+			}
+			if host != "127.0.0.1" {
+				fmt.Fprintf(os.Stderr, "%s listens on every host interface, so other machines on your network can connect\n", machine.Type())
+			}
+			return nil
+		case core.ErrNotImplemented:
+			fmt.Fprintf(os.Stderr, "%s can't forward ports for this machine; using lovm's proxy instead\n", machine.Type())
+		case core.ErrForwardPublic:
+			fmt.Fprintf(os.Stderr, "%s's port forwarding listens on every host interface; using lovm's proxy on "+
+				"127.0.0.1 instead (set \"expose-forwards\": true in %s to use %s's)\n",
+				machine.Type(), core.MachineFile, machine.Type())
+		default:
+			fmt.Fprintf(os.Stderr, "unable to forward ports with %s (%s); using lovm's proxy instead\n", machine.Type(), err)
+		}
+	}
+
+	return RunProxy(config.Forwards, machine)
+}
+
+// ReapplyForwards sets up the engine's port forwarding again once the machine
+// is ready, in case it was re-cloned or its IP changed. Call it after Wait,
+// since some engines forward to the guest's IP. Engines only change anything
+// if the forwards are out of date, which matters for VMware, where it means
+// restarting the NAT service for every VM. It only warns if that doesn't work,
+// since the machine itself started fine.
+func ReapplyForwards(machine core.VirtualizationEngine, config *core.MachineConfig) {
+	if len(config.Forwards) == 0 {
+		return
+	}
+	if err := machine.Forward(); err != nil && err != core.ErrNotImplemented && err != core.ErrForwardPublic {
+		fmt.Fprintf(os.Stderr, "unable to forward ports (%s); run lovm forward to try again\n", err)
+	}
+}
@@ -0,0 +1,148 @@
+package commands
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+func TestParseForwardArgs(t *testing.T) {
+	cases := []struct {
+		args     []string
+		expected ForwardOptions
+	}{
+		{[]string{"8080:80"}, ForwardOptions{Action: "add", Forward: core.Forward{HostPort: 8080, GuestPort: 80}}},
+		{[]string{"--proxy", "5432:5432"}, ForwardOptions{Action: "add", Forward: core.Forward{HostPort: 5432, GuestPort: 5432}, Proxy: true}},
+		{[]string{}, ForwardOptions{Action: "apply"}},
+		{[]string{"--proxy"}, ForwardOptions{Action: "apply", Proxy: true}},
+		{[]string{"list"}, ForwardOptions{Action: "list"}},
+		{[]string{"remove", "8080"}, ForwardOptions{Action: "remove", Forward: core.Forward{HostPort: 8080}}},
+	}
+
+	for _, c := range cases {
+		opts, err := ParseForwardArgs(c.args)
+		if err != nil {
+			t.Errorf("%q: %s", c.args, err)
+			continue
+		}
+		if *opts != c.expected {
+			t.Errorf("%q: expected %#v, found %#v", c.args, c.expected, *opts)
+		}
+	}
+
+	invalid := [][]string{
+		{"8080"},
+		{"8080:"},
+		{"0:80"},
+		{"8080:65536"},
+		{"http:80"},
+		{"8080:80", "8081:81"},
+		{"list", "8080"},
+		{"remove"},
+		{"remove", "8080:80"},
+		{"--proxy", "list"},
+	}
+	for _, args := range invalid {
+		if _, err := ParseForwardArgs(args); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
+
+// EchoServer listens on a random port on the loopback address and echoes
+// whatever it reads from each connection
+func EchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				conn.Write(data)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestForwardProxy(t *testing.T) {
+	guest := EchoServer(t)
+	defer guest.Close()
+	guestPort := guest.Addr().(*net.TCPAddr).Port
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The first IP is wrong, like a stale lease, so the proxy has to look it
+	// up again to connect
+	lookups := 0
+	proxy := &ForwardProxy{
+		Lookup: func() (net.IP, error) {
+			lookups++
+			if lookups == 1 {
+				return net.IPv6loopback, nil
+			}
+			return net.IPv4(127, 0, 0, 1), nil
+		},
+	}
+	go proxy.Serve(listener, guestPort)
+
+	for _, message := range []string{"hello", "again"} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(message))
+		conn.(*net.TCPConn).CloseWrite()
+
+		data, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != message {
+			t.Errorf("Expected %q, found %q", message, data)
+		}
+	}
+
+	// The second connection should reuse the IP we found the first time
+	if lookups != 2 {
+		t.Errorf("Expected 2 lookups, found %d", lookups)
+	}
+}
+
+// PublicEngine forwards ports on every host interface
+type PublicEngine struct {
+	core.VirtualizationEngine
+}
+
+func (e *PublicEngine) PublicForwards() bool {
+	return true
+}
+
+func TestListenHost(t *testing.T) {
+	config := &core.MachineConfig{}
+	if host := ListenHost(&PublicEngine{}, config); host != "127.0.0.1" {
+		t.Errorf("Expected the proxy on 127.0.0.1 unless forwards are exposed, found %s", host)
+	}
+
+	config.ExposeForwards = true
+	if host := ListenHost(&PublicEngine{}, config); host != "0.0.0.0" {
+		t.Errorf("Expected every interface once forwards are exposed, found %s", host)
+	}
+	if host := ListenHost(&KeyEngine{}, config); host != "127.0.0.1" {
+		t.Errorf("Expected 127.0.0.1 for an engine that forwards on loopback, found %s", host)
+	}
+}
@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+// IPOptions are the options for lovm ip
+type IPOptions struct {
+	// All lists every address instead of the one used for SSH
+	All bool
+
+	// Interface only shows addresses for the interface with this name or MAC
+	// address, e.g. ethernet1
+	Interface string
+
+	// JSON lists the addresses as JSON, like All
+	JSON bool
+
+	// Explain shows how the engine looked for the addresses
+	Explain bool
+}
+
+// ParseIPArgs parses the arguments for lovm ip
+func ParseIPArgs(args []string) (*IPOptions, error) {
+	opts := &IPOptions{}
+
+	flags := flag.NewFlagSet("ip", flag.ContinueOnError)
+	flags.BoolVar(&opts.All, "all", false, "list every address with its interface, MAC, network, and source")
+	flags.StringVar(&opts.Interface, "interface", "", "only show addresses for this interface, e.g. ethernet1")
+	flags.BoolVar(&opts.JSON, "json", false, "list the addresses as JSON")
+	flags.BoolVar(&opts.Explain, "explain", false, "show each way lovm looked for the addresses and what it found")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, errors.New("too many arguments")
+	}
+
+	return opts, nil
+}
+
+// WriteAddresses writes a table of addresses with a header, one address per
+// line. Fields without a value are shown as "-".
+func WriteAddresses(w io.Writer, addresses []core.Address) error {
+	value := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTERFACE\tMAC\tIP\tNETWORK\tSOURCE")
+	for _, addr := range addresses {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", value(addr.Interface), value(addr.MAC),
+			addr.IP, value(addr.Network), value(addr.Source))
+	}
+	return tw.Flush()
+}
+
+// ExplainAddresses asks the engine how it finds the VM's addresses. Engines
+// that only have one way are reported as a single resolution named after the
+// engine.
+func ExplainAddresses(machine core.VirtualizationEngine) ([]core.Resolution, error) {
+	if explainer, ok := machine.(core.AddressExplainer); ok {
+		_, resolutions, err := explainer.ExplainAddresses()
+		return resolutions, err
+	}
+
+	addresses, err := machine.Addresses()
+	return []core.Resolution{{Resolver: machine.Type(), Found: addresses, Err: err}}, nil
+}
+
+// WriteResolutions writes what each resolution found, one address per line,
+// or why it didn't find anything
+func WriteResolutions(w io.Writer, resolutions []core.Resolution) {
+	if len(resolutions) == 0 {
+		fmt.Fprintln(w, "no network interfaces to look for")
+	}
+
+	for _, r := range resolutions {
+		for _, addr := range r.Found {
+			network := ""
+			if addr.Network != "" {
+				network = " on " + addr.Network
+			}
+			fmt.Fprintf(w, "%s: found %s for %s%s\n", r.Resolver, addr.IP, addr.Interface, network)
+		}
+		switch {
+		case r.Err != nil:
+			fmt.Fprintf(w, "%s: failed: %s\n", r.Resolver, r.Err)
+		case len(r.Found) == 0:
+			fmt.Fprintf(w, "%s: no addresses found\n", r.Resolver)
+		}
+	}
+}
+
+// IP implements lovm ip. With no options it writes the IP used for SSH, which
+// is what scripts usually want. --interface picks the first address of
+// another interface, and --all or --json list all of them. --explain shows how
+// they were found instead.
+func IP(args []string, machine core.VirtualizationEngine) error {
+	opts, err := ParseIPArgs(args)
+	if err != nil {
+		return err
+	}
+
+	if opts.Explain {
+		resolutions, err := ExplainAddresses(machine)
+		if err != nil {
+			return err
+		}
+		WriteResolutions(os.Stdout, resolutions)
+		return nil
+	}
+
+	if !opts.All && !opts.JSON && opts.Interface == "" {
+		ip, err := machine.IP()
+		if err != nil {
+			return err
+		}
+		fmt.Println(ip)
+		return nil
+	}
+
+	addresses, err := machine.Addresses()
+	if err != nil {
+		return err
+	}
+	addresses = core.FilterAddresses(addresses, opts.Interface)
+
+	switch {
+	case opts.JSON:
+		// Write [] rather than null so scripts don't need a special case
+		if addresses == nil {
+			addresses = []core.Address{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(addresses)
+	case opts.All:
+		return WriteAddresses(os.Stdout, addresses)
+	}
+
+	if len(addresses) == 0 {
+		return fmt.Errorf("no IP address found for %s", opts.Interface)
+	}
+	fmt.Println(addresses[0].IP)
+	return nil
+}
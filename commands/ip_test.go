@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+func TestParseIPArgs(t *testing.T) {
+	opts, err := ParseIPArgs([]string{"--all", "--interface", "ethernet1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.All || opts.JSON || opts.Interface != "ethernet1" {
+		t.Errorf("Unexpected options %#v", opts)
+	}
+
+	opts, err = ParseIPArgs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *opts != (IPOptions{}) {
+		t.Errorf("Unexpected options %#v", opts)
+	}
+
+	invalid := [][]string{
+		{"ethernet1"},
+		{"--interface"},
+		{"--json", "extra"},
+	}
+	for _, args := range invalid {
+		if _, err := ParseIPArgs(args); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
+
+func TestWriteAddresses(t *testing.T) {
+	addresses := []core.Address{
+		{Interface: "ethernet0", MAC: "00:0c:29:05:6f:e3", IP: net.ParseIP("172.16.23.131"), Network: "vmnet8", Source: core.SourceDHCP},
+		{Interface: "ethernet1", IP: net.ParseIP("192.168.50.20"), Source: core.SourceStatic},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteAddresses(&buf, addresses); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `INTERFACE  MAC                IP             NETWORK  SOURCE
+ethernet0  00:0c:29:05:6f:e3  172.16.23.131  vmnet8   dhcp-lease
+ethernet1  -                  192.168.50.20  -        static
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expected, buf.String())
+	}
+}
+
+func TestWriteResolutions(t *testing.T) {
+	resolutions := []core.Resolution{
+		{Resolver: "static"},
+		{Resolver: "leases", Err: errors.New("open /private/var/db/vmware/vmnet-dhcpd-vmnet8.leases: permission denied")},
+		{Resolver: "guest-tools", Found: []core.Address{
+			{Interface: "ethernet0", IP: net.ParseIP("172.16.23.131"), Source: core.SourceGuestTools},
+		}},
+		{Resolver: "arp", Found: []core.Address{
+			{Interface: "ethernet1", IP: net.ParseIP("192.168.1.20"), Network: "vmnet0", Source: core.SourceARP},
+		}, Err: errors.New("ip neigh failed")},
+	}
+
+	var buf bytes.Buffer
+	WriteResolutions(&buf, resolutions)
+
+	expected := `static: no addresses found
+leases: failed: open /private/var/db/vmware/vmnet-dhcpd-vmnet8.leases: permission denied
+guest-tools: found 172.16.23.131 for ethernet0
+arp: found 192.168.1.20 for ethernet1 on vmnet0
+arp: failed: ip neigh failed
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expected, buf.String())
+	}
+}
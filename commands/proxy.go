@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+// ChangeDir handles lovm -C <dir> <command>, which runs the command as if lovm
+// was started in dir, like git -C. This lets tools that run lovm from
+// somewhere else, like ssh running lovm proxy, find the right machine.lovm.
+// -C may be repeated, and each dir is relative to the previous one. It
+// returns the rest of the arguments.
+func ChangeDir(args []string) ([]string, error) {
+	for len(args) > 0 && args[0] == "-C" {
+		if len(args) < 2 {
+			return nil, errors.New("-C requires a directory, e.g. lovm -C /path/to/project status")
+		}
+		if err := os.Chdir(args[1]); err != nil {
+			return nil, err
+		}
+		args = args[2:]
+	}
+	return args, nil
+}
+
+// ParseProxy parses the arguments for lovm proxy and returns the port to
+// connect to. The port defaults to SSH. Port 22 also means SSH, so it follows
+// SSHConfig.Port, e.g. when the engine forwards a host port to SSH in the
+// guest.
+func ParseProxy(args []string, config *core.MachineConfig) (port int, timeout time.Duration, err error) {
+	flags := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	flags.DurationVar(&timeout, "timeout", DefaultWaitTimeout, "how long to wait for the VM to be ready, e.g. 90s or 5m")
+
+	if err := flags.Parse(args); err != nil {
+		return 0, 0, err
+	}
+
+	switch flags.NArg() {
+	case 0:
+		port = DefaultSSHPort
+	case 1:
+		port, err = ParsePort(flags.Arg(0))
+		if err != nil {
+			return 0, 0, err
+		}
+	default:
+		return 0, 0, errors.New("expected args [port]")
+	}
+
+	if port == DefaultSSHPort {
+		port = SSHPort(config)
+	}
+
+	return port, timeout, nil
+}
+
+// PipeConn copies in to conn and conn to out until the other end closes the
+// connection. When in runs out we close our side for writing, but keep reading
+// until the other end is done, like nc -N.
+func PipeConn(conn net.Conn, in io.Reader, out io.Writer) error {
+	go func() {
+		io.Copy(conn, in)
+		closeWrite(conn)
+	}()
+
+	_, err := io.Copy(out, conn)
+	return err
+}
+
+// Proxy implements lovm proxy, which connects stdin and stdout to a port in
+// the guest, like nc. It's meant to be used as an SSH ProxyCommand, so tools
+// that want a hostname can connect to the machine without knowing its IP:
+//
+//	Host project
+//	  ProxyCommand lovm -C /path/to/project proxy 22
+//
+// If the machine was just started we wait for it to get an IP and for the
+// port to accept connections. Nothing but the connection's data is written to
+// stdout.
+func Proxy(args []string, machine core.VirtualizationEngine, config *core.MachineConfig) error {
+	port, timeout, err := ParseProxy(args, config)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+
+	ip, err := WaitForIP(machine.IP, timeout)
+	if err != nil {
+		return err
+	}
+
+	if err := WaitForPort(ip, port, timeout-time.Since(started)); err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), ProxyDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return PipeConn(conn, os.Stdin, os.Stdout)
+}
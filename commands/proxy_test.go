@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+func TestChangeDir(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(pwd)
+
+	dir, err := ioutil.TempDir("", "lovm-chdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "project"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := ChangeDir([]string{"-C", dir, "-C", "project", "proxy", "22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareLists(args, []string{"proxy", "22"}) {
+		t.Errorf("Unexpected args %q", args)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := filepath.EvalSymlinks(filepath.Join(dir, "project"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cwd, _ = filepath.EvalSymlinks(cwd); cwd != expected {
+		t.Errorf("Expected to be in %s, found %s", expected, cwd)
+	}
+
+	// Without -C nothing changes
+	args, err = ChangeDir([]string{"status", "-C", "elsewhere"})
+	if err != nil || !CompareLists(args, []string{"status", "-C", "elsewhere"}) {
+		t.Errorf("Unexpected args %q %v", args, err)
+	}
+
+	if _, err := ChangeDir([]string{"-C"}); err == nil {
+		t.Error("Expected an error for -C without a directory")
+	}
+	if _, err := ChangeDir([]string{"-C", filepath.Join(dir, "nope"), "status"}); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	config := &core.MachineConfig{}
+
+	port, timeout, err := ParseProxy(nil, config)
+	if err != nil || port != 22 || timeout != DefaultWaitTimeout {
+		t.Errorf("Expected port 22, found %d %s %v", port, timeout, err)
+	}
+
+	port, _, err = ParseProxy([]string{"--timeout", "10s", "5432"}, config)
+	if err != nil || port != 5432 {
+		t.Errorf("Expected port 5432, found %d %v", port, err)
+	}
+
+	// Port 22 follows the SSH port, e.g. QEMU's forwarded port
+	config.SSH.Port = 40022
+	for _, args := range [][]string{{}, {"22"}} {
+		if port, _, err := ParseProxy(args, config); err != nil || port != 40022 {
+			t.Errorf("%q: expected port 40022, found %d %v", args, port, err)
+		}
+	}
+
+	for _, args := range [][]string{{"ssh"}, {"0"}, {"22", "80"}} {
+		if _, _, err := ParseProxy(args, config); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
+
+func TestPipeConn(t *testing.T) {
+	guest := EchoServer(t)
+	defer guest.Close()
+
+	conn, err := net.Dial("tcp", guest.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The echo server only replies once it sees EOF, so this also checks
+	// that we pass it along
+	out := &bytes.Buffer{}
+	if err := PipeConn(conn, strings.NewReader("SSH-2.0-OpenSSH_9.6\r\n"), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "SSH-2.0-OpenSSH_9.6\r\n" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+}
@@ -0,0 +1,122 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+const setUsage = "expected args like cpus=4 memory=8G networks=nat,hostonly:vmnet1"
+
+// ParseSet applies lovm set arguments like cpus=4 or memory=8G to the config.
+// networks takes a comma-separated list, e.g. nat,bridged:en0. An empty value
+// (e.g. memory=) removes the setting, so the clone keeps what the source had
+// the next time it's cloned.
+func ParseSet(args []string, config *core.MachineConfig) error {
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s, found %q", setUsage, arg)
+		}
+		key, value := strings.ToLower(parts[0]), parts[1]
+
+		switch key {
+		case "cpus":
+			if value == "" {
+				config.CPUs = 0
+				continue
+			}
+			cpus, err := strconv.Atoi(value)
+			if err != nil || cpus < 1 {
+				return fmt.Errorf("invalid number of CPUs %q", value)
+			}
+			config.CPUs = cpus
+		case "memory":
+			if value != "" {
+				if _, err := core.ParseMemory(value); err != nil {
+					return err
+				}
+			}
+			config.Memory = value
+		case "networks":
+			var networks []core.Network
+			for _, s := range strings.Split(value, ",") {
+				if s == "" {
+					continue
+				}
+				network, err := core.ParseNetwork(s)
+				if err != nil {
+					return err
+				}
+				networks = append(networks, network)
+			}
+			config.Networks = networks
+		default:
+			return fmt.Errorf("unknown setting %q; use cpus, memory, or networks", parts[0])
+		}
+	}
+
+	return nil
+}
+
+// WriteSettings writes the hardware settings in the format lovm set takes.
+// Settings that aren't set are left out.
+func WriteSettings(config *core.MachineConfig) {
+	if config.CPUs > 0 {
+		fmt.Printf("cpus=%d\n", config.CPUs)
+	}
+	if config.Memory != "" {
+		fmt.Printf("memory=%s\n", config.Memory)
+	}
+	if len(config.Networks) > 0 {
+		var networks []string
+		for _, network := range config.Networks {
+			networks = append(networks, network.String())
+		}
+		fmt.Printf("networks=%s\n", strings.Join(networks, ","))
+	}
+}
+
+// ApplyHardware asks the engine to change the VM's hardware to match the
+// config. It only warns if the engine can't do it yet, or at all, since the
+// settings are saved either way.
+func ApplyHardware(machine core.VirtualizationEngine, config *core.MachineConfig) error {
+	if !config.HasHardware() {
+		return nil
+	}
+
+	switch err := machine.Configure(); err {
+	case nil:
+		return nil
+	case core.ErrNotStopped:
+		fmt.Fprintln(os.Stderr, "the machine is running or suspended; run lovm restart to apply the changes")
+	case core.ErrNotImplemented:
+		fmt.Fprintf(os.Stderr, "%s can't change the machine's hardware; cpus, memory, and networks are ignored\n", machine.Type())
+	default:
+		return err
+	}
+
+	return nil
+}
+
+// Set implements lovm set. The settings are saved in machine.lovm and applied
+// right away if the machine is stopped, or the next time it starts. With no
+// arguments it shows the current settings.
+func Set(args []string, machine core.VirtualizationEngine, config *core.MachineConfig) error {
+	if len(args) == 0 {
+		WriteSettings(config)
+		return nil
+	}
+
+	if err := ParseSet(args, config); err != nil {
+		return err
+	}
+
+	if !machine.Found() {
+		return nil
+	}
+	return ApplyHardware(machine, config)
+}
@@ -0,0 +1,48 @@
+package commands
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+func TestParseSet(t *testing.T) {
+	config := &core.MachineConfig{}
+
+	if err := ParseSet([]string{"cpus=4", "memory=8G", "networks=nat,hostonly:vmnet1"}, config); err != nil {
+		t.Fatal(err)
+	}
+	expected := &core.MachineConfig{
+		CPUs:   4,
+		Memory: "8G",
+		Networks: []core.Network{
+			{Type: core.NetworkNAT},
+			{Type: core.NetworkHostOnly, Name: "vmnet1"},
+		},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected %+v, found %+v", expected, config)
+	}
+
+	if err := ParseSet([]string{"memory=", "networks="}, config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Memory != "" || config.Networks != nil || config.CPUs != 4 {
+		t.Errorf("Expected only cpus to be left, found %+v", config)
+	}
+
+	invalid := [][]string{
+		{"cpus"},
+		{"cpus=0"},
+		{"cpus=four"},
+		{"memory=lots"},
+		{"networks=nat,internal"},
+		{"disk=20G"},
+	}
+	for _, args := range invalid {
+		if err := ParseSet(args, &core.MachineConfig{}); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+const snapshotUsage = "expected args save <name>, restore <name>, list, or delete <name>"
+
+// ParseSnapshot validates the arguments to lovm snapshot and returns the
+// action and the snapshot name, if there is one.
+func ParseSnapshot(args []string) (action string, name string, err error) {
+	if len(args) == 0 {
+		return "", "", errors.New(snapshotUsage)
+	}
+
+	action = args[0]
+
+	switch action {
+	case "list":
+		if len(args) != 1 {
+			return "", "", errors.New("too many arguments")
+		}
+		return action, "", nil
+	case "save", "restore", "delete":
+		if len(args) != 2 || args[1] == "" {
+			return "", "", fmt.Errorf("expected args %s <name>", action)
+		}
+		return action, args[1], nil
+	}
+
+	return "", "", errors.New(snapshotUsage)
+}
+
+func Snapshot(args []string, machine core.VirtualizationEngine) error {
+	action, name, err := ParseSnapshot(args)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "save":
+		return machine.SaveSnapshot(name)
+	case "restore":
+		return machine.RestoreSnapshot(name)
+	case "delete":
+		return machine.DeleteSnapshot(name)
+	}
+
+	names, err := machine.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+
+	return nil
+}
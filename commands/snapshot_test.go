@@ -0,0 +1,48 @@
+package commands
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSnapshot(t *testing.T) {
+	type testCase struct {
+		Action string
+		Name   string
+		Error  bool
+	}
+
+	cases := map[string]testCase{
+		``:                           {Error: true},
+		`list`:                       {Action: "list"},
+		`list extra`:                 {Error: true},
+		`save before-deploy`:         {Action: "save", Name: "before-deploy"},
+		`save`:                       {Error: true},
+		`restore before-deploy`:      {Action: "restore", Name: "before-deploy"},
+		`delete before-deploy`:       {Action: "delete", Name: "before-deploy"},
+		`delete before-deploy extra`: {Error: true},
+		`rename a b`:                 {Error: true},
+	}
+
+	for input, expected := range cases {
+		args := strings.Split(input, " ")
+		if input == "" {
+			args = []string{}
+		}
+		action, name, err := ParseSnapshot(args)
+		if expected.Error {
+			if err == nil {
+				t.Errorf("input %q: expected an error", input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("input %q: unexpected error %s", input, err)
+			continue
+		}
+		if action != expected.Action || name != expected.Name {
+			t.Errorf("input %q: expected %q %q, found %q %q", input,
+				expected.Action, expected.Name, action, name)
+		}
+	}
+}
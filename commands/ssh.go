@@ -1,147 +1,249 @@
 package commands
 
 import (
+	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 
 	"github.com/cbednarski/lovm/core"
+	"golang.org/x/crypto/ssh"
 )
 
-// SSHBoolFlags are used to identify which flags may be passed to SSH without
-// a second argument. This is a heuristic.
-const SSHBoolFlags = `46AaCfGgKkMNnqsTtVvXxYy`
+// SSHFlags lists every flag accepted by ssh, in the format used by getopt. A
+// letter followed by a colon takes a value, which may be attached (-p2222) or
+// be the next argument (-p 2222). This is copied from ssh.c in OpenSSH so
+// please keep it in sync with that rather than editing it by hand.
+const SSHFlags = `1246ab:c:e:fgi:kl:m:no:p:qstvxAB:CD:E:F:GI:J:KL:MNO:P:Q:R:S:TVw:W:XYy`
 
-// SSHOptionFlags are used to identify options that may be passed to SSH with
-// a single additional argument (no spaces). This is a heuristic.
-const SSHOptionFlags = `bcDEeFIiJLlmooOopQrRsSttWw`
+// SSHFlagArity returns 0 if flag is a boolean flag, 1 if it takes a value,
+// and -1 if ssh does not know about it.
+func SSHFlagArity(flag byte) int {
+	index := strings.IndexByte(SSHFlags, flag)
+	if index == -1 || flag == ':' {
+		return -1
+	}
+	if index+1 < len(SSHFlags) && SSHFlags[index+1] == ':' {
+		return 1
+	}
+	return 0
+}
 
-// IsSSHBoolFlags checks whether the specified flag contains one or more SSH
-// boolean flags. For example, something in the form of ssh -4 or ssh -A6
-// We do not validate these, we merely determine whether they are boolean flags
-// or whether they are options.
+// IsSSHBoolFlags checks whether the specified argument is made up of one or
+// more SSH boolean flags, for example ssh -4 or ssh -A6
 func IsSSHBoolFlags(arg string) bool {
-	if len(arg) < 2 {
-		return false
-	}
-	if arg[0] != '-' {
+	if len(arg) < 2 || arg[0] != '-' {
 		return false
 	}
 
-	for _, a := range []byte(arg[1:]) {
-		found := false
-		for _, s := range []byte(SSHBoolFlags) {
-			if a == s {
-				found = true
-			}
-		}
-		if !found {
+	for _, flag := range []byte(arg[1:]) {
+		if SSHFlagArity(flag) != 0 {
 			return false
 		}
 	}
 	return true
 }
 
+// IsSSHOptionFlag checks whether the specified argument is a single SSH flag
+// that takes a value in the following argument, for example ssh -l root
 func IsSSHOptionFlag(arg string) bool {
-	if len(arg) != 2 {
-		return false
-	}
-	if arg[0] != '-' {
+	if len(arg) != 2 || arg[0] != '-' {
 		return false
 	}
+	return SSHFlagArity(arg[1]) == 1
+}
 
-	for _, s := range []byte(SSHOptionFlags) {
-		if arg[1] == s {
-			return true
-		}
+// SSHOption is one flag from the ssh command line along with its value, if
+// it takes one.
+type SSHOption struct {
+	Flag  byte
+	Value string
+}
+
+// Keyword returns the config keyword and value for -o options, such as
+// -o User=root or -o "Port 2222". Keywords are case-insensitive, so the
+// keyword is returned in lower case. For other options it returns "".
+func (o SSHOption) Keyword() (keyword, value string) {
+	if o.Flag != 'o' {
+		return "", ""
 	}
-	return false
+	option := strings.TrimSpace(o.Value)
+	index := strings.IndexAny(option, "= \t")
+	if index == -1 {
+		return strings.ToLower(option), ""
+	}
+	value = strings.TrimLeft(option[index:], "= \t")
+	return strings.ToLower(option[:index]), value
+}
+
+// SSHArgs are the arguments passed to lovm ssh, split into the options for
+// ssh and the command to run on the remote side.
+type SSHArgs struct {
+	// Options are the flags parsed from the command line, in order
+	Options []SSHOption
+
+	// Args are the ssh arguments exactly as they were passed in, so they can
+	// be handed to ssh without being rewritten
+	Args []string
+
+	// Command is the remote command, if any
+	Command []string
 }
 
-// SplitSSHRemoteCommands identifies options and flags passed to SSH from any
-// command to be executed on the remote side. lovm ssh works by inserting the
-// virtual machine's IP address but SSH requires that all flags and options be
-// passed before the hostname argument, and any subsequent commands are passed
-// to the remote shell to be executed, so we need to be able to insert the IP
-// address *between* the SSH args and remote commands.
+// ParseSSHArgs parses arguments the same way ssh does. lovm ssh works by
+// inserting the virtual machine's IP address but SSH requires that all flags
+// and options be passed before the hostname argument, and any subsequent
+// arguments are passed to the remote shell to be executed, so we need to be
+// able to insert the IP address *between* the SSH args and remote command.
 //
 // For example:    lovm ssh -l root shutdown -h now
 // Translates to:  ssh -l root <ip> shutdown -h now
 //
-// The heuristics we are using are as follows:
-//
-// 1. Any boolean flag(s) matching SSHBoolFlags are identified and passed along
-// 2. Any option flag (starting with -) is assumed to have an argument with no
-//    spaces that follows immediately
-// 3. Any argument that does not start with - and does not satisfy #2 above
-//    marks the start of the remote command along with any subsequent arguments
-//
-// The first []string returned contains all SSH flags and options, if any are
-// present. The second []string returned contains all remote command components,
-// if any are present.
-func SplitSSHRemoteCommands(args []string) (sshArgs []string, remoteCommands []string) {
-	splitIndex := -1
+// Flags may be grouped (-At) and values may be attached (-p2222, -lroot). The
+// first argument that is not a flag, or anything after --, is the start of
+// the remote command.
+func ParseSSHArgs(args []string) (*SSHArgs, error) {
+	parsed := &SSHArgs{}
 
-	if len(args) == 0 {
-		return
-	}
-
-	for i := 0; i < len(args); i++ {
-		if IsSSHBoolFlags(args[i]) {
-			sshArgs = append(sshArgs, args[i])
-		} else if IsSSHOptionFlag(args[i]) && i+1 < len(args) {
-			sshArgs = append(sshArgs, args[i], args[i+1])
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
 			i++
-		} else {
-			splitIndex = i
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+
+		parsed.Args = append(parsed.Args, arg)
+
+		for j := 1; j < len(arg); j++ {
+			flag := arg[j]
+			switch SSHFlagArity(flag) {
+			case 0:
+				parsed.Options = append(parsed.Options, SSHOption{Flag: flag})
+				continue
+			case 1:
+				value := arg[j+1:]
+				if value == "" {
+					if i+1 >= len(args) {
+						return nil, fmt.Errorf("ssh option -%c requires a value", flag)
+					}
+					i++
+					value = args[i]
+					parsed.Args = append(parsed.Args, value)
+				}
+				parsed.Options = append(parsed.Options, SSHOption{Flag: flag, Value: value})
+			default:
+				return nil, fmt.Errorf("unknown ssh option -%c", flag)
+			}
+			// The rest of the argument was the value
 			break
 		}
 	}
 
-	if -1 < splitIndex && splitIndex < len(args) {
-		remoteCommands = append(args[splitIndex:])
+	if i < len(args) {
+		parsed.Command = args[i:]
 	}
 
-	return
+	return parsed, nil
 }
 
-func BuildSSHCommand(args []string, ip net.IP, config *core.MachineConfig) *exec.Cmd {
-	sshArgs, remoteCommands := SplitSSHRemoteCommands(args)
-
-	hasLogin := false
-	hasPrivateKeyPath := false
-
-	for _, arg := range sshArgs {
-		if arg == "-l" {
-			hasLogin = true
+// Has reports whether the option was passed as a flag (e.g. -l root) or as
+// the equivalent config keyword (e.g. -o User=root).
+func (a *SSHArgs) Has(flag byte, keyword string) bool {
+	keyword = strings.ToLower(keyword)
+	for _, option := range a.Options {
+		if option.Flag == flag {
+			return true
 		}
-		if arg == "-i" {
-			hasPrivateKeyPath = true
+		if k, _ := option.Keyword(); k == keyword {
+			return true
 		}
 	}
+	return false
+}
+
+// SplitSSHRemoteCommands separates ssh flags and options from the remote
+// command. See ParseSSHArgs. If the arguments can't be parsed they are all
+// returned as sshArgs, and ssh will report the problem.
+func SplitSSHRemoteCommands(args []string) (sshArgs []string, remoteCommands []string) {
+	parsed, err := ParseSSHArgs(args)
+	if err != nil {
+		return args, nil
+	}
+	return parsed.Args, parsed.Command
+}
+
+// BuildSSHCommand builds the ssh command to connect to ip. The login, private
+// key, and port from config are added unless they were passed in args.
+func BuildSSHCommand(args []string, ip net.IP, config *core.MachineConfig) (*exec.Cmd, error) {
+	parsed, err := ParseSSHArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	sshArgs := parsed.Args
 
 	if config != nil {
-		if config.SSH.Login != "" && !hasLogin {
+		if config.SSH.Login != "" && !parsed.Has('l', "User") {
 			sshArgs = append(sshArgs, "-l", config.SSH.Login)
 		}
-		if config.SSH.PrivateKeyPath != "" && !hasPrivateKeyPath {
+		if config.SSH.PrivateKeyPath != "" && !parsed.Has('i', "IdentityFile") {
 			sshArgs = append(sshArgs, "-i", config.SSH.PrivateKeyPath)
 		}
+		if config.SSH.Port != 0 && !parsed.Has('p', "Port") {
+			sshArgs = append(sshArgs, "-p", strconv.Itoa(config.SSH.Port))
+		}
+	}
+
+	// If the remote command starts with - we need -- so ssh doesn't read it as
+	// more options after the hostname.
+	if len(parsed.Command) > 0 && strings.HasPrefix(parsed.Command[0], "-") {
+		sshArgs = append(sshArgs, "--")
 	}
 
 	finalArgs := append(sshArgs, ip.String())
-	finalArgs = append(finalArgs, remoteCommands...)
+	finalArgs = append(finalArgs, parsed.Command...)
 
-	return exec.Command("ssh", finalArgs...)
+	return exec.Command("ssh", finalArgs...), nil
 }
 
-func SSH(args []string, machine core.VirtualizationEngine, config *core.MachineConfig) error {
-	ip, err := machine.IP()
+// SSH runs ssh against the VM's IP. If wait is true we'll wait for the VM to
+// get an IP and for SSH to be listening first (see Wait). If ssh is not
+// installed, or SSHConfig.Client is "native", we use the built-in client
+// instead (see BuiltinSSH).
+func SSH(args []string, machine core.VirtualizationEngine, config *core.MachineConfig, wait bool) error {
+	var ip net.IP
+	var err error
+	if wait {
+		ip, err = Wait(machine, config, DefaultWaitTimeout)
+	} else {
+		ip, err = machine.IP()
+	}
 	if err != nil {
 		return err
 	}
 
-	command := BuildSSHCommand(args, ip, config)
+	if UseBuiltinSSH(config) {
+		opts, err := ParseClientOptions(args, config)
+		if err != nil {
+			return err
+		}
+		err = BuiltinSSH(opts, ip)
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			return &ExitError{Code: exitErr.ExitStatus()}
+		}
+		return err
+	}
+
+	command, err := BuildSSHCommand(args, ip, config)
+	if err != nil {
+		return err
+	}
 
 	// Attach stdin, stdout, and stderr to the child process
 	command.Stdin = os.Stdin
@@ -153,8 +255,12 @@ func SSH(args []string, machine core.VirtualizationEngine, config *core.MachineC
 		return err
 	}
 
-	// Wait for it to complete
+	// Wait for it to complete. If the remote command failed, lovm will exit
+	// with the same status, as ssh does.
 	if err := command.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return &ExitError{Code: exitErr.ExitCode()}
+		}
 		return err
 	}
 
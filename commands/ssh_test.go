@@ -17,6 +17,10 @@ func TestIsSSHBoolFlags(t *testing.T) {
 		"-c":     false,
 		"-MN6XY": true,
 		"MN6XY":  false,
+		"-t":     true,
+		"-s":     true,
+		"-Ap":    false,
+		"-Z":     false,
 	}
 
 	for input, expected := range cases {
@@ -37,6 +41,8 @@ func TestIsSSHOptionFlag(t *testing.T) {
 		"c":   false,
 		"-bc": false,
 		"-q":  false,
+		"-t":  false,
+		"-J":  true,
 	}
 
 	for input, expected := range cases {
@@ -83,6 +89,18 @@ func TestSplitSSHRemoteCommands(t *testing.T) {
 			{"-l", "root"},
 			{"shutdown", "-r", "now"},
 		},
+		`-t top`: {
+			{"-t"},
+			{"top"},
+		},
+		`-lroot -p2222 uptime`: {
+			{"-lroot", "-p2222"},
+			{"uptime"},
+		},
+		`-A -- ls -la`: {
+			{"-A"},
+			{"ls", "-la"},
+		},
 	}
 
 	for input, expected := range cases {
@@ -146,12 +164,227 @@ func TestBuildSSHCommand(t *testing.T) {
 			},
 			Expected: []string{"ssh", "-l", "ubuntu", "-i", "/some/other/private/key", "192.168.1.80"},
 		},
+		{
+			Args: []string{},
+			IP:   net.ParseIP("127.0.0.1"),
+			Config: &core.MachineConfig{
+				SSH: core.SSHConfig{
+					Port: 40022,
+				},
+			},
+			Expected: []string{"ssh", "-p", "40022", "127.0.0.1"},
+		},
+		{
+			Args: []string{"-p", "22"},
+			IP:   net.ParseIP("127.0.0.1"),
+			Config: &core.MachineConfig{
+				SSH: core.SSHConfig{
+					Port: 40022,
+				},
+			},
+			Expected: []string{"ssh", "-p", "22", "127.0.0.1"},
+		},
+		{
+			// Attached values count as passing the option
+			Args: []string{"-lubuntu", "-p22", "-A", "uptime"},
+			IP:   net.ParseIP("127.0.0.1"),
+			Config: &core.MachineConfig{
+				SSH: core.SSHConfig{
+					Login: "root",
+					Port:  40022,
+				},
+			},
+			Expected: []string{"ssh", "-lubuntu", "-p22", "-A", "127.0.0.1", "uptime"},
+		},
+		{
+			// So do the equivalent -o options
+			Args: []string{"-o", "User=ubuntu", "-oIdentityFile=/some/other/key", "-o", "port 22"},
+			IP:   net.ParseIP("127.0.0.1"),
+			Config: &core.MachineConfig{
+				SSH: core.SSHConfig{
+					Login:          "root",
+					PrivateKeyPath: "/path/to/private/key",
+					Port:           40022,
+				},
+			},
+			Expected: []string{"ssh", "-o", "User=ubuntu", "-oIdentityFile=/some/other/key", "-o", "port 22", "127.0.0.1"},
+		},
+		{
+			// Other -o options don't
+			Args: []string{"-o", "ServerAliveInterval=30"},
+			IP:   net.ParseIP("192.168.1.80"),
+			Config: &core.MachineConfig{
+				SSH: core.SSHConfig{
+					Login: "root",
+				},
+			},
+			Expected: []string{"ssh", "-o", "ServerAliveInterval=30", "-l", "root", "192.168.1.80"},
+		},
+		{
+			// -t was previously mistaken for an option with a value
+			Args:     []string{"-t", "top"},
+			IP:       net.ParseIP("192.168.1.80"),
+			Expected: []string{"ssh", "-t", "192.168.1.80", "top"},
+		},
+		{
+			Args: []string{"-v", "--", "-c", "exit"},
+			IP:   net.ParseIP("192.168.1.80"),
+			Config: &core.MachineConfig{
+				SSH: core.SSHConfig{
+					Login: "root",
+				},
+			},
+			Expected: []string{"ssh", "-v", "-l", "root", "--", "192.168.1.80", "-c", "exit"},
+		},
 	}
 
 	for _, c := range cases {
-		output := BuildSSHCommand(c.Args, c.IP, c.Config)
+		output, err := BuildSSHCommand(c.Args, c.IP, c.Config)
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %s", c.Args, err)
+			continue
+		}
 		if !CompareLists(c.Expected, output.Args) {
 			t.Errorf("Expected command %v, found %v", c.Expected, output.Args)
 		}
 	}
+
+	for _, args := range [][]string{{"-Z"}, {"-l"}, {"-A", "-p"}} {
+		if _, err := BuildSSHCommand(args, net.ParseIP("192.168.1.80"), nil); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestParseSSHArgs(t *testing.T) {
+	type testCase struct {
+		Args    []string
+		Options []SSHOption
+		Command []string
+	}
+
+	cases := []testCase{
+		{
+			Args: []string{},
+		},
+		{
+			Args:    []string{"-A", "-t", "htop"},
+			Options: []SSHOption{{Flag: 'A'}, {Flag: 't'}},
+			Command: []string{"htop"},
+		},
+		{
+			Args:    []string{"-At", "htop"},
+			Options: []SSHOption{{Flag: 'A'}, {Flag: 't'}},
+			Command: []string{"htop"},
+		},
+		{
+			// -s is a boolean flag, so sftp is the remote command
+			Args:    []string{"-s", "sftp"},
+			Options: []SSHOption{{Flag: 's'}},
+			Command: []string{"sftp"},
+		},
+		{
+			Args:    []string{"-p2222", "-lroot", "-i/path/to/key"},
+			Options: []SSHOption{{'p', "2222"}, {'l', "root"}, {'i', "/path/to/key"}},
+		},
+		{
+			// Values may follow boolean flags in the same argument
+			Args:    []string{"-Ap", "2222", "uptime"},
+			Options: []SSHOption{{Flag: 'A'}, {'p', "2222"}},
+			Command: []string{"uptime"},
+		},
+		{
+			Args:    []string{"-vvl", "root"},
+			Options: []SSHOption{{Flag: 'v'}, {Flag: 'v'}, {'l', "root"}},
+		},
+		{
+			Args:    []string{"-oUser=root", "-o", "Port 2222"},
+			Options: []SSHOption{{'o', "User=root"}, {'o', "Port 2222"}},
+		},
+		{
+			Args:    []string{"-L", "8080:localhost:80", "-N"},
+			Options: []SSHOption{{'L', "8080:localhost:80"}, {Flag: 'N'}},
+		},
+		{
+			Args:    []string{"-J", "bastion", "-W", "localhost:22"},
+			Options: []SSHOption{{'J', "bastion"}, {'W', "localhost:22"}},
+		},
+		{
+			// Values that look like flags are still values
+			Args:    []string{"-l", "-A", "whoami"},
+			Options: []SSHOption{{'l', "-A"}},
+			Command: []string{"whoami"},
+		},
+		{
+			Args:    []string{"-l", "root", "--", "-weird-command", "-x"},
+			Options: []SSHOption{{'l', "root"}},
+			Command: []string{"-weird-command", "-x"},
+		},
+		{
+			// Flags after the command belong to the command
+			Args:    []string{"ls", "-la"},
+			Command: []string{"ls", "-la"},
+		},
+		{
+			Args:    []string{"-", "-A"},
+			Command: []string{"-", "-A"},
+		},
+	}
+
+	for _, c := range cases {
+		parsed, err := ParseSSHArgs(c.Args)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %s", c.Args, err)
+			continue
+		}
+		if len(parsed.Options) != len(c.Options) {
+			t.Errorf("Expected options %q for %q, found %q", c.Options, c.Args, parsed.Options)
+		} else {
+			for i := range c.Options {
+				if parsed.Options[i] != c.Options[i] {
+					t.Errorf("Expected options %q for %q, found %q", c.Options, c.Args, parsed.Options)
+					break
+				}
+			}
+		}
+		if !CompareLists(parsed.Command, c.Command) {
+			t.Errorf("Expected command %q for %q, found %q", c.Command, c.Args, parsed.Command)
+		}
+	}
+
+	errorCases := []struct {
+		Args    []string
+		Message string
+	}{
+		{[]string{"-Z"}, "unknown ssh option -Z"},
+		{[]string{"-AZ", "host"}, "unknown ssh option -Z"},
+		{[]string{"-p"}, "ssh option -p requires a value"},
+		{[]string{"-A", "-o"}, "ssh option -o requires a value"},
+	}
+	for _, c := range errorCases {
+		_, err := ParseSSHArgs(c.Args)
+		if err == nil || err.Error() != c.Message {
+			t.Errorf("Expected error %q for %q, found %v", c.Message, c.Args, err)
+		}
+	}
+}
+
+func TestSSHOptionKeyword(t *testing.T) {
+	cases := map[string][2]string{
+		"User=root":              {"user", "root"},
+		"IdentityFile ~/.ssh/id": {"identityfile", "~/.ssh/id"},
+		"Port = 2222":            {"port", "2222"},
+		"BatchMode":              {"batchmode", ""},
+	}
+
+	for input, expected := range cases {
+		keyword, value := SSHOption{'o', input}.Keyword()
+		if keyword != expected[0] || value != expected[1] {
+			t.Errorf("Expected %q for %q, found %q %q", expected, input, keyword, value)
+		}
+	}
+
+	if keyword, _ := (SSHOption{'l', "User=root"}).Keyword(); keyword != "" {
+		t.Errorf("Expected no keyword for -l, found %q", keyword)
+	}
 }
@@ -0,0 +1,322 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cbednarski/lovm/core"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+)
+
+const (
+	// DefaultSSHPort is used by the built-in client if SSHConfig.Port is not set
+	DefaultSSHPort = 22
+
+	// SSHDialTimeout limits how long the built-in client waits to connect
+	SSHDialTimeout = 30 * time.Second
+)
+
+// DefaultIdentityFiles are tried by the built-in client when no private key is
+// configured, the same as ssh does. They are relative to ~/.ssh
+var DefaultIdentityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// ClientOptions controls the built-in SSH client. These are filled in from
+// MachineConfig and the handful of ssh flags the built-in client understands.
+type ClientOptions struct {
+	Login          string
+	PrivateKeyPath string
+	Port           int
+	ForwardAgent   bool
+
+	// TTY forces (1) or disables (-1) PTY allocation, like ssh -t and -T. By
+	// default (0) we allocate a PTY for interactive shells only.
+	TTY int
+
+	// Command is run on the remote side. If empty we start a login shell.
+	Command []string
+}
+
+// UseBuiltinSSH reports whether lovm ssh should use the built-in client
+// rather than running ssh (see SSHConfig.Client).
+func UseBuiltinSSH(config *core.MachineConfig) bool {
+	if config != nil {
+		switch config.SSH.Client {
+		case "native":
+			return true
+		case "openssh":
+			return false
+		}
+	}
+	_, err := exec.LookPath("ssh")
+	return err != nil
+}
+
+// ParseClientOptions builds options for the built-in client. Values from the
+// command line take precedence over MachineConfig, as they do for ssh. Since
+// the built-in client is not a drop-in replacement for ssh, only -l, -i, -p,
+// -A, -t and -T are supported. Anything else is an error rather than being
+// silently ignored.
+func ParseClientOptions(args []string, config *core.MachineConfig) (*ClientOptions, error) {
+	opts := &ClientOptions{}
+	if config != nil {
+		opts.Login = config.SSH.Login
+		opts.PrivateKeyPath = config.SSH.PrivateKeyPath
+		opts.Port = config.SSH.Port
+		opts.ForwardAgent = config.SSH.ForwardAgent
+	}
+
+	parsed, err := ParseSSHArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	opts.Command = parsed.Command
+
+	for _, option := range parsed.Options {
+		switch option.Flag {
+		case 'l':
+			opts.Login = option.Value
+		case 'i':
+			opts.PrivateKeyPath = option.Value
+		case 'p':
+			port, err := strconv.Atoi(option.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q", option.Value)
+			}
+			opts.Port = port
+		case 'A':
+			opts.ForwardAgent = true
+		case 't':
+			opts.TTY = 1
+		case 'T':
+			opts.TTY = -1
+		default:
+			return nil, fmt.Errorf("-%c is not supported by the built-in ssh client", option.Flag)
+		}
+	}
+
+	if opts.Login == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, errors.New("unable to determine the SSH login; set ssh-config.login or use -l")
+		}
+		opts.Login = current.Username
+	}
+
+	if opts.Port == 0 {
+		opts.Port = DefaultSSHPort
+	}
+
+	return opts, nil
+}
+
+// KnownHostsCallback verifies host keys against the known_hosts file at path.
+// The first time we see a host its key is added to the file. After that, a
+// different key is an error.
+//
+// Each machine has its own known_hosts file (see core.KnownHostsFile) so when
+// DHCP hands a VM's IP address to a different VM it doesn't trip over keys
+// from the old one. The file is removed when the machine is deleted.
+func KnownHostsCallback(path string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		// knownhosts.New fails if the file does not exist yet
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		check, err := knownhosts.New(path)
+		if err != nil {
+			return err
+		}
+
+		err = check(hostname, remote, key)
+
+		keyErr := &knownhosts.KeyError{}
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) > 0 {
+				return fmt.Errorf("the host key for %s has changed; if the VM was rebuilt outside of lovm, remove %s and try again", hostname, path)
+			}
+			line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+			_, err = file.WriteString(line + "\n")
+		}
+
+		return err
+	}
+}
+
+// AuthMethods returns the ways the built-in client will try to log in: the
+// configured private key (or the default keys in ~/.ssh), then the SSH agent,
+// and finally a password prompt if we're attached to a terminal.
+func AuthMethods(opts *ClientOptions) []ssh.AuthMethod {
+	var signers []ssh.Signer
+
+	if opts.PrivateKeyPath != "" {
+		signer, err := ReadPrivateKey(opts.PrivateKeyPath, true)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to use private key %s: %s\n", opts.PrivateKeyPath, err)
+		} else {
+			signers = append(signers, signer)
+		}
+	} else if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range DefaultIdentityFiles {
+			signer, err := ReadPrivateKey(filepath.Join(home, ".ssh", name), false)
+			if err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+
+	var methods []ssh.AuthMethod
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		methods = append(methods, ssh.PasswordCallback(func() (string, error) {
+			return promptSecret(fmt.Sprintf("%s's password: ", opts.Login))
+		}))
+	}
+
+	return methods
+}
+
+// ReadPrivateKey loads a private key. If the key is encrypted and prompt is
+// true we'll ask for the passphrase.
+func ReadPrivateKey(path string, prompt bool) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok && prompt && term.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase, err := promptSecret(fmt.Sprintf("Enter passphrase for key '%s': ", path))
+		if err != nil {
+			return nil, err
+		}
+		return ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+
+	return signer, err
+}
+
+func promptSecret(prompt string) (string, error) {
+	os.Stderr.WriteString(prompt)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	os.Stderr.WriteString("\n")
+	return string(secret), err
+}
+
+// DialSSH connects and logs in to ip with the built-in client. Host keys are
+// checked against the machine's known_hosts file (see KnownHostsCallback).
+func DialSSH(opts *ClientOptions, ip net.IP) (*ssh.Client, error) {
+	clientConfig := &ssh.ClientConfig{
+		User:            opts.Login,
+		Auth:            AuthMethods(opts),
+		HostKeyCallback: KnownHostsCallback(filepath.FromSlash(core.KnownHostsFile)),
+		Timeout:         SSHDialTimeout,
+	}
+
+	address := net.JoinHostPort(ip.String(), strconv.Itoa(opts.Port))
+	return ssh.Dial("tcp", address, clientConfig)
+}
+
+// BuiltinSSH connects to ip using the SSH client built into lovm, so lovm ssh
+// works on hosts without an OpenSSH client. Stdin, stdout and stderr are
+// attached to the remote session. If the remote command fails the returned
+// error is an *ssh.ExitError with its exit status.
+func BuiltinSSH(opts *ClientOptions, ip net.IP) error {
+	client, err := DialSSH(opts, ip)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if opts.ForwardAgent {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return errors.New("agent forwarding requires SSH_AUTH_SOCK to be set")
+		}
+		if err := agent.ForwardToRemote(client, socket); err != nil {
+			return err
+		}
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return err
+		}
+	}
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	stdin := int(os.Stdin.Fd())
+	interactive := term.IsTerminal(stdin)
+	if opts.TTY > 0 || (opts.TTY == 0 && len(opts.Command) == 0 && interactive) {
+		width, height, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			width, height = 80, 24
+		}
+
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm"
+		}
+
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err := session.RequestPty(termType, height, width, modes); err != nil {
+			return err
+		}
+
+		// The remote side handles echo and line editing now, so pass our
+		// keystrokes through untouched.
+		if interactive {
+			state, err := term.MakeRaw(stdin)
+			if err != nil {
+				return err
+			}
+			defer term.Restore(stdin, state)
+		}
+	}
+
+	if len(opts.Command) > 0 {
+		return session.Run(strings.Join(opts.Command, " "))
+	}
+
+	if err := session.Shell(); err != nil {
+		return err
+	}
+	return session.Wait()
+}
@@ -0,0 +1,126 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cbednarski/lovm/core"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseClientOptions(t *testing.T) {
+	config := &core.MachineConfig{
+		SSH: core.SSHConfig{
+			Login:          "centos",
+			PrivateKeyPath: "/home/user/.ssh/id_rsa",
+			Port:           2222,
+		},
+	}
+
+	opts, err := ParseClientOptions([]string{"-l", "root", "-At", "uptime", "-p"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Login != "root" {
+		t.Errorf("Expected login root, found %s", opts.Login)
+	}
+	if opts.PrivateKeyPath != "/home/user/.ssh/id_rsa" {
+		t.Errorf("Expected the configured private key, found %s", opts.PrivateKeyPath)
+	}
+	if opts.Port != 2222 {
+		t.Errorf("Expected port 2222, found %d", opts.Port)
+	}
+	if !opts.ForwardAgent {
+		t.Error("Expected agent forwarding")
+	}
+	if opts.TTY != 1 {
+		t.Errorf("Expected PTY to be forced, found %d", opts.TTY)
+	}
+	if !CompareLists(opts.Command, []string{"uptime", "-p"}) {
+		t.Errorf("Expected command uptime -p, found %q", opts.Command)
+	}
+
+	opts, err = ParseClientOptions([]string{"-p", "22"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Port != 22 {
+		t.Errorf("Expected port 22, found %d", opts.Port)
+	}
+
+	for _, args := range [][]string{{"-L", "8080:localhost:80"}, {"-X"}, {"-p", "ssh"}} {
+		if _, err := ParseClientOptions(args, config); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer.PublicKey()
+}
+
+func TestKnownHostsCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lovm-known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".lovm", "known_hosts")
+	callback := KnownHostsCallback(path)
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.56.101"), Port: 22}
+	key := newHostKey(t)
+
+	// The first connection learns the key
+	if err := callback("192.168.56.101:22", remote, key); err != nil {
+		t.Fatalf("Expected the key to be learned: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "192.168.56.101 ssh-ed25519 ") {
+		t.Errorf("Unexpected known_hosts contents: %s", data)
+	}
+
+	// Seeing the same key again is fine, and doesn't add another line
+	if err := callback("192.168.56.101:22", remote, key); err != nil {
+		t.Errorf("Expected the known key to be accepted: %s", err)
+	}
+	data, _ = ioutil.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("Expected 1 line in known_hosts, found %d", lines)
+	}
+
+	// A different key for the same host is rejected
+	if err := callback("192.168.56.101:22", remote, newHostKey(t)); err == nil {
+		t.Error("Expected a changed host key to be rejected")
+	}
+
+	// Forwarded ports are recorded separately
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222}
+	if err := callback("127.0.0.1:2222", local, newHostKey(t)); err != nil {
+		t.Errorf("Expected the key to be learned: %s", err)
+	}
+	data, _ = ioutil.ReadFile(path)
+	if !strings.Contains(string(data), "\n[127.0.0.1]:2222 ssh-ed25519 ") {
+		t.Errorf("Unexpected known_hosts contents: %s", data)
+	}
+}
@@ -0,0 +1,214 @@
+package commands
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+// SSHConfigDir is where lovm ssh-config --write puts the generated config for
+// each machine, relative to the user's home directory. Add this to the top of
+// ~/.ssh/config to use them:
+//
+//	Include ~/.ssh/lovm.d/*
+const SSHConfigDir = ".ssh/lovm.d"
+
+// ParseSSHConfig parses the flags for lovm ssh-config. --write saves the host
+// alias and keeps a config file for it in SSHConfigDir. --remove undoes that.
+func ParseSSHConfig(args []string) (alias string, write, remove bool, err error) {
+	flags := flag.NewFlagSet("ssh-config", flag.ContinueOnError)
+	flags.StringVar(&alias, "host-alias", "", "name of the Host entry (defaults to the directory name)")
+	flags.BoolVar(&write, "write", false, "keep ~/"+SSHConfigDir+"/<alias> up to date when the VM starts and stops")
+	flags.BoolVar(&remove, "remove", false, "stop updating ~/"+SSHConfigDir+"/<alias> and remove it")
+
+	if err := flags.Parse(args); err != nil {
+		return "", false, false, err
+	}
+	if flags.NArg() > 0 {
+		return "", false, false, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	if write && remove {
+		return "", false, false, fmt.Errorf("--write and --remove can't be used together")
+	}
+
+	return alias, write, remove, nil
+}
+
+// HostAlias returns the Host name to use in the SSH config. If none has been
+// configured we use the name of the directory the machine lives in.
+func HostAlias(dir string, config *core.MachineConfig) string {
+	if config.SSH.HostAlias != "" {
+		return config.SSH.HostAlias
+	}
+	return filepath.Base(dir)
+}
+
+// SSHConfigPath returns the path of the generated config file for alias
+func SSHConfigPath(alias string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, filepath.FromSlash(SSHConfigDir), alias), nil
+}
+
+// quoteSSHConfig quotes a value if it has spaces, e.g. an IdentityFile path
+func quoteSSHConfig(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// WriteSSHConfig writes a Host block for the machine, so tools that read
+// ~/.ssh/config (scp, rsync, Ansible, editors, etc.) can connect to it.
+//
+// The host key is checked against knownHosts, the machine's own known_hosts
+// file (see core.KnownHostsFile), and learned the first time we connect. This
+// avoids host key warnings when a new VM gets the IP address of an old one,
+// since the file is removed when the machine is deleted.
+func WriteSSHConfig(w io.Writer, alias string, ip net.IP, config *core.MachineConfig, knownHosts string) error {
+	buf := &bytes.Buffer{}
+
+	fmt.Fprintf(buf, "Host %s\n", alias)
+	fmt.Fprintf(buf, "  HostName %s\n", ip)
+	if config.SSH.Login != "" {
+		fmt.Fprintf(buf, "  User %s\n", config.SSH.Login)
+	}
+	if config.SSH.Port != 0 {
+		fmt.Fprintf(buf, "  Port %d\n", config.SSH.Port)
+	}
+	if config.SSH.PrivateKeyPath != "" {
+		fmt.Fprintf(buf, "  IdentityFile %s\n", quoteSSHConfig(config.SSH.PrivateKeyPath))
+		fmt.Fprintf(buf, "  IdentitiesOnly yes\n")
+	}
+	if config.SSH.ForwardAgent {
+		fmt.Fprintf(buf, "  ForwardAgent yes\n")
+	}
+	fmt.Fprintf(buf, "  UserKnownHostsFile %s\n", quoteSSHConfig(knownHosts))
+	fmt.Fprintf(buf, "  StrictHostKeyChecking accept-new\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// SaveSSHConfig writes the Host block for the machine to SSHConfigPath
+func SaveSSHConfig(alias string, ip net.IP, config *core.MachineConfig, dir string) error {
+	path, err := SSHConfigPath(alias)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# Generated by lovm for %s; changes will be overwritten\n", dir)
+	knownHosts := filepath.Join(dir, filepath.FromSlash(core.KnownHostsFile))
+	if err := WriteSSHConfig(buf, alias, ip, config, knownHosts); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// RemoveSSHConfig removes the generated config file for alias, if any
+func RemoveSSHConfig(alias string) error {
+	path, err := SSHConfigPath(alias)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SyncSSHConfig keeps the generated config file in step with the machine if
+// SSHConfig.ConfigFile is set. This is called after the VM is started or
+// stopped. If the VM is running we wait for its IP address and write the
+// file. Otherwise we remove it, so ssh won't try to connect to an address
+// that may have been given to another VM.
+func SyncSSHConfig(machine core.VirtualizationEngine, config *core.MachineConfig, dir string) error {
+	if !config.SSH.ConfigFile {
+		return nil
+	}
+
+	alias := HostAlias(dir, config)
+
+	state, err := machine.State()
+	if err != nil {
+		return err
+	}
+	if state != core.StateRunning {
+		return RemoveSSHConfig(alias)
+	}
+
+	ip, err := WaitForIP(machine.IP, DefaultWaitTimeout)
+	if err != nil {
+		return err
+	}
+
+	return SaveSSHConfig(alias, ip, config, dir)
+}
+
+// ShowSSHConfig implements lovm ssh-config. It writes the Host block for the
+// machine to stdout, and saves or removes the generated config file if asked.
+func ShowSSHConfig(args []string, machine core.VirtualizationEngine, config *core.MachineConfig, dir string) error {
+	alias, write, remove, err := ParseSSHConfig(args)
+	if err != nil {
+		return err
+	}
+
+	previous := HostAlias(dir, config)
+
+	if remove {
+		config.SSH.ConfigFile = false
+		config.SSH.HostAlias = ""
+		return RemoveSSHConfig(previous)
+	}
+
+	if alias == "" {
+		alias = previous
+	}
+
+	ip, err := machine.IP()
+	if err != nil {
+		return err
+	}
+
+	knownHosts := filepath.Join(dir, filepath.FromSlash(core.KnownHostsFile))
+	if err := WriteSSHConfig(os.Stdout, alias, ip, config, knownHosts); err != nil {
+		return err
+	}
+
+	if !write {
+		return nil
+	}
+
+	// Don't leave the old file behind if the alias changed
+	if previous != alias && config.SSH.ConfigFile {
+		if err := RemoveSSHConfig(previous); err != nil {
+			return err
+		}
+	}
+
+	config.SSH.HostAlias = alias
+	config.SSH.ConfigFile = true
+
+	if err := SaveSSHConfig(alias, ip, config, dir); err != nil {
+		return err
+	}
+
+	path, _ := SSHConfigPath(alias)
+	fmt.Fprintf(os.Stderr, "wrote %s; add \"Include ~/%s/*\" to the top of ~/.ssh/config to use it\n", path, SSHConfigDir)
+	return nil
+}
@@ -0,0 +1,117 @@
+package commands
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+func TestParseSSHConfig(t *testing.T) {
+	alias, write, remove, err := ParseSSHConfig([]string{"--host-alias", "dev", "--write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alias != "dev" || !write || remove {
+		t.Errorf("Expected dev --write, found %q %t %t", alias, write, remove)
+	}
+
+	if _, _, _, err := ParseSSHConfig([]string{"--write", "--remove"}); err == nil {
+		t.Error("Expected an error for --write and --remove")
+	}
+	if _, _, _, err := ParseSSHConfig([]string{"dev"}); err == nil {
+		t.Error("Expected an error for an extra argument")
+	}
+}
+
+func TestHostAlias(t *testing.T) {
+	config := &core.MachineConfig{}
+	if alias := HostAlias("/home/user/src/project", config); alias != "project" {
+		t.Errorf("Expected project, found %s", alias)
+	}
+
+	config.SSH.HostAlias = "dev"
+	if alias := HostAlias("/home/user/src/project", config); alias != "dev" {
+		t.Errorf("Expected dev, found %s", alias)
+	}
+}
+
+func TestWriteSSHConfig(t *testing.T) {
+	config := &core.MachineConfig{
+		SSH: core.SSHConfig{
+			Login:          "centos",
+			PrivateKeyPath: "/home/user/My Keys/id_rsa",
+			Port:           2222,
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	err := WriteSSHConfig(buf, "project", net.ParseIP("127.0.0.1"), config, "/home/user/src/project/.lovm/known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `Host project
+  HostName 127.0.0.1
+  User centos
+  Port 2222
+  IdentityFile "/home/user/My Keys/id_rsa"
+  IdentitiesOnly yes
+  UserKnownHostsFile /home/user/src/project/.lovm/known_hosts
+  StrictHostKeyChecking accept-new
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	err = WriteSSHConfig(buf, "project", net.ParseIP("192.168.56.101"), &core.MachineConfig{}, "/tmp/known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "User ") || strings.Contains(buf.String(), "Port ") || strings.Contains(buf.String(), "IdentityFile ") {
+		t.Errorf("Expected unset options to be left out:\n%s", buf.String())
+	}
+}
+
+func TestSaveSSHConfig(t *testing.T) {
+	home, err := ioutil.TempDir("", "lovm-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	config := &core.MachineConfig{SSH: core.SSHConfig{Login: "centos"}}
+	if err := SaveSSHConfig("project", net.ParseIP("192.168.56.101"), config, "/home/user/src/project"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(home, ".ssh", "lovm.d", "project")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "Host project\n  HostName 192.168.56.101\n") {
+		t.Errorf("Unexpected config file:\n%s", data)
+	}
+
+	if err := RemoveSSHConfig("project"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed", path)
+	}
+
+	// Removing it again is fine
+	if err := RemoveSSHConfig("project"); err != nil {
+		t.Error(err)
+	}
+}
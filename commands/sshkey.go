@@ -0,0 +1,116 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cbednarski/lovm/core"
+	"golang.org/x/crypto/ssh"
+)
+
+// GenerateSSHKey creates a new ed25519 key with no passphrase. The private key
+// is written to path in OpenSSH format and the public key to path + ".pub".
+// It returns the public key in authorized_keys format.
+func GenerateSSHKey(path, comment string) (string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := ssh.MarshalPrivateKey(private, comment)
+	if err != nil {
+		return "", err
+	}
+
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublic))) + " " + comment + "\n"
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path+".pub", []byte(authorizedKey), 0644); err != nil {
+		return "", err
+	}
+
+	return authorizedKey, nil
+}
+
+// SSHKeyPath returns the absolute path to the key generated for the machine in
+// dir
+func SSHKeyPath(dir string) string {
+	return filepath.Join(dir, filepath.FromSlash(core.SSHKeyFile))
+}
+
+// SetupSSHKey generates an SSH key for the machine if SSHConfig.GenerateKey is
+// set and it doesn't have one yet, and points PrivateKeyPath at it. Then, if
+// the key has not been installed in the guest, we ask the engine to install
+// it. That may have to wait until the machine is running, so lovm start calls
+// this again after it starts if the key wasn't installed yet.
+//
+// If the engine can't install the key we only print a warning, since the
+// machine itself is fine and the user can install the key some other way.
+func SetupSSHKey(machine core.VirtualizationEngine, config *core.MachineConfig, dir string) error {
+	if !config.SSH.GenerateKey || !machine.Found() {
+		return nil
+	}
+
+	path := SSHKeyPath(dir)
+	publicKey, err := ioutil.ReadFile(path + ".pub")
+	if os.IsNotExist(err) {
+		key, err := GenerateSSHKey(path, "lovm@"+filepath.Base(dir))
+		if err != nil {
+			return err
+		}
+		publicKey = []byte(key)
+		config.SSH.KeyInstalled = false
+	} else if err != nil {
+		return err
+	}
+	config.SSH.PrivateKeyPath = path
+
+	if config.SSH.KeyInstalled {
+		return nil
+	}
+
+	switch err := machine.InstallSSHKey(string(publicKey)); err {
+	case nil:
+		config.SSH.KeyInstalled = true
+	case core.ErrNotRunning:
+		// We'll install it after the machine starts
+	case core.ErrNotImplemented:
+		fmt.Fprintf(os.Stderr, "%s can't install SSH keys in the guest; add %s.pub to "+
+			"authorized_keys in the guest yourself\n", machine.Type(), path)
+	default:
+		fmt.Fprintf(os.Stderr, "unable to install the SSH key in the guest (%s); lovm "+
+			"will try again the next time the machine starts\n", err)
+	}
+
+	return nil
+}
+
+// RemoveSSHKey deletes the machine's generated SSH key, so the next clone gets
+// a new one
+func RemoveSSHKey(config *core.MachineConfig, dir string) error {
+	config.SSH.KeyInstalled = false
+
+	path := SSHKeyPath(dir)
+	for _, file := range []string{path, path + ".pub"} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cbednarski/lovm/core"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateSSHKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lovm-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".lovm", "id_ed25519")
+	authorizedKey, err := GenerateSSHKey(path, "lovm@project")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public.Type() != ssh.KeyAlgoED25519 || comment != "lovm@project" {
+		t.Errorf("Unexpected public key %q", authorizedKey)
+	}
+
+	signer, err := ReadPrivateKey(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(signer.PublicKey().Marshal()) != string(public.Marshal()) {
+		t.Error("Expected the private key to match the public key")
+	}
+
+	CheckMode(t, path, 0600)
+	CheckMode(t, path+".pub", 0644)
+}
+
+// KeyEngine records the keys it is asked to install
+type KeyEngine struct {
+	core.VirtualizationEngine
+	Keys []string
+	Err  error
+}
+
+func (e *KeyEngine) Type() string {
+	return "test"
+}
+
+func (e *KeyEngine) Found() bool {
+	return true
+}
+
+func (e *KeyEngine) InstallSSHKey(publicKey string) error {
+	e.Keys = append(e.Keys, publicKey)
+	return e.Err
+}
+
+func TestSetupSSHKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lovm-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &core.MachineConfig{}
+	machine := &KeyEngine{Err: core.ErrNotRunning}
+
+	// Nothing happens unless it's turned on
+	if err := SetupSSHKey(machine, config, dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(machine.Keys) != 0 || config.SSH.PrivateKeyPath != "" {
+		t.Errorf("Expected no key, found %v %q", machine.Keys, config.SSH.PrivateKeyPath)
+	}
+
+	config.SSH.GenerateKey = true
+
+	// Before the machine starts
+	if err := SetupSSHKey(machine, config, dir); err != nil {
+		t.Fatal(err)
+	}
+	if config.SSH.PrivateKeyPath != SSHKeyPath(dir) || config.SSH.KeyInstalled {
+		t.Errorf("Expected a key that isn't installed yet, found %#v", config.SSH)
+	}
+
+	// After it starts
+	machine.Err = nil
+	if err := SetupSSHKey(machine, config, dir); err != nil {
+		t.Fatal(err)
+	}
+	if !config.SSH.KeyInstalled || len(machine.Keys) != 2 || machine.Keys[0] != machine.Keys[1] {
+		t.Errorf("Expected the same key to be installed, found %q", machine.Keys)
+	}
+
+	// Once it's installed we leave it alone
+	if err := SetupSSHKey(machine, config, dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(machine.Keys) != 2 {
+		t.Errorf("Expected the key to be installed once, found %q", machine.Keys)
+	}
+
+	// A new clone gets a new key
+	if err := RemoveSSHKey(config, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetupSSHKey(machine, config, dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(machine.Keys) != 3 || machine.Keys[2] == machine.Keys[0] || !config.SSH.KeyInstalled {
+		t.Errorf("Expected a new key to be installed, found %q", machine.Keys)
+	}
+}
@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+// WriteStatus writes a summary of the machine in a format that is easy to read
+// and easy to parse with a shell script, one "key: value" per line. The state
+// is always on the first line. Fields without a value are shown as "-".
+func WriteStatus(w io.Writer, engine string, state core.State, ip net.IP, config *core.MachineConfig) {
+	value := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	address := ""
+	if ip != nil {
+		address = ip.String()
+	}
+
+	fmt.Fprintf(w, "state:   %s\n", state)
+	fmt.Fprintf(w, "engine:  %s\n", engine)
+	fmt.Fprintf(w, "source:  %s\n", value(config.Source))
+	fmt.Fprintf(w, "path:    %s\n", value(config.Path))
+	fmt.Fprintf(w, "ip:      %s\n", value(address))
+
+	var hostPaths []string
+	for hostPath := range config.Mounts {
+		hostPaths = append(hostPaths, hostPath)
+	}
+	sort.Strings(hostPaths)
+
+	if len(hostPaths) == 0 {
+		fmt.Fprintf(w, "mounts:  -\n")
+	}
+	for _, hostPath := range hostPaths {
+		fmt.Fprintf(w, "mounts:  %s -> %s\n", hostPath, config.Mounts[hostPath])
+	}
+}
+
+func Status(machine core.VirtualizationEngine, config *core.MachineConfig) error {
+	state, err := machine.State()
+	if err != nil {
+		return err
+	}
+
+	// The IP is only meaningful while the machine is running, and even then
+	// it may not be available yet (e.g. the guest is still booting), which is
+	// not an error as far as status is concerned.
+	var ip net.IP
+	if state == core.StateRunning {
+		ip, _ = machine.IP()
+	}
+
+	WriteStatus(os.Stdout, machine.Type(), state, ip, config)
+
+	return nil
+}
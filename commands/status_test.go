@@ -0,0 +1,49 @@
+package commands
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+func TestWriteStatus(t *testing.T) {
+	config := &core.MachineConfig{
+		Source: "/vms/centos7/centos7.vmx",
+		Path:   "/project/.lovm/project/project.vmx",
+		Mounts: map[string]string{
+			"/project/src":  "/srv/src",
+			"/project/logs": "/var/log/app",
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	WriteStatus(buf, "vmware", core.StateRunning, net.ParseIP("172.16.23.131"), config)
+
+	expected := `state:   running
+engine:  vmware
+source:  /vms/centos7/centos7.vmx
+path:    /project/.lovm/project/project.vmx
+ip:      172.16.23.131
+mounts:  /project/logs -> /var/log/app
+mounts:  /project/src -> /srv/src
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	WriteStatus(buf, "unknown", core.StateNotCloned, nil, &core.MachineConfig{})
+
+	expected = `state:   not cloned
+engine:  unknown
+source:  -
+path:    -
+ip:      -
+mounts:  -
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expected, buf.String())
+	}
+}
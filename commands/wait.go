@@ -0,0 +1,170 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+const (
+	// DefaultWaitTimeout is how long we'll wait for the VM to be ready for SSH
+	DefaultWaitTimeout = 2 * time.Minute
+
+	// StartedFile is touched each time lovm starts the VM, so other commands
+	// can tell if the VM was only just started and may still be booting. It's
+	// removed when the VM is stopped, suspended or deleted.
+	StartedFile = "started"
+
+	// maxBackoff caps the delay between attempts
+	maxBackoff = 5 * time.Second
+)
+
+// WaitError reports which stage of waiting for the VM timed out, along with
+// the last error we saw at that stage.
+type WaitError struct {
+	Stage   string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *WaitError) Error() string {
+	return fmt.Sprintf("timed out after %s waiting for %s: %s", e.Timeout, e.Stage, e.Err)
+}
+
+// ParseWait parses the flags for lovm wait and lovm start. --wait is only
+// meaningful for start, but it's harmless to accept it for wait.
+func ParseWait(name string, args []string) (wait bool, timeout time.Duration, err error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.BoolVar(&wait, "wait", false, "wait until the VM is ready for SSH")
+	flags.DurationVar(&timeout, "timeout", DefaultWaitTimeout, "how long to wait, e.g. 90s or 5m")
+
+	if err := flags.Parse(args); err != nil {
+		return false, 0, err
+	}
+	if flags.NArg() > 0 {
+		return false, 0, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	return wait, timeout, nil
+}
+
+// backoff returns a function that sleeps a little longer each time it is
+// called, but never past the deadline. It reports false once the deadline has
+// passed.
+func backoff(deadline time.Time) func() bool {
+	delay := 250 * time.Millisecond
+
+	return func() bool {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxBackoff {
+			delay = maxBackoff
+		}
+		return true
+	}
+}
+
+// WaitForIP calls lookup (e.g. VirtualizationEngine.IP) until it returns an IP
+// address or the timeout expires. The guest usually won't have an IP until it
+// has booted and asked for a DHCP lease.
+func WaitForIP(lookup func() (net.IP, error), timeout time.Duration) (net.IP, error) {
+	retry := backoff(time.Now().Add(timeout))
+
+	for {
+		ip, err := lookup()
+		if err == nil {
+			return ip, nil
+		}
+		if !retry() {
+			return nil, &WaitError{Stage: "an IP address", Timeout: timeout, Err: err}
+		}
+	}
+}
+
+// WaitForPort tries to open a TCP connection to the port until it succeeds or
+// the timeout expires. The guest gets an IP address before sshd is listening,
+// so we need to check both.
+func WaitForPort(ip net.IP, port int, timeout time.Duration) error {
+	address := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	retry := backoff(time.Now().Add(timeout))
+
+	for {
+		conn, err := net.DialTimeout("tcp", address, 2*time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if !retry() {
+			return &WaitError{Stage: "SSH on " + address, Timeout: timeout, Err: err}
+		}
+	}
+}
+
+// SSHPort returns the port SSH is listening on
+func SSHPort(config *core.MachineConfig) int {
+	if config.SSH.Port != 0 {
+		return config.SSH.Port
+	}
+	return 22
+}
+
+// Wait blocks until the VM has an IP address and SSH is accepting connections,
+// and returns the IP address. The timeout applies to both stages together.
+func Wait(machine core.VirtualizationEngine, config *core.MachineConfig, timeout time.Duration) (net.IP, error) {
+	started := time.Now()
+
+	ip, err := WaitForIP(machine.IP, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := WaitForPort(ip, SSHPort(config), timeout-time.Since(started)); err != nil {
+		if waitErr, ok := err.(*WaitError); ok {
+			waitErr.Timeout = timeout
+		}
+		return nil, err
+	}
+
+	return ip, nil
+}
+
+// MarkStarted records that the VM was just started. See StartedFile.
+func MarkStarted(dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, ".lovm"), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ".lovm", StartedFile), []byte(time.Now().Format(time.RFC3339)), 0644)
+}
+
+// ClearStarted records that the VM is no longer starting, because it was
+// stopped, suspended or deleted. See StartedFile.
+func ClearStarted(dir string) error {
+	err := os.Remove(filepath.Join(dir, ".lovm", StartedFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// JustStarted reports whether lovm started the VM within the window
+func JustStarted(dir string, window time.Duration) bool {
+	fi, err := os.Stat(filepath.Join(dir, ".lovm", StartedFile))
+	if err != nil {
+		return false
+	}
+	return time.Since(fi.ModTime()) < window
+}
@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWait(t *testing.T) {
+	wait, timeout, err := ParseWait("start", []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait || timeout != DefaultWaitTimeout {
+		t.Errorf("Expected defaults, found %t %s", wait, timeout)
+	}
+
+	wait, timeout, err = ParseWait("start", []string{"--wait", "--timeout", "90s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wait || timeout != 90*time.Second {
+		t.Errorf("Expected --wait and 90s, found %t %s", wait, timeout)
+	}
+
+	if _, _, err := ParseWait("start", []string{"--timeout", "soon"}); err == nil {
+		t.Error("Expected an error for an invalid timeout")
+	}
+	if _, _, err := ParseWait("start", []string{"extra"}); err == nil {
+		t.Error("Expected an error for an extra argument")
+	}
+}
+
+func TestWaitForIP(t *testing.T) {
+	attempts := 0
+	lookup := func() (net.IP, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("no IP address found")
+		}
+		return net.ParseIP("172.16.23.131"), nil
+	}
+
+	ip, err := WaitForIP(lookup, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "172.16.23.131" || attempts != 3 {
+		t.Errorf("Expected 172.16.23.131 after 3 attempts, found %s after %d", ip, attempts)
+	}
+
+	_, err = WaitForIP(func() (net.IP, error) {
+		return nil, errors.New("no IP address found")
+	}, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "waiting for an IP address: no IP address found") {
+		t.Errorf("Expected the IP stage to time out, found %v", err)
+	}
+}
+
+func TestWaitForPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if err := WaitForPort(net.ParseIP("127.0.0.1"), port, time.Second); err != nil {
+		t.Error(err)
+	}
+
+	// Once the listener is closed nothing will answer on the port
+	listener.Close()
+
+	err = WaitForPort(net.ParseIP("127.0.0.1"), port, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "waiting for SSH on 127.0.0.1:") {
+		t.Errorf("Expected the SSH stage to time out, found %v", err)
+	}
+}
+
+func TestJustStarted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lovm-started")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if JustStarted(dir, time.Minute) {
+		t.Error("Expected a new machine not to be starting")
+	}
+
+	if err := MarkStarted(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !JustStarted(dir, time.Minute) {
+		t.Error("Expected the machine to be starting")
+	}
+
+	// e.g. after lovm stop
+	if err := ClearStarted(dir); err != nil {
+		t.Fatal(err)
+	}
+	if JustStarted(dir, time.Minute) {
+		t.Error("Expected a stopped machine not to be starting")
+	}
+	if err := ClearStarted(dir); err != nil {
+		t.Errorf("Expected clearing twice to work, found %s", err)
+	}
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Where an engine found an Address
+const (
+	// SourceDHCP means the address was found in a DHCP lease table on the host
+	SourceDHCP = "dhcp-lease"
+
+	// SourceStatic means the address was configured on the host, for example
+	// in the VM's settings
+	SourceStatic = "static"
+
+	// SourceGuestTools means the guest reported the address through the
+	// engine's guest tools or agent
+	SourceGuestTools = "guest-tools"
+
+	// SourceARP means the address was found in the host's ARP or neighbor
+	// table, by matching the interface's MAC address
+	SourceARP = "arp"
+
+	// SourcePortForward means the guest is reached through a port the engine
+	// forwards from the host, so the address is the host's
+	SourcePortForward = "port-forward"
+)
+
+// Address is an IP address assigned to one of the VM's network interfaces
+type Address struct {
+	// Interface is the engine's name for the network interface, e.g.
+	// ethernet0 in VMware or nic1 in VirtualBox. This is the name to use for
+	// SSHConfig.NetworkInterface.
+	Interface string `json:"interface"`
+
+	MAC string `json:"mac,omitempty"`
+	IP  net.IP `json:"ip"`
+
+	// Network names the network the interface is attached to, e.g. vmnet8,
+	// hostonly, or nat
+	Network string `json:"network,omitempty"`
+
+	// Source is where the address was found, e.g. SourceDHCP
+	Source string `json:"source"`
+}
+
+// Resolution records what one of the engine's ways of finding the VM's
+// addresses found, or why it failed, for lovm ip --explain
+type Resolution struct {
+	// Resolver names the method, e.g. "leases"
+	Resolver string
+
+	Found []Address
+	Err   error
+}
+
+// AddressExplainer is implemented by engines that have more than one way to
+// find the VM's addresses. ExplainAddresses returns the same addresses as
+// Addresses, along with what each method did, in the order they were tried.
+type AddressExplainer interface {
+	ExplainAddresses() ([]Address, []Resolution, error)
+}
+
+// Matches returns true if the address belongs to the interface with the given
+// name or MAC address, like SSHConfig.NetworkInterface
+func (a Address) Matches(name string) bool {
+	return a.Interface == name || (a.MAC != "" && strings.EqualFold(a.MAC, name))
+}
+
+// FilterAddresses returns the addresses that match name (see Address.Matches).
+// If name is empty all of the addresses are returned.
+func FilterAddresses(addresses []Address, name string) []Address {
+	if name == "" {
+		return addresses
+	}
+
+	var matches []Address
+	for _, addr := range addresses {
+		if addr.Matches(name) {
+			matches = append(matches, addr)
+		}
+	}
+	return matches
+}
+
+// SortAddresses sorts addresses by interface, with numbered interfaces in
+// numeric order so ethernet2 comes before ethernet10. Each interface's IPv4
+// addresses come before its IPv6 addresses. Otherwise the order is kept.
+func SortAddresses(addresses []Address) {
+	sort.SliceStable(addresses, func(i, j int) bool {
+		a, b := addresses[i], addresses[j]
+		if a.Interface != b.Interface {
+			return lessInterface(a.Interface, b.Interface)
+		}
+		return a.IP.To4() != nil && b.IP.To4() == nil
+	})
+}
+
+// lessInterface compares interface names, treating a trailing number as a
+// number rather than text
+func lessInterface(a, b string) bool {
+	prefixA, numberA := splitInterface(a)
+	prefixB, numberB := splitInterface(b)
+	if prefixA != prefixB || numberA == numberB {
+		return a < b
+	}
+	return numberA < numberB
+}
+
+func splitInterface(name string) (string, int) {
+	prefix := strings.TrimRight(name, "0123456789")
+	number, err := strconv.Atoi(name[len(prefix):])
+	if err != nil {
+		return name, -1
+	}
+	return prefix, number
+}
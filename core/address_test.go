@@ -0,0 +1,45 @@
+package core
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSortAddresses(t *testing.T) {
+	addresses := []Address{
+		{Interface: "ethernet10", IP: net.ParseIP("172.16.23.140")},
+		{Interface: "ethernet2", IP: net.ParseIP("fe80::20c:29ff:fe05:6fe3")},
+		{Interface: "ethernet2", IP: net.ParseIP("192.168.50.20")},
+		{Interface: "ethernet0", IP: net.ParseIP("172.16.23.131")},
+		{Interface: "ethernet0", IP: net.ParseIP("172.16.23.129")},
+	}
+
+	SortAddresses(addresses)
+
+	expected := []string{"172.16.23.131", "172.16.23.129", "192.168.50.20", "fe80::20c:29ff:fe05:6fe3", "172.16.23.140"}
+	for i, addr := range addresses {
+		if addr.IP.String() != expected[i] {
+			t.Errorf("Expected %s at %d, found %s (%s)", expected[i], i, addr.IP, addr.Interface)
+		}
+	}
+}
+
+func TestFilterAddresses(t *testing.T) {
+	addresses := []Address{
+		{Interface: "nic1", MAC: "08:00:27:4f:1a:2b", IP: net.ParseIP("10.0.2.15")},
+		{Interface: "nic2", MAC: "08:00:27:9c:3d:4e", IP: net.ParseIP("192.168.56.101")},
+	}
+
+	if found := FilterAddresses(addresses, ""); len(found) != 2 {
+		t.Errorf("Expected every address, found %v", found)
+	}
+	if found := FilterAddresses(addresses, "nic2"); len(found) != 1 || found[0].Interface != "nic2" {
+		t.Errorf("Expected nic2, found %v", found)
+	}
+	if found := FilterAddresses(addresses, "08:00:27:4F:1A:2B"); len(found) != 1 || found[0].Interface != "nic1" {
+		t.Errorf("Expected nic1, found %v", found)
+	}
+	if found := FilterAddresses(addresses, "nic3"); len(found) != 0 {
+		t.Errorf("Expected no addresses, found %v", found)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -13,9 +15,70 @@ var (
 	// is not yet implemented. This allows any part of the implementation to
 	// satisfy interface requirements before a full implementation is available.
 	ErrNotImplemented = errors.New("not implemented (TODO)")
+
+	// ErrNotSuspended is returned when the user asks to resume a VM that is
+	// stopped, rather than suspended or paused.
+	ErrNotSuspended = errors.New("the virtual machine is not suspended; use start instead")
+
+	// ErrNotRunning is returned when something needs the guest OS, but the
+	// virtual machine is not running.
+	ErrNotRunning = errors.New("the virtual machine is not running")
+
+	// ErrNotStopped is returned when something can only be changed while the
+	// virtual machine is stopped, such as its hardware.
+	ErrNotStopped = errors.New("the virtual machine must be stopped first")
+
+	reShareName = regexp.MustCompile(`[^a-zA-Z0-9]+`)
 )
 
 func CommandError(command *exec.Cmd, output []byte) {
 	os.Stderr.WriteString(fmt.Sprintf("[command debug] %s\n", strings.Join(command.Args, " ")))
 	os.Stderr.Write(output)
 }
+
+// ShareName derives the name of a shared folder from the path it is mounted at
+// in the guest, so the same mount always gets the same share. For example,
+// /home/user/src becomes home-user-src.
+func ShareName(guestPath string) string {
+	name := strings.Trim(reShareName.ReplaceAllString(guestPath, "-"), "-")
+	if name == "" {
+		return "root"
+	}
+	return name
+}
+
+// ClearKnownHosts removes the known_hosts file for the machine. The built-in
+// SSH client will learn the host key again the next time it connects.
+func ClearKnownHosts() error {
+	err := os.Remove(filepath.FromSlash(KnownHostsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// AuthorizeKeyScript builds a /bin/sh script that adds publicKey to the
+// authorized_keys file of the given guest login, or of the user running the
+// script if login is empty. It's meant to be run as root, or as the login
+// itself, by an engine's guest tools. The key is only added once.
+func AuthorizeKeyScript(login, publicKey string) string {
+	home, owner := `"${HOME:-$(getent passwd "$(id -un)" | cut -d: -f6)}"`, `"$(id -un)"`
+	if login != "" {
+		home = fmt.Sprintf(`"$(getent passwd %s | cut -d: -f6)"`, ShellQuote(login))
+		owner = ShellQuote(login)
+	}
+
+	key := ShellQuote(strings.TrimSpace(publicKey))
+
+	return strings.Join([]string{
+		"set -e",
+		"home=" + home,
+		`test -n "$home"`,
+		`mkdir -p "$home/.ssh"`,
+		`touch "$home/.ssh/authorized_keys"`,
+		fmt.Sprintf(`grep -qxF %[1]s "$home/.ssh/authorized_keys" || echo %[1]s >>"$home/.ssh/authorized_keys"`, key),
+		`chmod 700 "$home/.ssh"`,
+		`chmod 600 "$home/.ssh/authorized_keys"`,
+		fmt.Sprintf(`chown -R %s "$home/.ssh" 2>/dev/null || true`, owner),
+	}, "\n")
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestShareName(t *testing.T) {
+	cases := map[string]string{
+		"/srv/project":       "srv-project",
+		"/home/user/my src/": "home-user-my-src",
+		"/":                  "root",
+	}
+
+	for input, expected := range cases {
+		if output := ShareName(input); output != expected {
+			t.Errorf("Expected %q, found %q", expected, output)
+		}
+	}
+}
+
+func TestAuthorizeKeyScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+
+	home, err := ioutil.TempDir("", "lovm-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIEx9 lovm@project\n"
+	script := AuthorizeKeyScript("", key)
+
+	// Running it twice should only add the key once
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command("/bin/sh", "-c", script)
+		cmd.Env = append(os.Environ(), "HOME="+home)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: %s", err, out)
+		}
+	}
+
+	file := filepath.Join(home, ".ssh", "authorized_keys")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != key {
+		t.Errorf("Expected %q, found %q", key, data)
+	}
+
+	if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected authorized_keys to have mode 0600, found %v %v", fi, err)
+	}
+}
@@ -8,6 +8,16 @@ import (
 
 const MachineFile = "machine.lovm"
 
+// KnownHostsFile holds the SSH host keys for this machine. It is used by the
+// built-in SSH client and removed when the machine is deleted, since a new
+// clone will have new host keys.
+const KnownHostsFile = ".lovm/known_hosts"
+
+// SSHKeyFile is the private key lovm generates for the machine when
+// SSHConfig.GenerateKey is set. The public key is next to it, with .pub on
+// the end. Both are removed when the machine is deleted.
+const SSHKeyFile = ".lovm/id_ed25519"
+
 // SSHConfig is used to store additional details for SSHing into the virtual
 // machine, including a way to match the network interface name / ID, SSH
 // username, ssh private key, and possibly other configuration
@@ -24,6 +34,64 @@ type SSHConfig struct {
 	// one NIC. The virtual machine engine can use this to match the MAC
 	// address. See the specific engine for details.
 	NetworkInterface string `json:"network-interface,omitempty"`
+
+	// PingSweep lets engines that look for the VM's MAC address in the host's
+	// neighbor (ARP) table contact every address on the host's local networks
+	// first, so the VM shows up in it. This is off by default because it sends
+	// a packet to every machine on the network. See the specific engine for
+	// details.
+	PingSweep bool `json:"ping-sweep,omitempty"`
+
+	// IPResolvers lists the ways the engine should look for the VM's IP
+	// addresses, in order, for engines that have more than one. If it is empty
+	// the engine's default order is used. See the specific engine for names.
+	IPResolvers []string `json:"ip-resolvers,omitempty"`
+
+	// Port may be used to specify the port SSH is listening on. It will fill
+	// in the -p option for the underlying SSH command. Some engines set this
+	// automatically when they forward a host port to SSH in the guest.
+	Port int `json:"port,omitempty"`
+
+	// Client selects the SSH client used by lovm ssh. It may be "openssh" to
+	// always run the ssh command, or "native" to always use the client built
+	// into lovm. By default we run ssh if it is installed and fall back on the
+	// built-in client if it is not.
+	Client string `json:"client,omitempty"`
+
+	// ForwardAgent enables SSH agent forwarding in the built-in client. Use
+	// -A to do this with the ssh command.
+	ForwardAgent bool `json:"forward-agent,omitempty"`
+
+	// HostAlias is the Host name used by lovm ssh-config. If it is empty the
+	// name of the machine's directory is used.
+	HostAlias string `json:"host-alias,omitempty"`
+
+	// ConfigFile keeps ~/.ssh/lovm.d/<host alias> up to date as the VM is
+	// started and stopped. Set it with lovm ssh-config --write.
+	ConfigFile bool `json:"config-file,omitempty"`
+
+	// GenerateKey makes lovm generate a new SSH key for each clone (see
+	// SSHKeyFile) and install it in the guest, instead of using a key that is
+	// already in the source image. PrivateKeyPath is set to the new key. Set
+	// it with lovm clone --generate-key.
+	GenerateKey bool `json:"generate-key,omitempty"`
+
+	// KeyInstalled records that the generated key has been installed in the
+	// guest, so lovm start doesn't install it again.
+	KeyInstalled bool `json:"key-installed,omitempty"`
+}
+
+// GuestConfig stores credentials for an account in the guest operating system.
+// Some virtualization engines use these to run programs inside the guest via
+// their guest tools, for example to mount shared folders. This is separate
+// from SSH, which does not need a password.
+type GuestConfig struct {
+	// Login is the guest account to use. If it is empty SSHConfig.Login is
+	// used instead.
+	Login string `json:"login,omitempty"`
+
+	// Password for the guest account
+	Password string `json:"password,omitempty"`
 }
 
 // MachineConfig represents a cloned VM and the information we need to find it
@@ -46,6 +114,38 @@ type MachineConfig struct {
 
 	// SSH stores some additional configuration for the ssh command
 	SSH SSHConfig `json:"ssh-config,omitempty"`
+
+	// Guest stores credentials used by the virtualization engine's guest tools
+	Guest GuestConfig `json:"guest-config,omitempty"`
+
+	// Forwards lists the TCP ports forwarded from the host to the guest,
+	// ordered by host port. See lovm forward.
+	Forwards []Forward `json:"forwards,omitempty"`
+
+	// ExposeForwards lets engines whose port forwarding listens on every host
+	// interface, rather than just 127.0.0.1, forward ports themselves (see
+	// PublicForwarder). This makes the ports reachable from other machines on
+	// the network, so it's off by default and lovm forward uses its proxy for
+	// those engines instead.
+	ExposeForwards bool `json:"expose-forwards,omitempty"`
+
+	// CPUs, Memory and Networks change the clone's hardware. If they're not
+	// set the clone keeps what the source had. Memory is a size like 8G or
+	// 512M. Networks lists the network adapters in order, and replaces all of
+	// the source's adapters. Engines apply them after cloning and again each
+	// time the VM is started from stopped. See lovm set.
+	CPUs     int       `json:"cpus,omitempty"`
+	Memory   string    `json:"memory,omitempty"`
+	Networks []Network `json:"networks,omitempty"`
+}
+
+// GuestLogin returns the login to use for guest operations, falling back on
+// the SSH login if no guest login is configured.
+func (c *MachineConfig) GuestLogin() string {
+	if c.Guest.Login != "" {
+		return c.Guest.Login
+	}
+	return c.SSH.Login
 }
 
 // ConfigFromFile looks for a file called "machine.lovm" in the specified path,
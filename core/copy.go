@@ -0,0 +1,321 @@
+package core
+
+import (
+	"archive/tar"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrRelativeGuestPath is returned when copying with guest tools, because
+// programs run by the guest tools don't have a useful working directory.
+var ErrRelativeGuestPath = errors.New("guest paths must be absolute when copying without SSH")
+
+// GuestChannel is implemented by engines that can move files in and out of
+// the guest and run commands there using their guest tools. CopyToGuest and
+// CopyFromGuest use it to copy directory trees when SSH is not available.
+type GuestChannel interface {
+	// UploadFile copies a single file from the host to the guest
+	UploadFile(hostPath, guestPath string) error
+
+	// DownloadFile copies a single file from the guest to the host
+	DownloadFile(guestPath, hostPath string) error
+
+	// RunShell runs the script with /bin/sh in the guest
+	RunShell(script string) error
+}
+
+// ShellQuote quotes s for use in a /bin/sh script
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// CopyDestination works out where src ends up when it's copied to dst, like
+// cp: if dst is an existing directory src is copied into it, otherwise src is
+// copied to dst.
+func CopyDestination(src, dst string) string {
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		return filepath.Join(dst, filepath.Base(src))
+	}
+	return dst
+}
+
+// WriteTar writes src to w as a tar archive. If src is a directory the whole
+// tree is included. Entries are named relative to the parent of src (like
+// tar -C $(dirname src) $(basename src)) and keep their file modes.
+func WriteTar(w io.Writer, src string) error {
+	src = filepath.Clean(src)
+	parent := filepath.Dir(src)
+	archive := tar.NewWriter(w)
+
+	err := filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(parent, file)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if fi.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(archive, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// ExtractTar extracts an archive written by WriteTar (or tar -c with a single
+// top level entry) to dst, following the same rules as CopyDestination. File
+// modes are restored. Entries that would end up outside of dst are rejected,
+// including ones that would be written through a symlink from the archive.
+func ExtractTar(r io.Reader, dst string) error {
+	archive := tar.NewReader(r)
+	top := ""
+	target := ""
+
+	// Directory modes are set at the end, in case they aren't writable
+	dirModes := map[string]os.FileMode{}
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if name == "." || strings.HasPrefix(name, "../") || name == ".." || path.IsAbs(name) {
+			return fmt.Errorf("refusing to extract %q", header.Name)
+		}
+
+		// The first entry is the file or directory being copied
+		parts := strings.SplitN(name, "/", 2)
+		if top == "" {
+			top = parts[0]
+			target = CopyDestination(top, dst)
+		}
+		if parts[0] != top {
+			return fmt.Errorf("unexpected entry %q outside of %q", header.Name, top)
+		}
+		file := target
+		if len(parts) == 2 {
+			file = filepath.Join(target, filepath.FromSlash(parts[1]))
+		}
+
+		if err := CheckParents(target, file); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(file, 0755); err != nil {
+				return err
+			}
+			dirModes[file] = mode
+		case tar.TypeSymlink:
+			os.Remove(file)
+			if err := os.Symlink(header.Linkname, file); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				return err
+			}
+			if err := RemoveSymlink(file); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, archive)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			// OpenFile doesn't change the mode of existing files, and the
+			// umask applies to new ones
+			if err := os.Chmod(file, mode); err != nil {
+				return err
+			}
+		}
+	}
+
+	for dir, mode := range dirModes {
+		if err := os.Chmod(dir, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckParents returns an error if root, or any directory between root and
+// file, is a symlink. Writing file could then change something outside of
+// root, for example if an archive has a symlink x/link -> /etc followed by a
+// file x/link/passwd.
+func CheckParents(root, file string) error {
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	dir := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write %s through the symlink %s", file, dir)
+		}
+		dir = filepath.Join(dir, part)
+	}
+
+	return nil
+}
+
+// RemoveSymlink removes file if it's a symlink, so opening it for writing
+// replaces the link rather than writing wherever it points
+func RemoveSymlink(file string) error {
+	if fi, err := os.Lstat(file); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return os.Remove(file)
+	}
+	return nil
+}
+
+// GuestTempFile returns a unique path for a temporary file in the guest, e.g.
+// /tmp/lovm-cp-0123456789abcdef
+func GuestTempFile(prefix string) string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return "/tmp/lovm-" + prefix + "-" + hex.EncodeToString(suffix)
+}
+
+// copyToGuestScript unpacks the archive (1) to the destination (2) in the
+// guest, following the same rules as CopyDestination. (3) is the name of the
+// top level entry in the archive. The archive is removed afterwards.
+const copyToGuestScript = `set -e
+t=%[1]s
+d=%[2]s
+trap 'rm -rf "$t" ${x:+"$x"}' EXIT
+if [ -d "$d" ]; then
+  tar -xpf "$t" -C "$d"
+else
+  mkdir -p "$(dirname "$d")"
+  x=$(mktemp -d "$(dirname "$d")/.lovm-cp.XXXXXX")
+  tar -xpf "$t" -C "$x"
+  rm -rf "$d"
+  mv "$x"/%[3]s "$d"
+fi
+`
+
+// CopyToGuest copies src from the host to dst in the guest using the guest
+// tools. src may be a file or directory. Everything is sent as a single tar
+// archive and unpacked with tar in the guest, so file modes are kept and we
+// don't need to copy files one at a time.
+func CopyToGuest(channel GuestChannel, src, dst string) error {
+	if !path.IsAbs(dst) {
+		return ErrRelativeGuestPath
+	}
+
+	archive, err := ioutil.TempFile("", "lovm-cp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+
+	err = WriteTar(archive, src)
+	archive.Close()
+	if err != nil {
+		return err
+	}
+
+	guestArchive := GuestTempFile("cp") + ".tar"
+	if err := channel.UploadFile(archive.Name(), guestArchive); err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf(copyToGuestScript, ShellQuote(guestArchive), ShellQuote(dst),
+		ShellQuote(filepath.Base(filepath.Clean(src))))
+
+	return channel.RunShell(script)
+}
+
+// CopyFromGuest copies src from the guest to dst on the host using the guest
+// tools. src may be a file or directory. The guest packs it up with tar, and
+// we unpack it with ExtractTar.
+func CopyFromGuest(channel GuestChannel, src, dst string) error {
+	if !path.IsAbs(src) {
+		return ErrRelativeGuestPath
+	}
+
+	src = path.Clean(src)
+	guestArchive := GuestTempFile("cp") + ".tar"
+	script := fmt.Sprintf("tar -cf %s -C %s %s", ShellQuote(guestArchive),
+		ShellQuote(path.Dir(src)), ShellQuote(path.Base(src)))
+	if err := channel.RunShell(script); err != nil {
+		return err
+	}
+	defer channel.RunShell("rm -f " + ShellQuote(guestArchive))
+
+	archive, err := ioutil.TempFile("", "lovm-cp")
+	if err != nil {
+		return err
+	}
+	archive.Close()
+	defer os.Remove(archive.Name())
+
+	if err := channel.DownloadFile(guestArchive, archive.Name()); err != nil {
+		return err
+	}
+
+	f, err := os.Open(archive.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return ExtractTar(f, dst)
+}
@@ -0,0 +1,247 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// MakeTree creates a small directory tree with a few different file modes
+func MakeTree(t *testing.T, dir string) {
+	files := map[string]os.FileMode{
+		"build/run.sh":          0755,
+		"build/secret.txt":      0600,
+		"build/lib/library.txt": 0644,
+	}
+	for name, mode := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(file, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "build", "lib"), 0750); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// CheckTree verifies a copy of the tree created by MakeTree
+func CheckTree(t *testing.T, dir string) {
+	modes := map[string]os.FileMode{
+		"run.sh":          0755,
+		"secret.txt":      0600,
+		"lib":             0750 | os.ModeDir,
+		"lib/library.txt": 0644,
+	}
+	for name, mode := range modes {
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fi.Mode() != mode {
+			t.Errorf("Expected %s to have mode %s, found %s", name, mode, fi.Mode())
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "build/run.sh" {
+		t.Errorf("Unexpected contents in run.sh: %q", data)
+	}
+}
+
+func TempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "lovm-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	dir := TempDir(t)
+	defer os.RemoveAll(dir)
+	MakeTree(t, dir)
+
+	buf := &bytes.Buffer{}
+	if err := WriteTar(buf, filepath.Join(dir, "build")); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// Into a new path
+	if err := ExtractTar(bytes.NewReader(data), filepath.Join(dir, "copy")); err != nil {
+		t.Fatal(err)
+	}
+	CheckTree(t, filepath.Join(dir, "copy"))
+
+	// Into an existing directory
+	if err := os.Mkdir(filepath.Join(dir, "existing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExtractTar(bytes.NewReader(data), filepath.Join(dir, "existing")); err != nil {
+		t.Fatal(err)
+	}
+	CheckTree(t, filepath.Join(dir, "existing", "build"))
+
+	// A single file
+	buf.Reset()
+	if err := WriteTar(buf, filepath.Join(dir, "build", "run.sh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExtractTar(buf, filepath.Join(dir, "run")); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "run")); err != nil || fi.Mode() != 0755 {
+		t.Errorf("Expected run to be copied with mode 0755, found %v %v", fi, err)
+	}
+}
+
+func TestExtractTarRejectsTraversal(t *testing.T) {
+	dir := TempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"../escape", "/etc/passwd", "build/../../escape"} {
+		buf := &bytes.Buffer{}
+		archive := tar.NewWriter(buf)
+		archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+		archive.Write([]byte("x"))
+		archive.Close()
+
+		if err := ExtractTar(buf, filepath.Join(dir, "out")); err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+}
+
+func TestExtractTarRejectsSymlinkTraversal(t *testing.T) {
+	dir := TempDir(t)
+	defer os.RemoveAll(dir)
+
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A symlink to a directory outside of the destination, then a file
+	// "inside" the symlink
+	buf := &bytes.Buffer{}
+	archive := tar.NewWriter(buf)
+	archive.WriteHeader(&tar.Header{Name: "x/", Mode: 0755, Typeflag: tar.TypeDir})
+	archive.WriteHeader(&tar.Header{Name: "x/link", Linkname: outside, Typeflag: tar.TypeSymlink})
+	archive.WriteHeader(&tar.Header{Name: "x/link/passwd", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	archive.Write([]byte("x"))
+	archive.Close()
+
+	if err := ExtractTar(buf, filepath.Join(dir, "out")); err == nil {
+		t.Error("Expected x/link/passwd to be rejected")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "passwd")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written outside of the destination, found %v", err)
+	}
+
+	// A symlink to a file, then a file with the same name
+	buf.Reset()
+	archive = tar.NewWriter(buf)
+	archive.WriteHeader(&tar.Header{Name: "y/", Mode: 0755, Typeflag: tar.TypeDir})
+	archive.WriteHeader(&tar.Header{Name: "y/link", Linkname: filepath.Join(outside, "file"), Typeflag: tar.TypeSymlink})
+	archive.WriteHeader(&tar.Header{Name: "y/link", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	archive.Write([]byte("y"))
+	archive.Close()
+
+	if err := ExtractTar(buf, filepath.Join(dir, "out2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "file")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written outside of the destination, found %v", err)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "out2", "link")); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("Expected the symlink to be replaced with a file, found %v %v", fi, err)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	cases := map[string]string{
+		"/srv/app":    `'/srv/app'`,
+		"it's a path": `'it'\''s a path'`,
+		"$HOME/`ls`":  `'$HOME/` + "`ls`'",
+		"":            `''`,
+	}
+	for input, expected := range cases {
+		if output := ShellQuote(input); output != expected {
+			t.Errorf("Expected %s, found %s", expected, output)
+		}
+	}
+}
+
+// LocalChannel pretends the host is the guest, so we can test the scripts
+// CopyToGuest and CopyFromGuest run in the guest.
+type LocalChannel struct{}
+
+func (LocalChannel) copy(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0600)
+}
+
+func (c LocalChannel) UploadFile(hostPath, guestPath string) error {
+	return c.copy(hostPath, guestPath)
+}
+
+func (c LocalChannel) DownloadFile(guestPath, hostPath string) error {
+	return c.copy(guestPath, hostPath)
+}
+
+func (LocalChannel) RunShell(script string) error {
+	out, err := exec.Command("/bin/sh", "-c", script).CombinedOutput()
+	if err != nil {
+		os.Stderr.Write(out)
+	}
+	return err
+}
+
+func TestCopyWithGuestChannel(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar is not installed")
+	}
+
+	dir := TempDir(t)
+	defer os.RemoveAll(dir)
+	MakeTree(t, dir)
+
+	src := filepath.Join(dir, "build")
+
+	if err := CopyToGuest(LocalChannel{}, src, filepath.Join(dir, "guest", "app")); err != nil {
+		t.Fatal(err)
+	}
+	CheckTree(t, filepath.Join(dir, "guest", "app"))
+
+	// Copying again puts it inside the existing directory
+	if err := CopyToGuest(LocalChannel{}, src, filepath.Join(dir, "guest", "app")); err != nil {
+		t.Fatal(err)
+	}
+	CheckTree(t, filepath.Join(dir, "guest", "app", "build"))
+
+	if err := CopyFromGuest(LocalChannel{}, filepath.Join(dir, "guest", "app"), filepath.Join(dir, "host")); err != nil {
+		t.Fatal(err)
+	}
+	CheckTree(t, filepath.Join(dir, "host"))
+
+	if err := CopyToGuest(LocalChannel{}, src, "relative/path"); err != ErrRelativeGuestPath {
+		t.Errorf("Expected ErrRelativeGuestPath, found %v", err)
+	}
+}
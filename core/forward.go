@@ -0,0 +1,57 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrForwardPublic is returned by VirtualizationEngine.Forward if the engine's
+// port forwarding listens on every host interface and
+// MachineConfig.ExposeForwards isn't set. lovm forward runs its own proxy
+// instead, like it does for ErrNotImplemented.
+var ErrForwardPublic = errors.New("the engine's port forwarding listens on every host interface; " +
+	"set \"expose-forwards\": true in " + MachineFile + " to use it anyway")
+
+// PublicForwarder is implemented by engines whose port forwarding listens on
+// every host interface rather than the loopback address
+type PublicForwarder interface {
+	PublicForwards() bool
+}
+
+// Forward is a TCP port on the host that is forwarded to a port in the guest.
+// It listens on the host's loopback address unless the engine's forwarding
+// doesn't support that (see PublicForwarder).
+type Forward struct {
+	HostPort  int `json:"host-port"`
+	GuestPort int `json:"guest-port"`
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%d:%d", f.HostPort, f.GuestPort)
+}
+
+// AddForward adds a forward to the config. A host port can only be forwarded
+// to one place, so an existing forward for the same host port is replaced.
+func (c *MachineConfig) AddForward(forward Forward) {
+	c.RemoveForward(forward.HostPort)
+	c.Forwards = append(c.Forwards, forward)
+	sort.Slice(c.Forwards, func(i, j int) bool {
+		return c.Forwards[i].HostPort < c.Forwards[j].HostPort
+	})
+}
+
+// RemoveForward removes the forward for hostPort, and reports whether there
+// was one.
+func (c *MachineConfig) RemoveForward(hostPort int) bool {
+	for i, forward := range c.Forwards {
+		if forward.HostPort == hostPort {
+			c.Forwards = append(c.Forwards[:i], c.Forwards[i+1:]...)
+			if len(c.Forwards) == 0 {
+				c.Forwards = nil
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestForwards(t *testing.T) {
+	config := &MachineConfig{}
+
+	config.AddForward(Forward{HostPort: 8080, GuestPort: 80})
+	config.AddForward(Forward{HostPort: 5432, GuestPort: 5432})
+	config.AddForward(Forward{HostPort: 8080, GuestPort: 8000})
+
+	expected := []Forward{{5432, 5432}, {8080, 8000}}
+	if !reflect.DeepEqual(config.Forwards, expected) {
+		t.Errorf("Expected %v, found %v", expected, config.Forwards)
+	}
+
+	if config.RemoveForward(3000) {
+		t.Error("Expected no forward for port 3000")
+	}
+	if !config.RemoveForward(5432) || !config.RemoveForward(8080) {
+		t.Error("Expected forwards to be removed")
+	}
+	if config.Forwards != nil {
+		t.Errorf("Expected no forwards, found %v", config.Forwards)
+	}
+
+	if s := (Forward{HostPort: 8080, GuestPort: 80}).String(); s != "8080:80" {
+		t.Errorf("Unexpected string %q", s)
+	}
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Network types for MachineConfig.Networks
+const (
+	NetworkNAT      = "nat"
+	NetworkHostOnly = "hostonly"
+	NetworkBridged  = "bridged"
+)
+
+// Network attaches one of the VM's network adapters to a network on the host
+type Network struct {
+	// Type is nat, hostonly, or bridged
+	Type string `json:"type"`
+
+	// Name is the engine's name for the host network, e.g. vmnet1 for VMware,
+	// or vboxnet0 for VirtualBox. Bridged networks may name a host interface
+	// instead, e.g. en0. If it is empty the engine's default network of that
+	// type is used. See the specific engine for details.
+	Name string `json:"name,omitempty"`
+}
+
+// String formats the network like ParseNetwork expects, e.g. hostonly:vmnet1
+func (n Network) String() string {
+	if n.Name == "" {
+		return n.Type
+	}
+	return n.Type + ":" + n.Name
+}
+
+// ParseNetwork parses a network type, optionally followed by a colon and the
+// name of the host network, e.g. nat or bridged:en0
+func ParseNetwork(s string) (Network, error) {
+	parts := strings.SplitN(s, ":", 2)
+
+	network := Network{Type: strings.ToLower(parts[0])}
+	if len(parts) == 2 {
+		network.Name = parts[1]
+		if network.Name == "" {
+			return Network{}, fmt.Errorf("expected a network name after the colon in %q", s)
+		}
+	}
+
+	switch network.Type {
+	case NetworkNAT, NetworkHostOnly, NetworkBridged:
+	default:
+		return Network{}, fmt.Errorf("unsupported network type %q; use nat, hostonly, or bridged", parts[0])
+	}
+
+	return network, nil
+}
+
+// ParseMemory parses an amount of memory like 8G or 512M and returns it in
+// MiB. A plain number is taken to be MiB already.
+func ParseMemory(s string) (int, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+
+	scale := 1
+	switch {
+	case strings.HasSuffix(value, "G"):
+		scale = 1024
+		value = strings.TrimSuffix(value, "G")
+	case strings.HasSuffix(value, "M"):
+		value = strings.TrimSuffix(value, "M")
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid memory size %q; use e.g. 8G or 512M", s)
+	}
+
+	return n * scale, nil
+}
+
+// MemoryMB returns the configured memory in MiB, or 0 if it isn't set
+func (c *MachineConfig) MemoryMB() (int, error) {
+	if c.Memory == "" {
+		return 0, nil
+	}
+	return ParseMemory(c.Memory)
+}
+
+// HasHardware returns true if the config changes any of the VM's hardware,
+// rather than keeping what it had in the clone source
+func (c *MachineConfig) HasHardware() bool {
+	return c.CPUs > 0 || c.Memory != "" || len(c.Networks) > 0
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	cases := map[string]int{
+		"8G":    8192,
+		"8g":    8192,
+		"2GB":   2048,
+		"4GiB":  4096,
+		"512M":  512,
+		"512MB": 512,
+		"2048":  2048,
+	}
+	for s, expected := range cases {
+		found, err := ParseMemory(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		if found != expected {
+			t.Errorf("%q: expected %d, found %d", s, expected, found)
+		}
+	}
+
+	for _, s := range []string{"", "G", "0", "-1G", "8T", "lots"} {
+		if _, err := ParseMemory(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	cases := map[string]Network{
+		"nat":             {Type: NetworkNAT},
+		"NAT":             {Type: NetworkNAT},
+		"hostonly:vmnet1": {Type: NetworkHostOnly, Name: "vmnet1"},
+		"bridged:en0":     {Type: NetworkBridged, Name: "en0"},
+	}
+	for s, expected := range cases {
+		found, err := ParseNetwork(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		if found != expected {
+			t.Errorf("%q: expected %+v, found %+v", s, expected, found)
+		}
+	}
+
+	if s := (Network{Type: NetworkHostOnly, Name: "vboxnet0"}).String(); s != "hostonly:vboxnet0" {
+		t.Errorf("Unexpected string %q", s)
+	}
+
+	for _, s := range []string{"", "internal", "bridged:"} {
+		if _, err := ParseNetwork(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestHasHardware(t *testing.T) {
+	config := &MachineConfig{}
+	if config.HasHardware() {
+		t.Error("Expected no hardware for an empty config")
+	}
+
+	config.Memory = "8G"
+	if !config.HasHardware() {
+		t.Error("Expected hardware when memory is set")
+	}
+	if memory, err := config.MemoryMB(); err != nil || memory != 8192 {
+		t.Errorf("Expected 8192 MiB, found %d (%v)", memory, err)
+	}
+}
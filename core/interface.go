@@ -1,6 +1,45 @@
 package core
 
-import "net"
+import (
+	"io"
+	"net"
+)
+
+// State describes the power state of a virtual machine
+type State int
+
+const (
+	// StateUnknown means the engine reported a state we don't understand
+	StateUnknown State = iota
+
+	// StateNotCloned means there is no VM yet
+	StateNotCloned
+
+	StateStopped
+	StateRunning
+
+	// StatePaused means the VM is in memory but its CPUs are not running
+	StatePaused
+
+	// StateSuspended means the VM's memory has been saved to disk
+	StateSuspended
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNotCloned:
+		return "not cloned"
+	case StateStopped:
+		return "stopped"
+	case StateRunning:
+		return "running"
+	case StatePaused:
+		return "paused"
+	case StateSuspended:
+		return "suspended"
+	}
+	return "unknown"
+}
 
 // VirtualizationEngine abstracts various ways a virtualization engine might do
 // things.
@@ -29,6 +68,15 @@ type VirtualizationEngine interface {
 	// than 10 seconds.
 	Stop() error
 
+	// Suspend the VM, saving its memory to disk so it can be resumed later
+	// right where it left off. If the VM is already suspended or is not
+	// running, just report a success.
+	Suspend() error
+
+	// Resume a suspended or paused VM. If the machine is already running just
+	// report a success. If it is stopped, tell the user to start it instead.
+	Resume() error
+
 	// Restart the VM. Stop. Then start. If they want to do shutdown -r now they
 	// can do it via SSH. If the VM is not actually running just start it up.
 	Restart() error
@@ -41,10 +89,17 @@ type VirtualizationEngine interface {
 	Delete() error
 
 	// IP is used for SSH, or sometimes just to show the user the IP. Pick the
-	// first one because that's probably what they want. Maybe we'll get fancy
-	// later and support multiple IPs, but not now.
+	// first one from Addresses because that's probably what they want, unless
+	// SSHConfig.NetworkInterface says otherwise. It must give the same answer
+	// every time the VM's addresses are the same.
 	IP() (net.IP, error)
 
+	// Addresses returns every IP address we can find for the VM, in the order
+	// of its network interfaces (see SortAddresses). Interfaces without an
+	// address are left out. If the VM is running but we can't find any
+	// addresses, return an empty list rather than an error.
+	Addresses() ([]Address, error)
+
 	// Mount shared folders. When the user runs the mount command they will add
 	// a mount to the list of mounts, so this implementation needs to figure
 	// out three things: Enable mounting things. Did we already mount that
@@ -55,6 +110,73 @@ type VirtualizationEngine interface {
 	// mount the thing.
 	Mount() error
 
+	// Forward makes the engine's own port forwarding match
+	// MachineConfig.Forwards, adding forwards that are missing and removing
+	// the ones lovm added before that are no longer listed. Forwards we didn't
+	// add must be left alone. Like Mount, it's called again whenever the list
+	// changes.
+	//
+	// Return ErrNotImplemented if the engine can't forward ports for this VM,
+	// for example because it has no NAT network. lovm forward will run its own
+	// proxy instead. Engines that can only listen on every host interface must
+	// also implement PublicForwarder, and return ErrForwardPublic unless
+	// MachineConfig.ExposeForwards is set.
+	Forward() error
+
+	// Configure makes the VM's hardware match MachineConfig's CPUs, Memory and
+	// Networks, leaving alone anything that isn't set. It's called after the
+	// VM is cloned and each time Start finds it stopped, so if nothing has
+	// changed it should do nothing. If the VM isn't cloned yet do nothing.
+	//
+	// Return ErrNotStopped if something needs to change but the VM is running
+	// or suspended, and ErrNotImplemented if the engine can't change it.
+	Configure() error
+
 	// Found returns true if the VM already exists
 	Found() bool
+
+	// State reports whether the VM is cloned, running, suspended, etc. This
+	// should not change anything, just look.
+	State() (State, error)
+
+	// SaveSnapshot takes a named snapshot of the VM, whether it is running or
+	// not. These are snapshots of the clone, not the clone source.
+	SaveSnapshot(string) error
+
+	// RestoreSnapshot rolls the VM back to the named snapshot. Don't ask the
+	// user whether they are sure. They said restore.
+	RestoreSnapshot(string) error
+
+	// ListSnapshots returns the names of the VM's snapshots, oldest first.
+	ListSnapshots() ([]string, error)
+
+	// DeleteSnapshot deletes the named snapshot, but not the VM's current
+	// state.
+	DeleteSnapshot(string) error
+
+	// CopyToGuest copies a file or directory from the host into the running
+	// guest without SSH, using whatever the engine has for talking to the
+	// guest OS. lovm cp uses SFTP when it can, so this is the fallback. File
+	// modes should be kept. See GuestChannel for one way to do this.
+	CopyToGuest(hostPath, guestPath string) error
+
+	// CopyFromGuest copies a file or directory from the running guest to the
+	// host. It's the opposite of CopyToGuest.
+	CopyFromGuest(guestPath, hostPath string) error
+
+	// Exec runs script with /bin/sh in the running guest without SSH, using
+	// the engine's guest tools or agent, and returns its exit code. Write the
+	// output to stdout and stderr, as it happens if possible. An error means
+	// the script could not be run, not that it failed.
+	Exec(script string, stdout, stderr io.Writer) (int, error)
+
+	// InstallSSHKey authorizes publicKey for SSHConfig.Login in the guest
+	// without SSH, since we can't log in yet. This is used when lovm generates
+	// a key for the clone (see SSHConfig.GenerateKey). See AuthorizeKeyScript
+	// for one way to do this. Wait for the guest tools to start, like Start
+	// does for Mount.
+	//
+	// If the key can only be installed while the VM is running, and it's not,
+	// return ErrNotRunning and we'll try again after it starts.
+	InstallSSHKey(publicKey string) error
 }
@@ -4,6 +4,8 @@ import (
 	"strings"
 
 	"github.com/cbednarski/lovm/core"
+	"github.com/cbednarski/lovm/engine/libvirt"
+	"github.com/cbednarski/lovm/engine/qemu"
 	"github.com/cbednarski/lovm/engine/unknown"
 	"github.com/cbednarski/lovm/engine/virtualbox"
 	"github.com/cbednarski/lovm/engine/vmware"
@@ -12,6 +14,12 @@ import (
 // Identify uses heuristics to determine the appropriate virtualization engine
 // for the specified source
 func Identify(source string) string {
+	// libvirt domains are referred to by name, so there's no filename to
+	// check. We have to do this before we look for a snapshot.
+	if strings.HasPrefix(source, libvirt.DomainPrefix) {
+		return libvirt.Identifier
+	}
+
 	// We use the : separator as a special case for indicating snapshots. This
 	// breaks the filename heuristic so we'll strip it off first.
 	if strings.Contains(source, ":") {
@@ -24,6 +32,12 @@ func Identify(source string) string {
 	if strings.HasSuffix(source, ".vbox") {
 		return virtualbox.Identifier
 	}
+	if strings.HasSuffix(source, ".qcow2") {
+		return qemu.Identifier
+	}
+	if strings.HasSuffix(source, ".xml") {
+		return libvirt.Identifier
+	}
 	return unknown.Identifier
 }
 
@@ -35,6 +49,10 @@ func Engine(source string, machine *core.MachineConfig) core.VirtualizationEngin
 		return vmware.New(machine)
 	case virtualbox.Identifier:
 		return virtualbox.New(machine)
+	case qemu.Identifier:
+		return qemu.New(machine)
+	case libvirt.Identifier:
+		return libvirt.New(machine)
 	}
 	return unknown.New(machine)
 }
@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/cbednarski/lovm/core"
+	"github.com/cbednarski/lovm/engine/libvirt"
+	"github.com/cbednarski/lovm/engine/qemu"
 	"github.com/cbednarski/lovm/engine/unknown"
 	"github.com/cbednarski/lovm/engine/virtualbox"
 	"github.com/cbednarski/lovm/engine/vmware"
@@ -20,6 +22,8 @@ func TestInterfaces(t *testing.T) {
 
 	verify(vmware.New(dummy))
 	verify(virtualbox.New(dummy))
+	verify(qemu.New(dummy))
+	verify(libvirt.New(dummy))
 	verify(unknown.New(dummy))
 }
 
@@ -28,6 +32,9 @@ func TestIdentify(t *testing.T) {
 		"/path/to/some.vmx":            vmware.Identifier,
 		"/path/to/some.vmx:snapshotID": vmware.Identifier,
 		"/path/to/some.vbox":           virtualbox.Identifier,
+		"/path/to/some.qcow2":          qemu.Identifier,
+		"/path/to/some.xml":            libvirt.Identifier,
+		"libvirt://centos7":            libvirt.Identifier,
 		"/path/to/something.else":      unknown.Identifier,
 	}
 
@@ -45,6 +52,8 @@ func TestEngine(t *testing.T) {
 	cases := map[core.VirtualizationEngine]string{
 		Engine("/path/to/some.vmx", dummy):       vmware.Identifier,
 		Engine("/path/to/some.vbox", dummy):      virtualbox.Identifier,
+		Engine("/path/to/some.qcow2", dummy):     qemu.Identifier,
+		Engine("libvirt://centos7", dummy):       libvirt.Identifier,
 		Engine("/path/to/something.else", dummy): unknown.Identifier,
 	}
 
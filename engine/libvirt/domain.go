@@ -0,0 +1,277 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Node is a generic XML element. Domain XML has a large and growing schema, so
+// rather than modeling it we decode it into a tree, change the parts we care
+// about, and write everything else back out untouched.
+type Node struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Content string     `xml:",chardata"`
+	Nodes   []*Node    `xml:",any"`
+}
+
+// Disk is a disk image that needs a qcow2 overlay for a linked clone
+type Disk struct {
+	// Source is the path to the original disk image
+	Source string
+
+	// Format is the format of the original disk image, e.g. qcow2 or raw
+	Format string
+
+	// Target is the path to the overlay we will create
+	Target string
+}
+
+// ParseDomain decodes domain XML into a tree of Nodes
+func ParseDomain(data []byte) (*Node, error) {
+	root := &Node{}
+	if err := xml.Unmarshal(data, root); err != nil {
+		return nil, err
+	}
+	if root.XMLName.Local != "domain" {
+		return nil, fmt.Errorf("expected <domain>, found <%s>", root.XMLName.Local)
+	}
+
+	root.trim()
+	root.restorePrefixes(map[string]string{xmlNamespace: "xml"})
+
+	return root, nil
+}
+
+// Marshal encodes the tree as indented XML
+func (n *Node) Marshal() ([]byte, error) {
+	data, err := xml.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, byte(10)), nil
+}
+
+// trim removes the whitespace between elements, which the decoder lumps into
+// the parent's content. Domain XML does not mix text and elements so this is
+// safe, and it lets us re-indent the output.
+func (n *Node) trim() {
+	n.Content = strings.TrimSpace(n.Content)
+	for _, child := range n.Nodes {
+		child.trim()
+	}
+}
+
+// xmlNamespace is the namespace of the reserved xml: prefix, e.g. xml:lang
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// restorePrefixes puts namespace prefixes back into element and attribute
+// names. The decoder replaces them with the namespace URL, which the encoder
+// can't turn back into a prefix, so a domain using e.g. <qemu:commandline>
+// would otherwise come out with a mangled xmlns:qemu declaration and an xmlns
+// attribute on every element. prefixes maps the URLs declared so far to their
+// prefix.
+func (n *Node) restorePrefixes(prefixes map[string]string) {
+	declared := map[string]string{}
+	for url, prefix := range prefixes {
+		declared[url] = prefix
+	}
+
+	for i, attr := range n.Attrs {
+		switch {
+		case attr.Name.Space == "xmlns":
+			declared[attr.Value] = attr.Name.Local
+			n.Attrs[i].Name = xml.Name{Local: "xmlns:" + attr.Name.Local}
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+			declared[attr.Value] = ""
+		}
+	}
+
+	n.XMLName = prefixName(n.XMLName, declared)
+	for i, attr := range n.Attrs {
+		n.Attrs[i].Name = prefixName(attr.Name, declared)
+	}
+
+	for _, child := range n.Nodes {
+		child.restorePrefixes(declared)
+	}
+}
+
+// prefixName returns name with its namespace as a prefix, e.g. qemu:arg. If
+// the namespace wasn't declared the decoder leaves the prefix as the
+// namespace, so it's used as is.
+func prefixName(name xml.Name, prefixes map[string]string) xml.Name {
+	if name.Space == "" {
+		return name
+	}
+	prefix, ok := prefixes[name.Space]
+	if !ok {
+		prefix = name.Space
+	}
+	if prefix == "" {
+		return xml.Name{Local: name.Local}
+	}
+	return xml.Name{Local: prefix + ":" + name.Local}
+}
+
+// Child returns the first child element with the specified name, or nil
+func (n *Node) Child(name string) *Node {
+	for _, child := range n.Nodes {
+		if child.XMLName.Local == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// Children returns all child elements with the specified name
+func (n *Node) Children(name string) []*Node {
+	var children []*Node
+	for _, child := range n.Nodes {
+		if child.XMLName.Local == name {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// Remove removes all child elements with the specified name
+func (n *Node) Remove(name string) {
+	nodes := n.Nodes[:0]
+	for _, child := range n.Nodes {
+		if child.XMLName.Local != name {
+			nodes = append(nodes, child)
+		}
+	}
+	n.Nodes = nodes
+}
+
+// Attr returns the value of the named attribute, or an empty string
+func (n *Node) Attr(name string) string {
+	for _, attr := range n.Attrs {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// SetAttr adds or replaces the named attribute
+func (n *Node) SetAttr(name, value string) {
+	for i, attr := range n.Attrs {
+		if attr.Name.Local == name {
+			n.Attrs[i].Value = value
+			return
+		}
+	}
+	n.Attrs = append(n.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+// RemoveAttr removes the named attribute
+func (n *Node) RemoveAttr(name string) {
+	attrs := n.Attrs[:0]
+	for _, attr := range n.Attrs {
+		if attr.Name.Local != name {
+			attrs = append(attrs, attr)
+		}
+	}
+	n.Attrs = attrs
+}
+
+// CloneDomain rewrites the source domain's XML for a linked clone called name.
+// Each writable disk is pointed at a new qcow2 overlay in dir, which the
+// caller must create using the returned list of disks. Anything that has to
+// be unique to a domain (the UUID, MAC addresses) is removed so libvirt will
+// generate new values when the clone is defined.
+func CloneDomain(data []byte, name, dir string) ([]byte, []Disk, error) {
+	root, err := ParseDomain(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A running domain's XML includes its runtime ID
+	root.RemoveAttr("id")
+	root.Remove("uuid")
+
+	nameNode := root.Child("name")
+	if nameNode == nil {
+		nameNode = &Node{XMLName: xml.Name{Local: "name"}}
+		root.Nodes = append([]*Node{nameNode}, root.Nodes...)
+	}
+	nameNode.Content = name
+
+	devices := root.Child("devices")
+	if devices == nil {
+		return nil, nil, errors.New("domain has no devices")
+	}
+
+	for _, iface := range devices.Children("interface") {
+		iface.Remove("mac")
+		// The host-side device name (e.g. vnet0) is assigned at runtime
+		iface.Remove("target")
+	}
+
+	var disks []Disk
+	for _, disk := range devices.Children("disk") {
+		// CD-ROMs and other read-only disks can be shared with the source
+		if disk.Attr("device") != "disk" || disk.Child("readonly") != nil {
+			continue
+		}
+
+		source := disk.Child("source")
+		if source == nil {
+			continue
+		}
+
+		var path string
+		switch disk.Attr("type") {
+		case "file":
+			path = source.Attr("file")
+		case "block":
+			path = source.Attr("dev")
+			disk.SetAttr("type", "file")
+			source.RemoveAttr("dev")
+		default:
+			return nil, nil, fmt.Errorf("cannot clone %s disk; only file and "+
+				"block disks are supported", disk.Attr("type"))
+		}
+
+		format := "raw"
+		driver := disk.Child("driver")
+		if driver != nil && driver.Attr("type") != "" {
+			format = driver.Attr("type")
+		}
+		if driver == nil {
+			driver = &Node{XMLName: xml.Name{Local: "driver"}}
+			driver.SetAttr("name", "qemu")
+			disk.Nodes = append(disk.Nodes, driver)
+		}
+
+		target := filepath.Join(dir, fmt.Sprintf("%s-disk%d.qcow2", name, len(disks)))
+
+		disks = append(disks, Disk{
+			Source: path,
+			Format: format,
+			Target: target,
+		})
+
+		driver.SetAttr("type", "qcow2")
+		source.SetAttr("file", target)
+		// libvirt will probe the backing chain of the overlay itself
+		disk.Remove("backingStore")
+	}
+
+	if len(disks) == 0 {
+		return nil, nil, errors.New("domain has no writable disks to clone")
+	}
+
+	out, err := root.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return out, disks, nil
+}
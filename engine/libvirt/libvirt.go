@@ -0,0 +1,726 @@
+package libvirt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+const (
+	Identifier = "libvirt"
+
+	// DomainPrefix marks a clone source as the name of an existing libvirt
+	// domain rather than a path to a domain XML file, e.g. libvirt://centos7
+	DomainPrefix = "libvirt://"
+)
+
+var (
+	ErrIPNotFound = errors.New("no IP address found")
+
+	// AddressSources are passed to virsh domifaddr --source, in order, until
+	// one of them finds an address. The DHCP lease table only works for
+	// libvirt-managed networks, the guest agent only works if it is installed
+	// in the guest, and the ARP table only works if the host has recently
+	// talked to the guest.
+	AddressSources = []string{"lease", "agent", "arp"}
+
+	// AddressSourceNames maps each of the AddressSources to the matching
+	// core.Address source
+	AddressSourceNames = map[string]string{
+		"lease": core.SourceDHCP,
+		"agent": core.SourceGuestTools,
+		"arp":   core.SourceARP,
+	}
+
+	// ExecPollInterval is how often Exec checks whether the command is done
+	ExecPollInterval = 250 * time.Millisecond
+
+	// AgentTimeout is how long InstallSSHKey waits for the guest agent to
+	// start after the domain boots
+	AgentTimeout = 2 * time.Minute
+)
+
+type Libvirt struct {
+	Config *core.MachineConfig
+}
+
+func New(config *core.MachineConfig) *Libvirt {
+	return &Libvirt{
+		Config: config,
+	}
+}
+
+func (l *Libvirt) Type() string {
+	return Identifier
+}
+
+// Clone defines a new libvirt domain that is a linked clone of the source.
+// The source may be a path to a domain XML file or the name of an existing
+// domain prefixed with libvirt://. Each of the source's disks gets a qcow2
+// overlay in .lovm, so the clone is created instantly.
+//
+// The clone's domain XML is kept in .lovm and MachineConfig.Path points to it.
+// The domain is named after the file.
+func (l *Libvirt) Clone(source string) error {
+	if source == "" && l.Config.Source == "" {
+		return errors.New("clone a virtual machine first")
+	}
+
+	if l.Found() {
+		// If the VM is already cloned but we've been asked to clone a
+		// different source than the one we cloned, error and inform the user
+		// that they need to destroy first
+		if source != "" && source != l.Config.Source {
+			return fmt.Errorf("asked to clone from %q but the virtual "+
+				"machine is already cloned from %q; run delete first", source,
+				l.Config.Source)
+		}
+		// If the VM is already cloned and the source is the same it's a no-op
+		return nil
+	}
+
+	// If there is no user input use the same source they entered earlier
+	if source == "" {
+		source = l.Config.Source
+	}
+
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, DomainPrefix) {
+		cmd := exec.Command("virsh", "dumpxml", "--inactive",
+			strings.TrimPrefix(source, DomainPrefix))
+		data, err = cmd.CombinedOutput()
+		if err != nil {
+			core.CommandError(cmd, data)
+			return err
+		}
+	} else {
+		data, err = ioutil.ReadFile(source)
+		if err != nil {
+			return err
+		}
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	// We'll create the domain name based on the pwd. Not perfect, but good
+	// enough. libvirt domain names are global, unlike VMware and VirtualBox
+	// paths, so we prefix them to make it clear where they came from.
+	_, dirName := filepath.Split(pwd)
+	name := "lovm-" + dirName
+
+	// Make a subfolder for the VM files to live in
+	targetDir := filepath.Join(pwd, ".lovm", dirName)
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return err
+	}
+
+	domain, disks, err := CloneDomain(data, name, targetDir)
+	if err != nil {
+		return err
+	}
+
+	for _, disk := range disks {
+		cmd := exec.Command("qemu-img", "create", "-f", "qcow2",
+			"-F", disk.Format, "-b", disk.Source, disk.Target)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			core.CommandError(cmd, out)
+			return err
+		}
+	}
+
+	target := filepath.Join(targetDir, fmt.Sprintf("%s.xml", name))
+	if err := ioutil.WriteFile(target, domain, 0644); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("virsh", "define", target)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return err
+	}
+
+	// Set VM path to the domain XML we just created.
+	l.Config.Path = target
+	l.Config.Source = source
+
+	return nil
+}
+
+// Start the domain. If the domain is already running it reports success, and
+// if it is paused it is resumed. virsh start restores a suspended domain on
+// its own.
+func (l *Libvirt) Start() error {
+	if err := l.Clone(""); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("virsh", "start", l.Domain())
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		if bytes.Contains(out, []byte(`Domain is already active`)) {
+			return l.unpause()
+		}
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// Suspend saves the domain's memory to disk and stops it using virsh
+// managedsave. If the domain is not running it reports success.
+func (l *Libvirt) Suspend() error {
+	if !l.Found() {
+		return nil
+	}
+
+	cmd := exec.Command("virsh", "managedsave", l.Domain())
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		if bytes.Contains(out, []byte(`domain is not running`)) {
+			return nil
+		}
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// Resume restores a suspended domain or unpauses a paused one
+func (l *Libvirt) Resume() error {
+	state, err := l.State()
+	if err != nil {
+		return err
+	}
+
+	switch state {
+	case core.StateRunning:
+		return nil
+	case core.StatePaused, core.StateSuspended:
+		return l.Start()
+	}
+
+	return core.ErrNotSuspended
+}
+
+// unpause resumes the domain if it is paused
+func (l *Libvirt) unpause() error {
+	state, err := l.State()
+	if err != nil {
+		return err
+	}
+	if state != core.StatePaused {
+		return nil
+	}
+
+	cmd := exec.Command("virsh", "resume", l.Domain())
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// Stop performs a hard stop on the domain using virsh destroy, which despite
+// the name does not delete anything. If the domain is suspended its saved
+// memory is discarded. If the domain is already stopped or does
+// not exist it reports success.
+func (l *Libvirt) Stop() error {
+	// If there's no VM we don't need to do anything
+	if !l.Found() {
+		return nil
+	}
+
+	cmd := exec.Command("virsh", "destroy", l.Domain())
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		// If the error message says the domain is already turned off, we're
+		// almost done. If it's suspended, stopping it means throwing away the
+		// saved memory. managedsave-remove does nothing if there isn't any.
+		if bytes.Contains(out, []byte(`domain is not running`)) {
+			cmd := exec.Command("virsh", "managedsave-remove", l.Domain())
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				core.CommandError(cmd, out)
+			}
+			return err
+		}
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+func (l *Libvirt) Restart() error {
+	if err := l.Stop(); err != nil {
+		return err
+	}
+	if err := l.Start(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete stops the domain, undefines it, and removes its overlay disks. The
+// source's disks are not touched. If the domain does not exist, Delete reports
+// success.
+//
+// We don't ask virsh to remove the domain's storage, since that includes any
+// CD-ROMs and read-only disks the clone shares with the source. The overlays
+// all live in the clone's directory in .lovm, so removing it is enough.
+func (l *Libvirt) Delete() error {
+	// If there's no VM we don't need to do anything
+	if !l.Found() {
+		return nil
+	}
+
+	if err := l.Stop(); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("virsh", "undefine", l.Domain(), "--snapshots-metadata")
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		// If someone else already undefined it we can still clean up
+		if !bytes.Contains(out, []byte(`failed to get domain`)) {
+			core.CommandError(cmd, out)
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(filepath.Dir(l.Config.Path)); err != nil {
+		return err
+	}
+
+	// Remove the machine path because we don't have a VM anymore
+	l.Config.Path = ""
+
+	return core.ClearKnownHosts()
+}
+
+// IP returns the first IPv4 address reported by virsh domifaddr, trying each
+// of the AddressSources in turn. If SSHConfig.NetworkInterface is set, only
+// addresses for the interface with that name or MAC address are considered.
+func (l *Libvirt) IP() (net.IP, error) {
+	for _, source := range AddressSources {
+		addresses, err := l.sourceAddresses(source)
+		if err != nil {
+			// The guest agent is optional, so if it's missing we just try
+			// the next source
+			continue
+		}
+
+		for _, addr := range core.FilterAddresses(addresses, l.Config.SSH.NetworkInterface) {
+			if addr.IP.To4() != nil {
+				return addr.IP, nil
+			}
+		}
+	}
+
+	return nil, ErrIPNotFound
+}
+
+// Addresses returns the addresses reported by the first of the AddressSources
+// that finds any, in the order virsh lists them. The interface names depend on
+// the source: the lease table and ARP table use the host's name for the
+// interface (e.g. vnet0), while the guest agent uses the guest's (e.g. eth0).
+func (l *Libvirt) Addresses() ([]core.Address, error) {
+	addresses, _, err := l.ExplainAddresses()
+	return addresses, err
+}
+
+// ExplainAddresses is like Addresses, but also reports what each of the
+// AddressSources found, for lovm ip --explain
+func (l *Libvirt) ExplainAddresses() ([]core.Address, []core.Resolution, error) {
+	var resolutions []core.Resolution
+
+	for _, source := range AddressSources {
+		addresses, err := l.sourceAddresses(source)
+		resolutions = append(resolutions, core.Resolution{
+			Resolver: source,
+			Found:    addresses,
+			Err:      err,
+		})
+		if err == nil && len(addresses) > 0 {
+			return addresses, resolutions, nil
+		}
+	}
+
+	return nil, resolutions, nil
+}
+
+// sourceAddresses runs virsh domifaddr with the given source, leaving out
+// loopback addresses
+func (l *Libvirt) sourceAddresses(source string) ([]core.Address, error) {
+	cmd := exec.Command("virsh", "domifaddr", l.Domain(), "--source", source)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("virsh domifaddr --source %s failed: %s", source, strings.TrimSpace(string(out)))
+	}
+
+	var addresses []core.Address
+	for _, addr := range ParseInterfaceAddresses(out) {
+		if addr.IP.IsLoopback() {
+			continue
+		}
+		addresses = append(addresses, core.Address{
+			Interface: addr.Name,
+			MAC:       addr.MAC.String(),
+			IP:        addr.IP,
+			Source:    AddressSourceNames[source],
+		})
+	}
+
+	return addresses, nil
+}
+
+// Mount is not supported yet. libvirt can share folders using virtiofs, but
+// that requires shared memory to be configured before the domain starts.
+func (l *Libvirt) Mount() error {
+	return core.ErrNotImplemented
+}
+
+// Forward is not supported. libvirt's NAT network can only forward ports with
+// host firewall rules, which need root. The guest's address on the network is
+// reachable from the host, so lovm forward's proxy works instead.
+func (l *Libvirt) Forward() error {
+	return core.ErrNotImplemented
+}
+
+// Configure is not supported. The domain's hardware is in its XML, which the
+// user can change with virsh edit.
+func (l *Libvirt) Configure() error {
+	return core.ErrNotImplemented
+}
+
+// CopyToGuest is not supported. virsh can't copy files into the guest, even
+// with the QEMU guest agent. Use SSH instead.
+func (l *Libvirt) CopyToGuest(hostPath, guestPath string) error {
+	return core.ErrNotImplemented
+}
+
+// CopyFromGuest is not supported. See CopyToGuest.
+func (l *Libvirt) CopyFromGuest(guestPath, hostPath string) error {
+	return core.ErrNotImplemented
+}
+
+// GuestExecStatus is the result of the guest agent's guest-exec-status
+// command. The output is base64 encoded, which encoding/json decodes for us.
+type GuestExecStatus struct {
+	Exited   bool   `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	Signal   int    `json:"signal"`
+	OutData  []byte `json:"out-data"`
+	ErrData  []byte `json:"err-data"`
+}
+
+// agentCommand sends a command to the QEMU guest agent in the domain and
+// decodes the "return" part of the response into result.
+func (l *Libvirt) agentCommand(command string, arguments interface{}, result interface{}) error {
+	request, err := json.Marshal(map[string]interface{}{
+		"execute":   command,
+		"arguments": arguments,
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("virsh", "qemu-agent-command", l.Domain(), string(request))
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return err
+	}
+
+	return json.Unmarshal(out, &struct {
+		Return interface{} `json:"return"`
+	}{result})
+}
+
+// Exec runs the script in the guest with the QEMU guest agent's guest-exec
+// command, which needs qemu-guest-agent to be installed in the guest and a
+// guest agent channel in the domain XML. The agent collects all of the
+// output, so we can only show it once the script has finished.
+func (l *Libvirt) Exec(script string, stdout, stderr io.Writer) (int, error) {
+	if !l.Found() {
+		return 0, errors.New("clone a virtual machine first")
+	}
+
+	started := struct {
+		PID int `json:"pid"`
+	}{}
+	err := l.agentCommand("guest-exec", map[string]interface{}{
+		"path":           "/bin/sh",
+		"arg":            []string{"-c", script},
+		"capture-output": true,
+	}, &started)
+	if err != nil {
+		return 0, err
+	}
+
+	status := &GuestExecStatus{}
+	for {
+		err := l.agentCommand("guest-exec-status", map[string]interface{}{
+			"pid": started.PID,
+		}, status)
+		if err != nil {
+			return 0, err
+		}
+		if status.Exited {
+			break
+		}
+		time.Sleep(ExecPollInterval)
+	}
+
+	stdout.Write(status.OutData)
+	stderr.Write(status.ErrData)
+
+	// Like the shell, report a command killed by a signal as 128 + signal
+	if status.Signal != 0 {
+		return 128 + status.Signal, nil
+	}
+	return status.ExitCode, nil
+}
+
+// InstallSSHKey adds the key to authorized_keys in the guest using Exec. The
+// guest agent runs commands as root, so this doesn't need a login or password,
+// but it does need qemu-guest-agent in the guest.
+func (l *Libvirt) InstallSSHKey(publicKey string) error {
+	state, err := l.State()
+	if err != nil {
+		return err
+	}
+	if state != core.StateRunning {
+		return core.ErrNotRunning
+	}
+
+	// The agent won't answer until the guest has booted
+	deadline := time.Now().Add(AgentTimeout)
+	for {
+		cmd := exec.Command("virsh", "qemu-agent-command", l.Domain(), `{"execute":"guest-ping"}`)
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			core.CommandError(cmd, out)
+			return fmt.Errorf("the QEMU guest agent is not responding: %s", err)
+		}
+		time.Sleep(time.Second)
+	}
+
+	stderr := &bytes.Buffer{}
+	code, err := l.Exec(core.AuthorizeKeyScript(l.Config.SSH.Login, publicKey), ioutil.Discard, stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("failed to install the SSH key in the guest: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// Found will check for the presence of the clone's domain XML
+func (l *Libvirt) Found() bool {
+	if l.Config.Path == "" {
+		return false
+	}
+
+	fi, err := os.Stat(l.Config.Path)
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode().IsRegular()
+}
+
+// State uses virsh domstate to check the domain's state. We ask for the
+// reason too, because that's the only way to tell that a domain which is shut
+// off has been suspended with managedsave.
+func (l *Libvirt) State() (core.State, error) {
+	if !l.Found() {
+		return core.StateNotCloned, nil
+	}
+
+	cmd := exec.Command("virsh", "domstate", l.Domain(), "--reason")
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return core.StateUnknown, err
+	}
+
+	return ParseState(strings.TrimSpace(string(out))), nil
+}
+
+// ParseState translates the output of virsh domstate --reason into a
+// core.State. For example:
+//
+//	running (booted)
+//	shut off (saved)
+func ParseState(output string) core.State {
+	state := output
+	reason := ""
+	if i := strings.Index(output, " ("); i != -1 {
+		state = output[:i]
+		reason = strings.TrimSuffix(output[i+2:], ")")
+	}
+
+	if state == "shut off" && reason == "saved" {
+		return core.StateSuspended
+	}
+
+	switch state {
+	case "running", "in shutdown":
+		return core.StateRunning
+	case "shut off", "crashed":
+		return core.StateStopped
+	case "paused":
+		return core.StatePaused
+	case "pmsuspended":
+		return core.StateSuspended
+	}
+	return core.StateUnknown
+}
+
+// SaveSnapshot creates an internal snapshot. If the domain is running the
+// snapshot includes its memory.
+func (l *Libvirt) SaveSnapshot(name string) error {
+	return l.snapshotCommand("snapshot-create-as", name)
+}
+
+// RestoreSnapshot reverts the domain to the snapshot, including its power
+// state at the time the snapshot was taken.
+func (l *Libvirt) RestoreSnapshot(name string) error {
+	return l.snapshotCommand("snapshot-revert", name)
+}
+
+func (l *Libvirt) DeleteSnapshot(name string) error {
+	return l.snapshotCommand("snapshot-delete", name)
+}
+
+// ListSnapshots lists snapshot names with parents before their children
+func (l *Libvirt) ListSnapshots() ([]string, error) {
+	if !l.Found() {
+		return nil, errors.New("clone a virtual machine first")
+	}
+
+	cmd := exec.Command("virsh", "snapshot-list", l.Domain(), "--name", "--topological")
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return nil, err
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+
+	return names, nil
+}
+
+func (l *Libvirt) snapshotCommand(command, name string) error {
+	if !l.Found() {
+		return errors.New("clone a virtual machine first")
+	}
+
+	cmd := exec.Command("virsh", command, l.Domain(), name)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// Domain returns the name of the clone's libvirt domain, which matches the
+// name of the domain XML file.
+func (l *Libvirt) Domain() string {
+	_, file := filepath.Split(l.Config.Path)
+	return strings.TrimSuffix(file, filepath.Ext(file))
+}
+
+// InterfaceAddress is a row from virsh domifaddr
+type InterfaceAddress struct {
+	Name string
+	MAC  net.HardwareAddr
+	IP   net.IP
+}
+
+// ParseInterfaceAddresses parses the output of virsh domifaddr. For example:
+//
+//	 Name       MAC address          Protocol     Address
+//	-------------------------------------------------------------------------------
+//	 lo         00:00:00:00:00:00    ipv4         127.0.0.1/8
+//	 eth0       52:54:00:8e:8a:3c    ipv4         192.168.122.45/24
+//	 -          -                    ipv6         fe80::5054:ff:fe8e:8a3c/64
+//
+// When an interface has more than one address the name and MAC are replaced
+// with - on the following rows.
+func ParseInterfaceAddresses(data []byte) []InterfaceAddress {
+	var addresses []InterfaceAddress
+	var current InterfaceAddress
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 || fields[0] == "Name" {
+			continue
+		}
+
+		if fields[0] != "-" {
+			mac, err := net.ParseMAC(fields[1])
+			if err != nil {
+				continue
+			}
+			current = InterfaceAddress{Name: fields[0], MAC: mac}
+		}
+
+		ip, _, err := net.ParseCIDR(fields[3])
+		if err != nil {
+			continue
+		}
+
+		addr := current
+		addr.IP = ip
+		addresses = append(addresses, addr)
+	}
+
+	return addresses
+}
@@ -0,0 +1,425 @@
+package libvirt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+// FakeVirsh is a stand-in for virsh and qemu-img. It records each invocation
+// in $FAKE_LOG and tracks whether the domain is running using $FAKE_STATE.
+const FakeVirsh = `#!/bin/sh
+echo "virsh $*" >> "$FAKE_LOG"
+case "$1" in
+dumpxml)
+	cat "$FAKE_FIXTURES/centos.xml" ;;
+define)
+	echo "Domain lovm-example defined from $2" ;;
+start)
+	if [ -f "$FAKE_STATE" ]; then
+		echo "error: Domain is already active" >&2
+		exit 1
+	fi
+	touch "$FAKE_STATE" ;;
+destroy)
+	if [ ! -f "$FAKE_STATE" ]; then
+		echo "error: Failed to destroy domain $2" >&2
+		echo "error: Requested operation is not valid: domain is not running" >&2
+		exit 1
+	fi
+	rm "$FAKE_STATE" ;;
+domstate)
+	if [ -f "$FAKE_STATE" ]; then
+		echo "running (booted)"
+	else
+		echo "shut off (destroyed)"
+	fi ;;
+managedsave-remove)
+	echo "Domain $2 has no managed save image; removal skipped" ;;
+undefine)
+	echo "Domain $2 has been undefined" ;;
+qemu-agent-command)
+	case "$3" in
+	*guest-exec-status*)
+		cat "$FAKE_FIXTURES/guest-exec-status.json" ;;
+	*)
+		echo '{"return":{"pid":4242}}' ;;
+	esac ;;
+domifaddr)
+	case "$4" in
+	agent)
+		cat "$FAKE_FIXTURES/domifaddr-agent.txt" ;;
+	*)
+		echo "error: Failed to query for interfaces addresses" >&2
+		exit 1 ;;
+	esac ;;
+esac
+`
+
+const FakeQemuImg = `#!/bin/sh
+echo "qemu-img $*" >> "$FAKE_LOG"
+for last; do :; done
+touch "$last"
+`
+
+// SetupFakes puts fake virsh and qemu-img commands on the PATH and changes to
+// a temporary project directory. The returned function reverts everything.
+func SetupFakes(t *testing.T) (string, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake commands require a unix shell")
+	}
+
+	fixtures, err := filepath.Abs("test-fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "lovm-libvirt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin := filepath.Join(dir, "bin")
+	project := filepath.Join(dir, "example")
+	for _, path := range []string{bin, project} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(bin, "virsh"), []byte(FakeVirsh), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, "qemu-img"), []byte(FakeQemuImg), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(project); err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	os.Setenv("FAKE_LOG", filepath.Join(dir, "log"))
+	os.Setenv("FAKE_STATE", filepath.Join(dir, "running"))
+	os.Setenv("FAKE_FIXTURES", fixtures)
+
+	return dir, func() {
+		os.Chdir(pwd)
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func ReadLog(t *testing.T, dir string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestCloneDomain(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("test-fixtures", "centos.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, disks, err := CloneDomain(data, "lovm-example", "/project/.lovm/example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(disks) != 1 {
+		t.Fatalf("Expected one disk, found %#v", disks)
+	}
+	expected := Disk{
+		Source: "/var/lib/libvirt/images/centos7.qcow2",
+		Format: "qcow2",
+		Target: "/project/.lovm/example/lovm-example-disk0.qcow2",
+	}
+	if disks[0] != expected {
+		t.Errorf("Expected %#v, found %#v", expected, disks[0])
+	}
+
+	// Namespaced elements keep their prefix, and the namespace is only
+	// declared on the root
+	for _, s := range []string{
+		`<domain type="kvm" xmlns:qemu="http://libvirt.org/schemas/domain/qemu/1.0">`,
+		`<qemu:commandline>`,
+		`<qemu:arg value="-s"></qemu:arg>`,
+		`<qemu:env name="QEMU_AUDIO_DRV" value="none"></qemu:env>`,
+	} {
+		if !strings.Contains(string(out), s) {
+			t.Errorf("Expected %s in:\n%s", s, out)
+		}
+	}
+	if n := strings.Count(string(out), "xmlns"); n != 1 {
+		t.Errorf("Expected one namespace declaration, found %d in:\n%s", n, out)
+	}
+
+	domain, err := ParseDomain(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := domain.Child("name").Content; name != "lovm-example" {
+		t.Errorf("Expected name lovm-example, found %q", name)
+	}
+	if domain.Child("uuid") != nil || domain.Attr("id") != "" {
+		t.Error("Expected uuid and id to be removed")
+	}
+	if vcpu := domain.Child("vcpu").Content; vcpu != "2" {
+		t.Errorf("Expected vcpu to be preserved, found %q", vcpu)
+	}
+
+	devices := domain.Child("devices")
+	disk := devices.Children("disk")[0]
+	if file := disk.Child("source").Attr("file"); file != expected.Target {
+		t.Errorf("Expected disk source %q, found %q", expected.Target, file)
+	}
+	if disk.Child("backingStore") != nil {
+		t.Error("Expected backingStore to be removed")
+	}
+	cdrom := devices.Children("disk")[1]
+	if file := cdrom.Child("source").Attr("file"); !strings.HasSuffix(file, ".iso") {
+		t.Errorf("Expected cdrom to be left alone, found %q", file)
+	}
+
+	iface := devices.Child("interface")
+	if iface.Child("mac") != nil || iface.Child("target") != nil {
+		t.Error("Expected interface mac and target to be removed")
+	}
+	if network := iface.Child("source").Attr("network"); network != "default" {
+		t.Errorf("Expected interface source to be preserved, found %q", network)
+	}
+}
+
+func TestParseInterfaceAddresses(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("test-fixtures", "domifaddr-agent.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := ParseInterfaceAddresses(data)
+
+	expected := []string{
+		"lo 00:00:00:00:00:00 127.0.0.1",
+		"lo 00:00:00:00:00:00 ::1",
+		"eth0 52:54:00:8e:8a:3c 192.168.122.45",
+		"eth0 52:54:00:8e:8a:3c fe80::5054:ff:fe8e:8a3c",
+		"eth1 52:54:00:5d:21:07 10.10.0.12",
+	}
+
+	if len(addrs) != len(expected) {
+		t.Fatalf("Expected %d addresses, found %#v", len(expected), addrs)
+	}
+	for i, addr := range addrs {
+		output := strings.Join([]string{addr.Name, addr.MAC.String(), addr.IP.String()}, " ")
+		if output != expected[i] {
+			t.Errorf("Expected %q, found %q", expected[i], output)
+		}
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	dir, cleanup := SetupFakes(t)
+	defer cleanup()
+
+	config := &core.MachineConfig{}
+	vm := New(config)
+
+	if err := vm.Clone("libvirt://centos7"); err != nil {
+		t.Fatal(err)
+	}
+	if !vm.Found() || vm.Domain() != "lovm-example" {
+		t.Fatalf("Expected domain lovm-example to be cloned, found %q", config.Path)
+	}
+
+	// Start twice and stop twice to check that both are idempotent
+	for _, step := range []func() error{vm.Start, vm.Start, vm.Stop, vm.Stop} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if state, err := vm.State(); err != nil || state != core.StateStopped {
+		t.Errorf("Expected %s, found %s (%v)", core.StateStopped, state, err)
+	}
+
+	if err := vm.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := vm.State(); err != nil || state != core.StateRunning {
+		t.Errorf("Expected %s, found %s (%v)", core.StateRunning, state, err)
+	}
+
+	ip, err := vm.IP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "192.168.122.45" {
+		t.Errorf("Expected 192.168.122.45, found %s", ip)
+	}
+
+	config.SSH.NetworkInterface = "52:54:00:5D:21:07"
+	ip, err = vm.IP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.10.0.12" {
+		t.Errorf("Expected 10.10.0.12, found %s", ip)
+	}
+
+	if err := vm.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if vm.Found() {
+		t.Error("Expected domain to be deleted")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "example", ".lovm", "example")); !os.IsNotExist(err) {
+		t.Errorf("Expected the overlay directory to be removed, found %v", err)
+	}
+
+	disk := filepath.Join(dir, "example", ".lovm", "example", "lovm-example-disk0.qcow2")
+	xml := filepath.Join(dir, "example", ".lovm", "example", "lovm-example.xml")
+
+	expected := []string{
+		"virsh dumpxml --inactive centos7",
+		"qemu-img create -f qcow2 -F qcow2 -b /var/lib/libvirt/images/centos7.qcow2 " + disk,
+		"virsh define " + xml,
+		"virsh start lovm-example",
+		"virsh start lovm-example",
+		"virsh domstate lovm-example --reason",
+		"virsh destroy lovm-example",
+		"virsh destroy lovm-example",
+		"virsh managedsave-remove lovm-example",
+		"virsh domstate lovm-example --reason",
+		"virsh start lovm-example",
+		"virsh domstate lovm-example --reason",
+		"virsh domifaddr lovm-example --source lease",
+		"virsh domifaddr lovm-example --source agent",
+		"virsh domifaddr lovm-example --source lease",
+		"virsh domifaddr lovm-example --source agent",
+		"virsh destroy lovm-example",
+		// The cdrom is shared with the source, so virsh must not remove any
+		// storage
+		"virsh undefine lovm-example --snapshots-metadata",
+	}
+
+	log := ReadLog(t, dir)
+	if len(log) != len(expected) {
+		t.Fatalf("Expected commands:\n%s\nfound:\n%s", strings.Join(expected, "\n"), strings.Join(log, "\n"))
+	}
+	for i := range expected {
+		if log[i] != expected[i] {
+			t.Errorf("Expected %q, found %q", expected[i], log[i])
+		}
+	}
+}
+
+func TestParseState(t *testing.T) {
+	cases := map[string]core.State{
+		"running (booted)":      core.StateRunning,
+		"running":               core.StateRunning,
+		"paused (user)":         core.StatePaused,
+		"shut off (destroyed)":  core.StateStopped,
+		"shut off (saved)":      core.StateSuspended,
+		"pmsuspended (unknown)": core.StateSuspended,
+		"crashed (panicked)":    core.StateStopped,
+		"blocked (unknown)":     core.StateUnknown,
+	}
+
+	for input, expected := range cases {
+		if output := ParseState(input); output != expected {
+			t.Errorf("Expected %s for %q, found %s", expected, input, output)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	dir, cleanup := SetupFakes(t)
+	defer cleanup()
+
+	config := &core.MachineConfig{}
+	vm := New(config)
+
+	if err := vm.Clone("libvirt://centos7"); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code, err := vm.Exec("ls /nope; uname", stdout, stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != 2 {
+		t.Errorf("Expected exit code 2, found %d", code)
+	}
+	if stdout.String() != "Linux\n" {
+		t.Errorf("Unexpected stdout %q", stdout.String())
+	}
+	if stderr.String() != "ls: cannot access '/nope': No such file or directory\n" {
+		t.Errorf("Unexpected stderr %q", stderr.String())
+	}
+
+	log := ReadLog(t, dir)
+	expected := `virsh qemu-agent-command lovm-example {"arguments":{"arg":["-c","ls /nope; uname"],"capture-output":true,"path":"/bin/sh"},"execute":"guest-exec"}`
+	if log[len(log)-2] != expected {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expected, log[len(log)-2])
+	}
+	expected = `virsh qemu-agent-command lovm-example {"arguments":{"pid":4242},"execute":"guest-exec-status"}`
+	if log[len(log)-1] != expected {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expected, log[len(log)-1])
+	}
+}
+
+func TestInstallSSHKey(t *testing.T) {
+	dir, cleanup := SetupFakes(t)
+	defer cleanup()
+
+	config := &core.MachineConfig{}
+	vm := New(config)
+
+	if err := vm.Clone("libvirt://centos7"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.InstallSSHKey("ssh-ed25519 AAAA lovm"); err != core.ErrNotRunning {
+		t.Errorf("Expected ErrNotRunning, found %v", err)
+	}
+
+	if err := vm.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake agent says the script failed
+	err := vm.InstallSSHKey("ssh-ed25519 AAAA lovm")
+	if err == nil || !strings.Contains(err.Error(), "cannot access") {
+		t.Errorf("Expected the script's error, found %v", err)
+	}
+
+	pinged := false
+	for _, line := range ReadLog(t, dir) {
+		if line == `virsh qemu-agent-command lovm-example {"execute":"guest-ping"}` {
+			pinged = true
+		}
+	}
+	if !pinged {
+		t.Error("Expected InstallSSHKey to wait for the guest agent")
+	}
+}
@@ -0,0 +1,1067 @@
+package qemu
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+const (
+	Identifier = "qemu"
+
+	// Binary is the QEMU system emulator we run. We only support x86_64
+	// guests for now.
+	Binary = "qemu-system-x86_64"
+
+	// DnsmasqLeasesFile is where dnsmasq writes its lease table by default.
+	// This can be overridden per NIC in the hardware file.
+	DnsmasqLeasesFile = "/var/lib/misc/dnsmasq.leases"
+
+	// QMPTimeout bounds every conversation with QEMU's control socket. Stop
+	// has to finish within 10 seconds so this must be comfortably less.
+	QMPTimeout = 5 * time.Second
+
+	// SuspendSnapshot is the internal snapshot we use to save the VM's memory
+	// when it is suspended. It is deleted once the VM is resumed.
+	SuspendSnapshot = "lovm-suspend"
+
+	DefaultCPUs   = 1
+	DefaultMemory = 1024
+)
+
+var (
+	ErrNotRunning        = errors.New("the virtual machine is not running")
+	ErrInterfaceNotFound = errors.New("no interface found")
+	ErrLeaseNotFound     = errors.New("no active lease found")
+	ErrIPNotFound        = errors.New("no IP address found")
+)
+
+// Hardware describes the virtual hardware for a QEMU VM. A qcow2 image doesn't
+// say anything about the machine it belongs to, so we keep this in a JSON file
+// next to the disk image, with the same name. For example, centos.qcow2 is
+// described by centos.json:
+//
+//	{
+//	  "cpus": 2,
+//	  "memory": 2048,
+//	  "nics": [
+//	    {"type": "user"},
+//	    {"type": "tap", "ifname": "tap0"}
+//	  ]
+//	}
+//
+// If the source doesn't have a hardware file we use a single CPU, 1024 MiB of
+// memory, and one user-mode NIC.
+type Hardware struct {
+	CPUs int `json:"cpus,omitempty"`
+
+	// Memory is specified in MiB
+	Memory int `json:"memory,omitempty"`
+
+	NICs []NIC `json:"nics,omitempty"`
+}
+
+// NIC is a virtual network interface. The clone's copy of the hardware file
+// records the MAC address and SSH port we picked for it, so they stay the same
+// across restarts.
+type NIC struct {
+	// Type is either "user", for QEMU's built-in user-mode network, or "tap"
+	// to attach the NIC to an existing tap device on the host.
+	Type string `json:"type"`
+
+	MAC string `json:"mac,omitempty"`
+
+	// Ifname is the name of the tap device on the host (tap only)
+	Ifname string `json:"ifname,omitempty"`
+
+	// SSHPort is the host port forwarded to port 22 in the guest (user only)
+	SSHPort int `json:"ssh-port,omitempty"`
+
+	// Leases is the path to the dnsmasq lease table for the tap network. If
+	// empty, DnsmasqLeasesFile is used (tap only)
+	Leases string `json:"leases,omitempty"`
+}
+
+type QEMU struct {
+	Config *core.MachineConfig
+}
+
+func New(config *core.MachineConfig) *QEMU {
+	return &QEMU{
+		Config: config,
+	}
+}
+
+func (q *QEMU) Type() string {
+	return Identifier
+}
+
+// Clone creates a linked clone of the source disk image. The clone is a qcow2
+// overlay that uses the source as its backing file, so it is created
+// instantly and only stores the blocks that change. The source must not be
+// modified (or run) while clones of it exist.
+func (q *QEMU) Clone(source string) error {
+	if source == "" && q.Config.Source == "" {
+		return errors.New("clone a virtual machine first")
+	}
+
+	if q.Found() {
+		// If the VM is already cloned but we've been asked to clone a
+		// different source than the one we cloned, error and inform the user
+		// that they need to destroy first
+		if source != "" && source != q.Config.Source {
+			return fmt.Errorf("asked to clone from %q but the virtual "+
+				"machine is already cloned from %q; run delete first", source,
+				q.Config.Source)
+		}
+		// If the VM is already cloned and the source is the same it's a no-op
+		return nil
+	}
+
+	// If there is no user input use the same source they entered earlier
+	if source == "" {
+		source = q.Config.Source
+	}
+
+	if strings.Contains(source, ":") {
+		return errors.New("qemu does not support cloning from a snapshot; " +
+			"specify a path to a .qcow2 image")
+	}
+
+	// qemu-img resolves a relative backing file path relative to the overlay,
+	// so we need to use an absolute path.
+	backing, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+
+	hardware, err := ReadHardware(HardwareFile(backing))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if hardware == nil {
+		hardware = &Hardware{}
+	}
+	if err := hardware.Prepare(); err != nil {
+		return err
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	// We'll create the VM name based on the pwd. Not perfect, but good enough.
+	_, targetName := filepath.Split(pwd)
+
+	// Make a subfolder for the VM files to live in
+	targetDir := filepath.Join(pwd, ".lovm", targetName)
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return err
+	}
+
+	target := filepath.Join(targetDir, fmt.Sprintf("%s.qcow2", targetName))
+
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "qcow2",
+		"-b", backing, target)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return err
+	}
+
+	if err := hardware.Save(HardwareFile(target)); err != nil {
+		return err
+	}
+
+	// Point SSH at the forwarded port if the first NIC is user-mode
+	if q.Config.SSH.Port == 0 && hardware.NICs[0].Type == "user" {
+		q.Config.SSH.Port = hardware.NICs[0].SSHPort
+	}
+
+	// Set VM path to the disk image we just created.
+	q.Config.Path = target
+	q.Config.Source = source
+
+	return nil
+}
+
+// Start launches QEMU in the background. If the VM is already running it
+// reports success, and if it is paused it is resumed. If it is suspended we
+// launch QEMU from the suspend snapshot and then delete it.
+func (q *QEMU) Start() error {
+	if err := q.Clone(""); err != nil {
+		return err
+	}
+
+	if qmp, err := DialQMP(q.SocketPath(), QMPTimeout); err == nil {
+		defer qmp.Close()
+
+		status, err := qmp.Status()
+		if err != nil {
+			return err
+		}
+		if status == "running" {
+			return nil
+		}
+		_, err = qmp.Execute("cont", nil)
+		return err
+	}
+
+	hardware, err := ReadHardware(HardwareFile(q.Config.Path))
+	if err != nil {
+		return err
+	}
+
+	suspended, err := q.Suspended()
+	if err != nil {
+		return err
+	}
+
+	// A stale socket from a crashed QEMU will prevent the new one from
+	// listening.
+	os.Remove(q.SocketPath())
+
+	cmd := BuildCommand(q.Config.Path, hardware, q.Config.Forwards, q.SocketPath(), q.PidPath())
+	if suspended {
+		cmd.Args = append(cmd.Args, "-loadvm", SuspendSnapshot)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return err
+	}
+
+	if suspended {
+		// If we leave the snapshot behind we'll resume from it again next
+		// time, which would be very confusing.
+		return q.snapshotCommand("delvm", "-d", SuspendSnapshot)
+	}
+
+	return nil
+}
+
+// Suspend saves the VM's memory in an internal snapshot and then stops QEMU.
+// If the VM is not running it reports success.
+func (q *QEMU) Suspend() error {
+	if !q.Found() {
+		return nil
+	}
+
+	qmp, err := DialQMP(q.SocketPath(), QMPTimeout)
+	if err != nil {
+		// If nothing is listening QEMU isn't running, but if it doesn't
+		// answer it may be hung, and we can't tell whether it's suspended
+		if NotListening(err) {
+			return nil
+		}
+		return err
+	}
+	defer qmp.Close()
+
+	// Saving memory can take a while, so give QEMU more time
+	qmp.conn.SetDeadline(time.Now().Add(2 * time.Minute))
+
+	if err := qmp.HumanMonitorCommand("savevm " + SuspendSnapshot); err != nil {
+		return err
+	}
+
+	_, err = qmp.Execute("quit", nil)
+	return err
+}
+
+// Resume starts a suspended VM or continues a paused one. Start handles both,
+// so we just make sure we're not booting a stopped VM.
+func (q *QEMU) Resume() error {
+	state, err := q.State()
+	if err != nil {
+		return err
+	}
+
+	switch state {
+	case core.StateRunning:
+		return nil
+	case core.StatePaused, core.StateSuspended:
+		return q.Start()
+	}
+
+	return core.ErrNotSuspended
+}
+
+// Suspended checks for the suspend snapshot
+func (q *QEMU) Suspended() (bool, error) {
+	names, err := q.ListSnapshots()
+	if err != nil {
+		return false, err
+	}
+
+	for _, name := range names {
+		if name == SuspendSnapshot {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Stop cuts the power by telling QEMU to quit. If QEMU doesn't answer we kill
+// the process instead, as long as the pidfile still points at it (see
+// IsVMProcess). If the VM is suspended its saved memory is discarded. If the
+// machine is already stopped or does not exist it reports success.
+func (q *QEMU) Stop() error {
+	// If there's no VM we don't need to do anything
+	if !q.Found() {
+		return nil
+	}
+
+	qmp, err := DialQMP(q.SocketPath(), QMPTimeout)
+	if err == nil {
+		_, err = qmp.Execute("quit", nil)
+		qmp.Close()
+		if err == nil {
+			return nil
+		}
+	}
+
+	data, err := ioutil.ReadFile(q.PidPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return err
+		}
+
+		if IsVMProcess(pid, q.Config.Path) {
+			process, err := os.FindProcess(pid)
+			if err != nil {
+				return nil
+			}
+
+			// If the process is already gone, that's what we wanted anyway
+			err = process.Kill()
+			if err != nil && err != os.ErrProcessDone && !strings.Contains(err.Error(), "no such process") {
+				return err
+			}
+
+			return os.Remove(q.PidPath())
+		}
+
+		// QEMU crashed or the host rebooted, and the PID may belong to
+		// something else by now, so we leave it alone
+		if err := os.Remove(q.PidPath()); err != nil {
+			return err
+		}
+	}
+
+	// No QEMU process and no socket means QEMU isn't running. If the VM is
+	// suspended, stopping it means throwing away the saved memory.
+	suspended, err := q.Suspended()
+	if err != nil || !suspended {
+		return err
+	}
+	return q.snapshotCommand("delvm", "-d", SuspendSnapshot)
+}
+
+// IsVMProcess returns true if pid is QEMU running the disk image. The pidfile
+// is left behind if QEMU crashes or the host reboots, so the PID in it may
+// belong to an unrelated process.
+func IsVMProcess(pid int, disk string) bool {
+	var cmdline string
+	if data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		cmdline = string(bytes.Replace(data, []byte{0}, []byte{' '}, -1))
+	} else if _, err := os.Stat("/proc/self"); err == nil {
+		// We have /proc, so the process is gone
+		return false
+	} else {
+		// macOS doesn't have /proc
+		out, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+		if err != nil {
+			return false
+		}
+		cmdline = string(out)
+	}
+
+	return strings.Contains(cmdline, Binary) && strings.Contains(cmdline, "file="+disk+",")
+}
+
+func (q *QEMU) Restart() error {
+	if err := q.Stop(); err != nil {
+		return err
+	}
+	if err := q.Start(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete stops the VM and removes the VM's folder under .lovm, including the
+// overlay disk, hardware file, and control socket. The source image is not
+// touched. If Clone set SSHConfig.Port to the forwarded port it is cleared, so
+// the next clone can pick a new one.
+func (q *QEMU) Delete() error {
+	// If there's no VM we don't need to do anything
+	if !q.Found() {
+		return nil
+	}
+
+	if err := q.Stop(); err != nil {
+		return err
+	}
+
+	hardware, err := ReadHardware(HardwareFile(q.Config.Path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.RemoveAll(filepath.Dir(q.Config.Path)); err != nil {
+		return err
+	}
+
+	// Remove the machine path because we don't have a VM anymore
+	q.Config.Path = ""
+	if hardware != nil && len(hardware.NICs) > 0 && hardware.NICs[0].Type == "user" &&
+		q.Config.SSH.Port == hardware.NICs[0].SSHPort {
+		q.Config.SSH.Port = 0
+	}
+
+	return core.ClearKnownHosts()
+}
+
+// IP returns the address to use to connect to the VM. For a user-mode NIC
+// this is the host's loopback address, because QEMU forwards the SSH port
+// (see SSHConfig.Port) to the guest. For a tap NIC we look up the NIC's MAC
+// address in the dnsmasq lease table for the tap network.
+//
+// If SSHConfig.NetworkInterface is set (e.g. "net1") that NIC is used,
+// otherwise we use the first one.
+func (q *QEMU) IP() (net.IP, error) {
+	if !q.Running() {
+		return nil, ErrNotRunning
+	}
+
+	hardware, err := ReadHardware(HardwareFile(q.Config.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	id := "net0"
+	if q.Config.SSH.NetworkInterface != "" {
+		id = q.Config.SSH.NetworkInterface
+	}
+	nic, err := hardware.FindNICByName(id)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := NICAddress(id, nic)
+	if err != nil {
+		return nil, err
+	}
+
+	return addr.IP, nil
+}
+
+// Addresses returns the address of each NIC that has one, in the order they
+// are attached to the VM. See IP.
+func (q *QEMU) Addresses() ([]core.Address, error) {
+	if !q.Running() {
+		return nil, ErrNotRunning
+	}
+
+	hardware, err := ReadHardware(HardwareFile(q.Config.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []core.Address
+	for i, nic := range hardware.NICs {
+		addr, err := NICAddress(fmt.Sprintf("net%d", i), nic)
+		switch err {
+		case nil:
+			addresses = append(addresses, addr)
+		case ErrIPNotFound:
+			continue
+		default:
+			return nil, err
+		}
+	}
+
+	return addresses, nil
+}
+
+// NICAddress returns the address to use to connect to the NIC with the given
+// netdev ID. Returns ErrIPNotFound if a tap NIC has no lease yet.
+func NICAddress(id string, nic NIC) (core.Address, error) {
+	if nic.Type == "user" {
+		return core.Address{
+			Interface: id,
+			MAC:       nic.MAC,
+			IP:        net.IPv4(127, 0, 0, 1),
+			Network:   "user",
+			Source:    core.SourcePortForward,
+		}, nil
+	}
+
+	mac, err := net.ParseMAC(nic.MAC)
+	if err != nil {
+		return core.Address{}, err
+	}
+
+	leases := nic.Leases
+	if leases == "" {
+		leases = DnsmasqLeasesFile
+	}
+
+	ip, err := FindCurrentLeaseByMAC(leases, mac)
+	if err == ErrLeaseNotFound {
+		return core.Address{}, ErrIPNotFound
+	}
+	if err != nil {
+		return core.Address{}, err
+	}
+
+	return core.Address{
+		Interface: id,
+		MAC:       mac.String(),
+		IP:        ip,
+		Network:   nic.Ifname,
+		Source:    core.SourceDHCP,
+	}, nil
+}
+
+// Mount is not supported yet. QEMU can share folders using virtio-9p or
+// virtiofsd, but both need to be configured before the VM starts.
+func (q *QEMU) Mount() error {
+	return core.ErrNotImplemented
+}
+
+// Configure is not supported. The clone's hardware is in its hardware file
+// (see Hardware), which the user can change while the VM is stopped.
+func (q *QEMU) Configure() error {
+	return core.ErrNotImplemented
+}
+
+// Forward forwards ports to the guest through the first user-mode NIC, the
+// same way as its SSH port. The forwards are on the QEMU command line (see
+// BuildCommand) so they are set up whenever the VM starts. If the VM is
+// already running we add and remove them through the human monitor as well.
+//
+// A tap NIC is reachable from the host, so without a user-mode NIC we return
+// ErrNotImplemented and lovm forward uses its proxy instead.
+func (q *QEMU) Forward() error {
+	if !q.Found() {
+		return nil
+	}
+
+	hardware, err := ReadHardware(HardwareFile(q.Config.Path))
+	if err != nil {
+		return err
+	}
+
+	id, nic, ok := hardware.UserNIC()
+	if !ok {
+		return core.ErrNotImplemented
+	}
+
+	qmp, err := DialQMP(q.SocketPath(), QMPTimeout)
+	if err != nil {
+		// The VM isn't running, so they'll be added when it starts
+		return nil
+	}
+	defer qmp.Close()
+
+	output, err := qmp.HumanMonitorOutput("info usernet")
+	if err != nil {
+		return err
+	}
+	current := ParseHostForwards(output, id)
+
+	wanted := map[int]int{}
+	for _, forward := range q.Config.Forwards {
+		wanted[forward.HostPort] = forward.GuestPort
+	}
+
+	for hostPort, guestPort := range current {
+		if hostPort == nic.SSHPort || wanted[hostPort] == guestPort {
+			continue
+		}
+		command := fmt.Sprintf("hostfwd_remove %s tcp:127.0.0.1:%d", id, hostPort)
+		output, err := qmp.HumanMonitorOutput(command)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(output, "removed") {
+			return fmt.Errorf("qemu %s: %s", command, strings.TrimSpace(output))
+		}
+		delete(current, hostPort)
+	}
+
+	for _, forward := range q.Config.Forwards {
+		if guestPort, ok := current[forward.HostPort]; ok && guestPort == forward.GuestPort {
+			continue
+		}
+		if err := qmp.HumanMonitorCommand(fmt.Sprintf("hostfwd_add %s tcp:127.0.0.1:%d-:%d",
+			id, forward.HostPort, forward.GuestPort)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseHostForwards reads the TCP host forwards for the netdev with the given
+// ID from the output of the info usernet monitor command, and returns them as
+// a map of host ports to guest ports. For example:
+//
+//	Hub -1 (net0):
+//	  Protocol[State]    FD  Source Address  Port   Dest. Address  Port RecvQ SendQ
+//	  TCP[HOST_FORWARD]  13       127.0.0.1 40022       10.0.2.15    22     0     0
+func ParseHostForwards(output, id string) map[int]int {
+	forwards := map[int]int{}
+	section := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, " ") {
+			section = line
+			continue
+		}
+		if !strings.HasSuffix(section, "("+id+"):") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[0] != "TCP[HOST_FORWARD]" {
+			continue
+		}
+		hostPort, err := strconv.Atoi(fields[3])
+		if err != nil {
+			continue
+		}
+		guestPort, err := strconv.Atoi(fields[5])
+		if err != nil {
+			continue
+		}
+		forwards[hostPort] = guestPort
+	}
+
+	return forwards
+}
+
+// CopyToGuest is not supported. QEMU's guest agent can read and write files,
+// but it needs a virtio-serial channel we don't set up yet. Use SSH instead.
+func (q *QEMU) CopyToGuest(hostPath, guestPath string) error {
+	return core.ErrNotImplemented
+}
+
+// CopyFromGuest is not supported. See CopyToGuest.
+func (q *QEMU) CopyFromGuest(guestPath, hostPath string) error {
+	return core.ErrNotImplemented
+}
+
+// Exec is not supported. See CopyToGuest.
+func (q *QEMU) Exec(script string, stdout, stderr io.Writer) (int, error) {
+	return 0, core.ErrNotImplemented
+}
+
+// InstallSSHKey is not supported. See CopyToGuest.
+func (q *QEMU) InstallSSHKey(publicKey string) error {
+	return core.ErrNotImplemented
+}
+
+// Found will check for the presence of the overlay disk image
+func (q *QEMU) Found() bool {
+	if q.Config.Path == "" {
+		return false
+	}
+
+	fi, err := os.Stat(q.Config.Path)
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode().IsRegular()
+}
+
+// State asks QEMU for the VM's run state. If QEMU isn't answering on the
+// control socket, the VM is either stopped or suspended.
+func (q *QEMU) State() (core.State, error) {
+	if !q.Found() {
+		return core.StateNotCloned, nil
+	}
+
+	qmp, err := DialQMP(q.SocketPath(), QMPTimeout)
+	if err != nil {
+		suspended, err := q.Suspended()
+		if err != nil {
+			return core.StateUnknown, err
+		}
+		if suspended {
+			return core.StateSuspended, nil
+		}
+		return core.StateStopped, nil
+	}
+	defer qmp.Close()
+
+	status, err := qmp.Status()
+	if err != nil {
+		return core.StateUnknown, err
+	}
+
+	return ParseState(status), nil
+}
+
+// ParseState translates QEMU's run state into a core.State
+func ParseState(status string) core.State {
+	switch status {
+	case "running":
+		return core.StateRunning
+	case "paused", "debug", "prelaunch", "inmigrate":
+		return core.StatePaused
+	case "suspended":
+		return core.StateSuspended
+	case "shutdown":
+		return core.StateStopped
+	}
+	return core.StateUnknown
+}
+
+// SaveSnapshot saves a snapshot inside the qcow2 image. If the VM is running
+// the snapshot includes its memory and QEMU has to take it, since the disk is
+// locked. Otherwise we use qemu-img.
+func (q *QEMU) SaveSnapshot(name string) error {
+	return q.snapshotCommand("savevm", "-c", name)
+}
+
+// RestoreSnapshot reverts the VM to the snapshot. If the VM is running it
+// keeps running from the snapshot.
+func (q *QEMU) RestoreSnapshot(name string) error {
+	return q.snapshotCommand("loadvm", "-a", name)
+}
+
+func (q *QEMU) DeleteSnapshot(name string) error {
+	return q.snapshotCommand("delvm", "-d", name)
+}
+
+// ListSnapshots reads the snapshots from the qcow2 image. --force-share lets
+// us read the image while QEMU has it open.
+func (q *QEMU) ListSnapshots() ([]string, error) {
+	if !q.Found() {
+		return nil, errors.New("clone a virtual machine first")
+	}
+
+	cmd := exec.Command("qemu-img", "info", "--force-share", "--output=json", q.Config.Path)
+
+	out, err := cmd.Output()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return nil, err
+	}
+
+	return ParseSnapshotList(out)
+}
+
+// snapshotCommand runs the HMP command (e.g. savevm) if QEMU is running, or
+// qemu-img snapshot with the specified flag if it is not.
+func (q *QEMU) snapshotCommand(command, flag, name string) error {
+	if !q.Found() {
+		return errors.New("clone a virtual machine first")
+	}
+
+	if qmp, err := DialQMP(q.SocketPath(), QMPTimeout); err == nil {
+		defer qmp.Close()
+
+		// Saving memory can take a while, so give QEMU more time
+		qmp.conn.SetDeadline(time.Now().Add(2 * time.Minute))
+
+		return qmp.HumanMonitorCommand(fmt.Sprintf("%s %s", command, name))
+	}
+
+	cmd := exec.Command("qemu-img", "snapshot", flag, name, q.Config.Path)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// Running reports whether QEMU is answering on the control socket
+func (q *QEMU) Running() bool {
+	if !q.Found() {
+		return false
+	}
+
+	qmp, err := DialQMP(q.SocketPath(), QMPTimeout)
+	if err != nil {
+		return false
+	}
+	qmp.Close()
+
+	return true
+}
+
+// SocketPath is the QMP control socket, which lives next to the disk image
+func (q *QEMU) SocketPath() string {
+	return filepath.Join(filepath.Dir(q.Config.Path), "qmp.sock")
+}
+
+// PidPath is where QEMU writes its process ID
+func (q *QEMU) PidPath() string {
+	return filepath.Join(filepath.Dir(q.Config.Path), "qemu.pid")
+}
+
+// HardwareFile returns the path to the hardware file for a disk image
+func HardwareFile(disk string) string {
+	return strings.TrimSuffix(disk, filepath.Ext(disk)) + ".json"
+}
+
+// ReadHardware reads a hardware file. See Hardware for the format.
+func ReadHardware(path string) (*Hardware, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hardware := &Hardware{}
+	if err := json.Unmarshal(data, hardware); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+
+	return hardware, nil
+}
+
+// Save writes the hardware file
+func (h *Hardware) Save(path string) error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, byte(10))
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Prepare fills in defaults for a freshly cloned VM. Each NIC gets a random
+// MAC address, and each user-mode NIC gets a free host port to forward to SSH
+// in the guest.
+func (h *Hardware) Prepare() error {
+	if h.CPUs == 0 {
+		h.CPUs = DefaultCPUs
+	}
+	if h.Memory == 0 {
+		h.Memory = DefaultMemory
+	}
+	if len(h.NICs) == 0 {
+		h.NICs = []NIC{{Type: "user"}}
+	}
+
+	for i := range h.NICs {
+		nic := &h.NICs[i]
+		switch nic.Type {
+		case "":
+			nic.Type = "user"
+		case "user", "tap":
+		default:
+			return fmt.Errorf("unsupported NIC type %q; use user or tap", nic.Type)
+		}
+		if nic.Type == "tap" && nic.Ifname == "" {
+			return errors.New("tap NICs require an ifname")
+		}
+
+		// The source's MAC address is not copied, since two VMs with the same
+		// MAC can't share a network.
+		mac, err := RandomMAC()
+		if err != nil {
+			return err
+		}
+		nic.MAC = mac.String()
+
+		if nic.Type == "user" {
+			port, err := FreePort()
+			if err != nil {
+				return err
+			}
+			nic.SSHPort = port
+		}
+	}
+
+	return nil
+}
+
+// FindNICByName finds a NIC by its QEMU netdev ID, e.g. net0
+func (h *Hardware) FindNICByName(name string) (NIC, error) {
+	for i, nic := range h.NICs {
+		if name == fmt.Sprintf("net%d", i) {
+			return nic, nil
+		}
+	}
+	return NIC{}, ErrInterfaceNotFound
+}
+
+// UserNIC returns the netdev ID (e.g. net0) of the first user-mode NIC, and
+// the NIC itself. ok is false if there isn't one.
+func (h *Hardware) UserNIC() (id string, nic NIC, ok bool) {
+	for i, nic := range h.NICs {
+		if nic.Type == "user" {
+			return fmt.Sprintf("net%d", i), nic, true
+		}
+	}
+	return "", NIC{}, false
+}
+
+// BuildCommand builds the QEMU command line. QEMU daemonizes itself once the
+// VM has started, so the command returns quickly. The forwards are added to
+// the first user-mode NIC, along with its SSH port.
+func BuildCommand(disk string, hardware *Hardware, forwards []core.Forward, socket, pidfile string) *exec.Cmd {
+	_, name := filepath.Split(strings.TrimSuffix(disk, filepath.Ext(disk)))
+
+	// Use hardware acceleration if we can, but fall back to emulation
+	accel := "kvm:tcg"
+	if runtime.GOOS == "darwin" {
+		accel = "hvf:tcg"
+	}
+
+	args := []string{
+		"-name", name,
+		"-machine", "accel=" + accel,
+		"-smp", strconv.Itoa(hardware.CPUs),
+		"-m", strconv.Itoa(hardware.Memory),
+		"-drive", fmt.Sprintf("file=%s,if=virtio,format=qcow2", disk),
+	}
+
+	for i, nic := range hardware.NICs {
+		id := fmt.Sprintf("net%d", i)
+		switch nic.Type {
+		case "user":
+			netdev := fmt.Sprintf("user,id=%s,hostfwd=tcp:127.0.0.1:%d-:22", id, nic.SSHPort)
+			if userID, _, _ := hardware.UserNIC(); userID == id {
+				for _, forward := range forwards {
+					netdev += fmt.Sprintf(",hostfwd=tcp:127.0.0.1:%d-:%d",
+						forward.HostPort, forward.GuestPort)
+				}
+			}
+			args = append(args, "-netdev", netdev)
+		case "tap":
+			args = append(args, "-netdev",
+				fmt.Sprintf("tap,id=%s,ifname=%s,script=no,downscript=no", id, nic.Ifname))
+		}
+		args = append(args, "-device",
+			fmt.Sprintf("virtio-net-pci,netdev=%s,mac=%s", id, nic.MAC))
+	}
+
+	args = append(args,
+		"-qmp", fmt.Sprintf("unix:%s,server,nowait", socket),
+		"-pidfile", pidfile,
+		"-display", "none",
+		"-daemonize",
+	)
+
+	return exec.Command(Binary, args...)
+}
+
+// RandomMAC generates a MAC address in QEMU's 52:54:00 prefix
+func RandomMAC() (net.HardwareAddr, error) {
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0, 0, 0}
+	if _, err := rand.Read(mac[3:]); err != nil {
+		return nil, err
+	}
+	return mac, nil
+}
+
+// FreePort asks the OS for a TCP port that is not currently in use
+func FreePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// ParseSnapshotList reads the snapshot names from the output of qemu-img info
+// --output=json. qemu-img lists them in the order they were created.
+func ParseSnapshotList(data []byte) ([]string, error) {
+	info := struct {
+		Snapshots []struct {
+			Name string `json:"name"`
+		} `json:"snapshots"`
+	}{}
+
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, snapshot := range info.Snapshots {
+		names = append(names, snapshot.Name)
+	}
+
+	return names, nil
+}
+
+// FindCurrentLeaseByMAC searches a dnsmasq lease table for an unexpired lease
+// assigned to the specified MAC address, and returns the IP address.
+//
+// If no valid lease can be found, returns ErrLeaseNotFound.
+func FindCurrentLeaseByMAC(path string, addr net.HardwareAddr) (net.IP, error) {
+	// example dnsmasq lease file. The fields are expiry time (unix time, or 0
+	// for infinite leases), MAC address, IP address, hostname, and client ID.
+	//
+	// 1556000000 52:54:00:12:34:56 192.168.122.10 centos 01:52:54:00:12:34:56
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil || mac.String() != addr.String() {
+			continue
+		}
+
+		expires, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || (expires != 0 && expires < now) {
+			continue
+		}
+
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			return nil, fmt.Errorf("failed parsing ip address: %q", fields[2])
+		}
+		return ip, nil
+	}
+
+	return nil, ErrLeaseNotFound
+}
@@ -0,0 +1,495 @@
+package qemu
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+func CompareLists(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for index, word := range a {
+		if word != b[index] {
+			return false
+		}
+	}
+	return true
+}
+
+// FakeQemuImg is a stand-in for qemu-img that creates empty overlays and
+// reports no snapshots
+const FakeQemuImg = `#!/bin/sh
+case "$1" in
+create)
+	for last; do :; done
+	touch "$last" ;;
+info)
+	echo '{}' ;;
+esac
+`
+
+// SetupFakes puts a fake qemu-img on the PATH, creates an empty source image,
+// and changes to a temporary project directory. The returned function reverts
+// everything.
+func SetupFakes(t *testing.T) (string, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake commands require a unix shell")
+	}
+
+	dir, err := ioutil.TempDir("", "lovm-qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin := filepath.Join(dir, "bin")
+	project := filepath.Join(dir, "example")
+	for _, path := range []string{bin, project} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, "qemu-img"), []byte(FakeQemuImg), 0755); err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(dir, "centos.qcow2")
+	if err := ioutil.WriteFile(source, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(project); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+
+	return source, func() {
+		os.Chdir(pwd)
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDeleteAndClone(t *testing.T) {
+	source, cleanup := SetupFakes(t)
+	defer cleanup()
+
+	config := &core.MachineConfig{}
+	vm := New(config)
+
+	// Each clone uses the port its hardware file forwards to SSH
+	for i := 0; i < 2; i++ {
+		if err := vm.Clone(source); err != nil {
+			t.Fatal(err)
+		}
+		hardware, err := ReadHardware(HardwareFile(config.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.SSH.Port == 0 || config.SSH.Port != hardware.NICs[0].SSHPort {
+			t.Errorf("Expected SSH port %d, found %d", hardware.NICs[0].SSHPort, config.SSH.Port)
+		}
+
+		if err := vm.Delete(); err != nil {
+			t.Fatal(err)
+		}
+		if vm.Found() || config.SSH.Port != 0 {
+			t.Errorf("Expected the clone and its port to be gone, found %q and %d", config.Path, config.SSH.Port)
+		}
+	}
+
+	// A port the user set is kept
+	config.SSH.Port = 2200
+	if err := vm.Clone(source); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if config.SSH.Port != 2200 {
+		t.Errorf("Expected port 2200 to be kept, found %d", config.SSH.Port)
+	}
+}
+
+func TestStopStalePidfile(t *testing.T) {
+	source, cleanup := SetupFakes(t)
+	defer cleanup()
+
+	config := &core.MachineConfig{}
+	vm := New(config)
+	if err := vm.Clone(source); err != nil {
+		t.Fatal(err)
+	}
+
+	// The PID now belongs to the test, which Stop must not kill
+	if err := ioutil.WriteFile(vm.PidPath(), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(vm.PidPath()); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale pidfile to be removed, found %v", err)
+	}
+}
+
+func TestIsVMProcess(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a unix shell")
+	}
+
+	disk := "/project/.lovm/example/example.qcow2"
+	cmd := exec.Command("sh", "-c", "sleep 10; exit 0", Binary, "-drive", "file="+disk+",if=virtio,format=qcow2")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	// Start can return before the new command line shows up in /proc
+	found := IsVMProcess(cmd.Process.Pid, disk)
+	for i := 0; i < 100 && !found; i++ {
+		time.Sleep(10 * time.Millisecond)
+		found = IsVMProcess(cmd.Process.Pid, disk)
+	}
+	if !found {
+		t.Error("Expected the process to be recognized")
+	}
+	if IsVMProcess(cmd.Process.Pid, "/other/.lovm/other/other.qcow2") {
+		t.Error("Expected a different disk not to match")
+	}
+	if IsVMProcess(os.Getpid(), disk) {
+		t.Error("Expected the test process not to match")
+	}
+}
+
+func TestNotListening(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lovm-qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "qmp.sock")
+	if _, err := DialQMP(path, time.Second); !NotListening(err) {
+		t.Errorf("Expected a missing socket not to be listening, found %v", err)
+	}
+
+	// A socket left behind after QEMU exits
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if _, err := DialQMP(path, time.Second); !NotListening(err) {
+		t.Errorf("Expected a stale socket not to be listening, found %v", err)
+	}
+
+	// A server that never answers may just be hung
+	os.Remove(path)
+	listener, err = net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if _, err := DialQMP(path, 100*time.Millisecond); err == nil || NotListening(err) {
+		t.Errorf("Expected a timeout, found %v", err)
+	}
+}
+
+func TestHardwareFile(t *testing.T) {
+	expected := filepath.Join("path", "to", "centos.json")
+	if output := HardwareFile(filepath.Join("path", "to", "centos.qcow2")); output != expected {
+		t.Errorf("Expected %q, found %q", expected, output)
+	}
+}
+
+func TestReadHardware(t *testing.T) {
+	hardware, err := ReadHardware(filepath.Join("test-fixtures", "centos.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hardware.CPUs != 2 || hardware.Memory != 2048 || len(hardware.NICs) != 2 {
+		t.Fatalf("Unexpected hardware %#v", hardware)
+	}
+
+	if err := hardware.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	user := hardware.NICs[0]
+	if user.SSHPort == 0 {
+		t.Error("Expected user NIC to be assigned an SSH port")
+	}
+	if !strings.HasPrefix(user.MAC, "52:54:00:") {
+		t.Errorf("Expected MAC in QEMU's prefix, found %q", user.MAC)
+	}
+
+	tap, err := hardware.FindNICByName("net1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tap.Ifname != "tap0" || tap.SSHPort != 0 {
+		t.Errorf("Unexpected tap NIC %#v", tap)
+	}
+
+	if _, err := hardware.FindNICByName("net2"); err != ErrInterfaceNotFound {
+		t.Errorf("Expected %s, found %s", ErrInterfaceNotFound, err)
+	}
+}
+
+func TestPrepareDefaults(t *testing.T) {
+	hardware := &Hardware{}
+	if err := hardware.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	if hardware.CPUs != DefaultCPUs || hardware.Memory != DefaultMemory {
+		t.Errorf("Expected default CPUs and memory, found %#v", hardware)
+	}
+	if len(hardware.NICs) != 1 || hardware.NICs[0].Type != "user" {
+		t.Errorf("Expected one user NIC, found %#v", hardware.NICs)
+	}
+
+	hardware = &Hardware{NICs: []NIC{{Type: "tap"}}}
+	if err := hardware.Prepare(); err == nil {
+		t.Error("Expected an error for a tap NIC without an ifname")
+	}
+}
+
+func TestBuildCommand(t *testing.T) {
+	hardware := &Hardware{
+		CPUs:   2,
+		Memory: 2048,
+		NICs: []NIC{
+			{Type: "user", MAC: "52:54:00:12:34:56", SSHPort: 40022},
+			{Type: "tap", MAC: "52:54:00:ab:cd:ef", Ifname: "tap0"},
+		},
+	}
+
+	forwards := []core.Forward{{HostPort: 8080, GuestPort: 80}, {HostPort: 5433, GuestPort: 5432}}
+
+	cmd := BuildCommand("/lovm/example/example.qcow2", hardware, forwards,
+		"/lovm/example/qmp.sock", "/lovm/example/qemu.pid")
+
+	expected := []string{
+		"-smp", "2",
+		"-m", "2048",
+		"-drive", "file=/lovm/example/example.qcow2,if=virtio,format=qcow2",
+		"-netdev", "user,id=net0,hostfwd=tcp:127.0.0.1:40022-:22" +
+			",hostfwd=tcp:127.0.0.1:8080-:80,hostfwd=tcp:127.0.0.1:5433-:5432",
+		"-device", "virtio-net-pci,netdev=net0,mac=52:54:00:12:34:56",
+		"-netdev", "tap,id=net1,ifname=tap0,script=no,downscript=no",
+		"-device", "virtio-net-pci,netdev=net1,mac=52:54:00:ab:cd:ef",
+		"-qmp", "unix:/lovm/example/qmp.sock,server,nowait",
+		"-pidfile", "/lovm/example/qemu.pid",
+		"-display", "none",
+		"-daemonize",
+	}
+
+	// Skip the binary, name, and accelerator, which depend on the host
+	args := cmd.Args[5:]
+	if cmd.Args[0] != Binary || cmd.Args[2] != "example" || !CompareLists(args, expected) {
+		t.Errorf("Expected %v, found %v", expected, cmd.Args)
+	}
+}
+
+func TestParseHostForwards(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("test-fixtures", "info-usernet.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwards := ParseHostForwards(string(data), "net0")
+	if len(forwards) != 2 || forwards[40022] != 22 || forwards[8080] != 80 {
+		t.Errorf("Unexpected forwards for net0: %v", forwards)
+	}
+
+	forwards = ParseHostForwards(string(data), "net2")
+	if len(forwards) != 1 || forwards[40023] != 22 {
+		t.Errorf("Unexpected forwards for net2: %v", forwards)
+	}
+
+	if forwards := ParseHostForwards(string(data), "net1"); len(forwards) != 0 {
+		t.Errorf("Expected no forwards for net1, found %v", forwards)
+	}
+}
+
+func TestFindCurrentLeaseByMAC(t *testing.T) {
+	path := filepath.Join("test-fixtures", "dnsmasq.leases")
+
+	cases := map[string]string{
+		// Infinite lease
+		"52:54:00:12:34:56": "192.168.122.10",
+		"52:54:00:ab:cd:ef": "192.168.122.20",
+	}
+
+	for input, expected := range cases {
+		mac, err := net.ParseMAC(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, err := FindCurrentLeaseByMAC(path, mac)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if ip.String() != expected {
+			t.Errorf("Expected %s, found %s", expected, ip)
+		}
+	}
+
+	// This MAC address has a lease but it has expired
+	mac, err := net.ParseMAC("52:54:00:6b:3c:58")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindCurrentLeaseByMAC(path, mac); err != ErrLeaseNotFound {
+		t.Errorf("Expected %s, found %s", ErrLeaseNotFound, err)
+	}
+}
+
+// FakeQMPServer listens on a unix socket and answers a QMP session the way
+// QEMU would, recording each command it receives.
+func FakeQMPServer(t *testing.T, path string, commands chan<- string) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer listener.Close()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte(`{"QMP": {"version": {"qemu": {"micro": 0, "minor": 1, "major": 4}}, "capabilities": []}}` + "\n"))
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			line := scanner.Text()
+			commands <- line
+			switch {
+			case strings.Contains(line, "query-status"):
+				conn.Write([]byte(`{"timestamp": {"seconds": 1555914291, "microseconds": 0}, "event": "RESUME"}` + "\n"))
+				conn.Write([]byte(`{"return": {"status": "paused", "singlestep": false, "running": false}}` + "\n"))
+			case strings.Contains(line, "loadvm"):
+				conn.Write([]byte(`{"return": "Error: Snapshot 'missing' does not exist\r\n"}` + "\n"))
+			case strings.Contains(line, "human-monitor-command"):
+				conn.Write([]byte(`{"return": ""}` + "\n"))
+			case strings.Contains(line, "bogus"):
+				conn.Write([]byte(`{"error": {"class": "CommandNotFound", "desc": "The command bogus has not been found"}}` + "\n"))
+			default:
+				conn.Write([]byte(`{"return": {}}` + "\n"))
+			}
+		}
+	}()
+}
+
+func TestQMP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lovm-qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "qmp.sock")
+	commands := make(chan string, 10)
+	FakeQMPServer(t, path, commands)
+
+	qmp, err := DialQMP(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qmp.Close()
+
+	status, err := qmp.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "paused" {
+		t.Errorf("Expected paused, found %q", status)
+	}
+
+	if _, err := qmp.Execute("bogus", nil); err == nil {
+		t.Error("Expected an error for an unknown command")
+	}
+
+	if err := qmp.HumanMonitorCommand("savevm before-deploy"); err != nil {
+		t.Error(err)
+	}
+
+	if err := qmp.HumanMonitorCommand("loadvm missing"); err == nil {
+		t.Error("Expected an error for a missing snapshot")
+	}
+
+	if _, err := qmp.Execute("quit", nil); err != nil {
+		t.Error(err)
+	}
+
+	expected := []string{
+		`{"execute":"qmp_capabilities"}`,
+		`{"execute":"query-status"}`,
+		`{"execute":"bogus"}`,
+		`{"execute":"human-monitor-command","arguments":{"command-line":"savevm before-deploy"}}`,
+		`{"execute":"human-monitor-command","arguments":{"command-line":"loadvm missing"}}`,
+		`{"execute":"quit"}`,
+	}
+	for _, command := range expected {
+		if received := <-commands; received != command {
+			t.Errorf("Expected %s, found %s", command, received)
+		}
+	}
+}
+
+func TestParseState(t *testing.T) {
+	cases := map[string]core.State{
+		"running":        core.StateRunning,
+		"paused":         core.StatePaused,
+		"suspended":      core.StateSuspended,
+		"shutdown":       core.StateStopped,
+		"guest-panicked": core.StateUnknown,
+	}
+
+	for input, expected := range cases {
+		if output := ParseState(input); output != expected {
+			t.Errorf("Expected %s for %q, found %s", expected, input, output)
+		}
+	}
+}
+
+func TestParseSnapshotList(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("test-fixtures", "qemu-img-info.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := ParseSnapshotList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"before-deploy", "after-deploy"}
+	if !CompareLists(names, expected) {
+		t.Errorf("Expected %#v, found %#v", expected, names)
+	}
+}
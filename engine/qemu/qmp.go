@@ -0,0 +1,163 @@
+package qemu
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// QMP is a minimal client for the QEMU Machine Protocol. QEMU listens on a
+// unix socket and speaks line-delimited JSON. After connecting, the server
+// sends a greeting and we have to negotiate capabilities before we can send
+// any other commands.
+//
+// See https://wiki.qemu.org/Documentation/QMP
+type QMP struct {
+	conn    net.Conn
+	decoder *json.Decoder
+}
+
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class       string `json:"class"`
+		Description string `json:"desc"`
+	} `json:"error"`
+	Event string `json:"event"`
+}
+
+// NotListening returns true if DialQMP failed because there is no socket, or
+// nothing is listening on it, which means QEMU isn't running. Other errors,
+// such as a timeout, may mean QEMU is running but hung.
+func NotListening(err error) bool {
+	return errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// DialQMP connects to the QMP socket at path. All communication on the
+// connection must complete before the timeout expires.
+func DialQMP(path string, timeout time.Duration) (*QMP, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	q := &QMP{
+		conn:    conn,
+		decoder: json.NewDecoder(bufio.NewReader(conn)),
+	}
+
+	// Read the greeting, e.g. {"QMP": {"version": {...}, "capabilities": []}}
+	greeting := map[string]json.RawMessage{}
+	if err := q.decoder.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, ok := greeting["QMP"]; !ok {
+		conn.Close()
+		return nil, errors.New("unexpected greeting from QMP server")
+	}
+
+	if _, err := q.Execute("qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Execute runs a QMP command and returns the raw value of the response.
+// Asynchronous events that arrive while we wait for the response are ignored.
+func (q *QMP) Execute(command string, arguments interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(qmpCommand{Execute: command, Arguments: arguments})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := q.conn.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+
+	for {
+		response := qmpResponse{}
+		if err := q.decoder.Decode(&response); err != nil {
+			return nil, err
+		}
+		if response.Event != "" {
+			continue
+		}
+		if response.Error != nil {
+			return nil, fmt.Errorf("qmp %s: %s", command, response.Error.Description)
+		}
+		return response.Return, nil
+	}
+}
+
+// Status returns the run state of the VM, e.g. running, paused, or suspended
+func (q *QMP) Status() (string, error) {
+	data, err := q.Execute("query-status", nil)
+	if err != nil {
+		return "", err
+	}
+
+	status := struct {
+		Status string `json:"status"`
+	}{}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return "", err
+	}
+
+	return status.Status, nil
+}
+
+// HumanMonitorCommand runs a command in QEMU's human monitor. Some features,
+// like internal snapshots, are only available there. HMP reports errors as
+// text, so any output is treated as an error.
+func (q *QMP) HumanMonitorCommand(command string) error {
+	output, err := q.HumanMonitorOutput(command)
+	if err != nil {
+		return err
+	}
+
+	if output = strings.TrimSpace(output); output != "" {
+		return fmt.Errorf("qemu %s: %s", command, output)
+	}
+
+	return nil
+}
+
+func (q *QMP) Close() error {
+	return q.conn.Close()
+}
+
+// HumanMonitorOutput runs a command in QEMU's human monitor and returns its
+// output, for commands like info that are expected to print something.
+func (q *QMP) HumanMonitorOutput(command string) (string, error) {
+	data, err := q.Execute("human-monitor-command", map[string]string{
+		"command-line": command,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	output := ""
+	if err := json.Unmarshal(data, &output); err != nil {
+		return "", err
+	}
+
+	return output, nil
+}
@@ -2,6 +2,7 @@ package unknown
 
 import (
 	"errors"
+	"io"
 	"net"
 
 	"github.com/cbednarski/lovm/core"
@@ -23,7 +24,7 @@ func (u *Unknown) Type() string {
 
 func (u *Unknown) Clone(source string) error {
 	if source != "" {
-		return errors.New("unrecognized virtualization format; specify a path to .vmx or .vbox")
+		return errors.New("unrecognized virtualization format; specify a path to .vmx, .vbox, .qcow2, or .xml")
 	}
 	return ErrNoConfiguration
 }
@@ -36,6 +37,14 @@ func (u *Unknown) Stop() error {
 	return ErrNoConfiguration
 }
 
+func (u *Unknown) Suspend() error {
+	return ErrNoConfiguration
+}
+
+func (u *Unknown) Resume() error {
+	return ErrNoConfiguration
+}
+
 func (u *Unknown) Restart() error {
 	return ErrNoConfiguration
 }
@@ -48,10 +57,58 @@ func (u *Unknown) IP() (net.IP, error) {
 	return nil, ErrNoConfiguration
 }
 
+func (u *Unknown) Addresses() ([]core.Address, error) {
+	return nil, ErrNoConfiguration
+}
+
 func (u *Unknown) Mount() error {
 	return ErrNoConfiguration
 }
 
+func (u *Unknown) Forward() error {
+	return ErrNoConfiguration
+}
+
+func (u *Unknown) Configure() error {
+	return ErrNoConfiguration
+}
+
 func (u *Unknown) Found() bool {
 	return false
 }
+
+func (u *Unknown) State() (core.State, error) {
+	return core.StateNotCloned, nil
+}
+
+func (u *Unknown) SaveSnapshot(name string) error {
+	return ErrNoConfiguration
+}
+
+func (u *Unknown) RestoreSnapshot(name string) error {
+	return ErrNoConfiguration
+}
+
+func (u *Unknown) ListSnapshots() ([]string, error) {
+	return nil, ErrNoConfiguration
+}
+
+func (u *Unknown) DeleteSnapshot(name string) error {
+	return ErrNoConfiguration
+}
+
+func (u *Unknown) CopyToGuest(hostPath, guestPath string) error {
+	return ErrNoConfiguration
+}
+
+func (u *Unknown) CopyFromGuest(guestPath, hostPath string) error {
+	return ErrNoConfiguration
+}
+
+func (u *Unknown) Exec(script string, stdout, stderr io.Writer) (int, error) {
+	return 0, ErrNoConfiguration
+}
+
+func (u *Unknown) InstallSSHKey(publicKey string) error {
+	return ErrNoConfiguration
+}
@@ -0,0 +1,6 @@
+package virtualbox
+
+const (
+	// ConfigDir is relative to the user's home directory
+	ConfigDir = ".config/VirtualBox"
+)
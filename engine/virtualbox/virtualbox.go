@@ -1,21 +1,67 @@
 package virtualbox
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/hex"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cbednarski/lovm/core"
 )
 
+// Note: See paths* for platform-specific constants
 const (
 	Identifier   = "virtualbox"
 	SnapshotName = `lovm-clone`
+
+	// DHCPLeasesFile is the name of the lease table VirtualBox keeps for each
+	// host-only network, parameterized with the name of the host-only adapter
+	// (e.g. vboxnet0). It lives in ConfigDir.
+	DHCPLeasesFile = "HostInterfaceNetworking-%s-Dhcpd.leases"
+
+	// MaxNICs is the number of network adapters a VirtualBox VM can have
+	MaxNICs = 8
+
+	// DefaultHostOnlyAdapter is the host-only network we attach adapters to
+	// when MachineConfig.Networks doesn't name one
+	DefaultHostOnlyAdapter = "vboxnet0"
+
+	// GuestAdditionsTimeout is how long Start will wait for the guest
+	// additions to come up before it gives up on mounting shared folders.
+	GuestAdditionsTimeout = 2 * time.Minute
+)
+
+var (
+	ErrInterfaceNotFound = errors.New("no interface found")
+	ErrLeaseNotFound     = errors.New("no active lease found")
+	ErrIPNotFound        = errors.New("no IP address found; lovm ip " +
+		"requires a host-only network (see docs/virtualbox.md)")
+	ErrGuestAdditionsNotRunning = errors.New("the VirtualBox guest " +
+		"additions are not running in the guest")
+	ErrNoGuestLogin = errors.New("guest operations require a login and " +
+		"password; set guest-config in " + core.MachineFile)
+	reMachineReadable = regexp.MustCompile(`^"?([^"=]+)"?="?(.*?)"?$`)
+	reNICIndex        = regexp.MustCompile(`^nic(\d+)$`)
+	// VirtualBox 5 and 6 print guest properties in the first form, and
+	// VirtualBox 7 prints them in the second form.
+	reGuestPropertyOld = regexp.MustCompile(`^Name: ([^,]+), value: ([^,]*),`)
+	reGuestPropertyNew = regexp.MustCompile(`^(\S+) = '(.*)'`)
+	reGuestNetMAC      = regexp.MustCompile(`^/VirtualBox/GuestInfo/Net/(\d+)/MAC$`)
+	reSharedFolderName = regexp.MustCompile(`^SharedFolderName(Machine|Transient)Mapping(\d+)$`)
+	reNATForwarding    = regexp.MustCompile(`^Forwarding\(\d+\)$`)
 )
 
 type VirtualBox struct {
@@ -128,19 +174,52 @@ func (v *VirtualBox) Start() error {
 		return err
 	}
 
-	// TODO VirtualBox barfs if we try to start a VM that is already running so
-	//  we'll need to detect that case and no-op instead.
+	// VirtualBox barfs if we try to start a VM that is already running, so
+	// we'll check first. A paused VM needs to be resumed instead. A suspended
+	// ("saved") VM is restored by startvm.
+	state, err := v.State()
+	if err != nil {
+		return err
+	}
 
-	cmd := exec.Command("vboxmanage",
-		"startvm", v.Config.Path, "--type", "headless")
+	// VirtualBox can only change the hardware while the VM is powered off
+	if state == core.StateStopped {
+		if err := v.Configure(); err != nil {
+			return err
+		}
+	}
 
-	out, err := cmd.CombinedOutput()
+	var args []string
+	switch state {
+	case core.StateRunning:
+	case core.StatePaused:
+		args = []string{"controlvm", v.Config.Path, "resume"}
+	default:
+		args = []string{"startvm", v.Config.Path, "--type", "headless"}
+	}
 
-	if err != nil {
-		core.CommandError(cmd, out)
+	if args != nil {
+		cmd := exec.Command("vboxmanage", args...)
+
+		out, err := cmd.CombinedOutput()
+
+		if err != nil {
+			core.CommandError(cmd, out)
+			return err
+		}
 	}
 
-	return err
+	// Shared folders we add while the VM is running are transient, so they
+	// need to be added again each time the VM starts. Mounting them in the
+	// guest requires the guest additions, which take a while to start.
+	if len(v.Config.Mounts) > 0 {
+		if err := v.WaitForGuestAdditions(GuestAdditionsTimeout); err != nil {
+			return err
+		}
+		return v.Mount()
+	}
+
+	return nil
 }
 
 func (v *VirtualBox) Stop() error {
@@ -155,9 +234,11 @@ func (v *VirtualBox) Stop() error {
 	out, err := cmd.CombinedOutput()
 
 	if err != nil {
-		// If the error message says the VM is already turned off, we're done
+		// If the error message says the VM is already turned off, we're
+		// almost done. If it's suspended, stopping it means throwing away the
+		// saved memory.
 		if bytes.Contains(out, []byte(`is not currently running`)) {
-			return nil
+			return v.discardState()
 		}
 
 		core.CommandError(cmd, out)
@@ -166,6 +247,65 @@ func (v *VirtualBox) Stop() error {
 	return err
 }
 
+// discardState throws away the saved memory of a suspended VM
+func (v *VirtualBox) discardState() error {
+	state, err := v.State()
+	if err != nil || state != core.StateSuspended {
+		return err
+	}
+
+	cmd := exec.Command("vboxmanage", "discardstate", v.Config.Path)
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// Suspend saves the VM's memory to disk and stops it. If the VM is not running
+// it reports success.
+func (v *VirtualBox) Suspend() error {
+	state, err := v.State()
+	if err != nil {
+		return err
+	}
+	if state != core.StateRunning && state != core.StatePaused {
+		return nil
+	}
+
+	cmd := exec.Command("vboxmanage",
+		"controlvm", v.Config.Path, "savestate")
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// Resume restores a suspended VM or unpauses a paused one. Start handles both
+// of these, so we just make sure we're not booting a stopped VM.
+func (v *VirtualBox) Resume() error {
+	state, err := v.State()
+	if err != nil {
+		return err
+	}
+
+	switch state {
+	case core.StateRunning:
+		return nil
+	case core.StatePaused, core.StateSuspended:
+		return v.Start()
+	}
+
+	return core.ErrNotSuspended
+}
+
 func (v *VirtualBox) Restart() error {
 	if err := v.Stop(); err != nil {
 		return err
@@ -198,17 +338,689 @@ func (v *VirtualBox) Delete() error {
 	// Remove the machine path because we don't have a VM anymore
 	if err == nil {
 		v.Config.Path = ""
+		err = core.ClearKnownHosts()
 	}
 
 	return err
 }
 
+// IP returns the IP address of the first network interface that can accept
+// inbound connections. VirtualBox's default NAT adapter is outbound-only so it
+// is skipped (see docs/virtualbox.md).
+//
+// If SSHConfig.NetworkInterface is set (e.g. "nic2") only that adapter will be
+// considered.
 func (v *VirtualBox) IP() (net.IP, error) {
-	return nil, core.ErrNotImplemented
+	info, err := VMInfo(v.Config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	nics := ReadNICs(info)
+
+	if v.Config.SSH.NetworkInterface != "" {
+		nic, err := FindNICByName(nics, v.Config.SSH.NetworkInterface)
+		if err != nil {
+			return nil, err
+		}
+		nics = []NIC{nic}
+	}
+
+	addresses, err := v.nicAddresses(nics)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addresses {
+		if addr.Network != "nat" {
+			return addr.IP, nil
+		}
+	}
+
+	return nil, ErrIPNotFound
+}
+
+// Addresses returns the IP address of each of the VM's network adapters, in
+// adapter order, including NAT adapters.
+//
+// We ask the guest additions first, since they report the address the guest
+// OS is actually using. If the guest additions are not installed or have not
+// reported anything yet, we fall back to the DHCP lease tables for host-only
+// networks. In both cases we match on the MAC addresses reported by showvminfo
+// so we know which address belongs to which adapter.
+func (v *VirtualBox) Addresses() ([]core.Address, error) {
+	info, err := VMInfo(v.Config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.nicAddresses(ReadNICs(info))
+}
+
+func (v *VirtualBox) nicAddresses(nics []NIC) ([]core.Address, error) {
+	// Without the guest additions there may be no guest properties to read,
+	// which is exactly when we need the lease table, so carry on without them
+	var guestIPs map[string]net.IP
+	if properties, err := GuestProperties(v.Config.Path); err == nil {
+		guestIPs = GuestIPsByMAC(properties)
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	leasesFile := filepath.Join(home, ConfigDir, DHCPLeasesFile)
+
+	var addresses []core.Address
+	for _, nic := range nics {
+		addr := core.Address{
+			Interface: nic.Name,
+			MAC:       nic.MAC.String(),
+			Network:   nic.Type,
+		}
+
+		if ip, ok := guestIPs[nic.MAC.String()]; ok {
+			addr.IP = ip
+			addr.Source = core.SourceGuestTools
+			addresses = append(addresses, addr)
+			continue
+		}
+
+		if nic.HostOnlyAdapter == "" {
+			continue
+		}
+		ip, err := FindCurrentLeaseByMAC(leasesFile, nic.HostOnlyAdapter, nic.MAC)
+		switch {
+		case err == nil:
+			addr.IP = ip
+			addr.Source = core.SourceDHCP
+			addresses = append(addresses, addr)
+		case err == ErrLeaseNotFound, os.IsNotExist(err):
+			// The DHCP server may not have handed out a lease yet, or it may
+			// not be enabled for this network. Try the next one.
+			continue
+		default:
+			return nil, err
+		}
+	}
+
+	return addresses, nil
 }
 
+// Mount reconciles the VM's shared folders with MachineConfig.Mounts and then
+// mounts them in the guest. Shared folders that already exist with the right
+// host path are left alone, so this is safe to call repeatedly.
+//
+// VirtualBox has two kinds of shared folders: permanent ones, which can only
+// be added while the VM is stopped, and transient ones, which can only be
+// added while it is running and disappear when it stops. We add whichever kind
+// we can right now. If the VM is stopped the guest side of the mount happens
+// the next time it is started.
+//
+// Mounting in the guest is done with guestcontrol, which requires the guest
+// additions and the login and password configured in GuestConfig.
 func (v *VirtualBox) Mount() error {
-	return core.ErrNotImplemented
+	if len(v.Config.Mounts) == 0 || !v.Found() {
+		return nil
+	}
+
+	info, err := VMInfo(v.Config.Path)
+	if err != nil {
+		return err
+	}
+
+	running := info["VMState"] == "running"
+	shares := ReadSharedFolders(info)
+
+	for hostPath, guestPath := range v.Config.Mounts {
+		name := core.ShareName(guestPath)
+
+		share, ok := shares[name]
+		if ok && share.HostPath != hostPath {
+			// The user changed the host path, so we need to remove the old
+			// share before we can add a new one with the same name.
+			args := []string{"sharedfolder", "remove", v.Config.Path, "--name", name}
+			if share.Transient {
+				args = append(args, "--transient")
+			}
+			cmd := exec.Command("vboxmanage", args...)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				core.CommandError(cmd, out)
+				return err
+			}
+			ok = false
+		}
+
+		if !ok {
+			args := []string{"sharedfolder", "add", v.Config.Path, "--name",
+				name, "--hostpath", hostPath}
+			if running {
+				args = append(args, "--transient")
+			}
+			cmd := exec.Command("vboxmanage", args...)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				core.CommandError(cmd, out)
+				return err
+			}
+		}
+
+		if running {
+			if err := v.MountInGuest(name, guestPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Configure runs vboxmanage modifyvm to make the VM's hardware match
+// MachineConfig's CPUs, Memory and Networks (see ModifyVMArgs). It only runs
+// if something needs to change.
+func (v *VirtualBox) Configure() error {
+	if !v.Found() || !v.Config.HasHardware() {
+		return nil
+	}
+
+	info, err := VMInfo(v.Config.Path)
+	if err != nil {
+		return err
+	}
+
+	args, err := ModifyVMArgs(info, v.Config)
+	if err != nil || len(args) == 0 {
+		return err
+	}
+	if ParseState(info["VMState"]) != core.StateStopped {
+		return core.ErrNotStopped
+	}
+
+	cmd := exec.Command("vboxmanage", append([]string{"modifyvm", v.Config.Path}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return err
+	}
+
+	return nil
+}
+
+// ModifyVMArgs returns the vboxmanage modifyvm options that would make the
+// hardware in showvminfo output match the config's CPUs, Memory and Networks,
+// or nothing if it already does. Networks are attached to the adapters in
+// order, starting with nic1, and any adapters past the end of the list are
+// detached. For example:
+//
+//	--memory 8192 --nic2 hostonly --hostonlyadapter2 vboxnet0 --nic3 none
+//
+// A host-only network's name is the host-only adapter, and defaults to
+// DefaultHostOnlyAdapter. A bridged network's name is the host interface, and
+// is required. VirtualBox has one NAT network per adapter, so NAT networks
+// don't have a name.
+func ModifyVMArgs(info map[string]string, config *core.MachineConfig) ([]string, error) {
+	var args []string
+
+	if config.CPUs > 0 && info["cpus"] != strconv.Itoa(config.CPUs) {
+		args = append(args, "--cpus", strconv.Itoa(config.CPUs))
+	}
+
+	memory, err := config.MemoryMB()
+	if err != nil {
+		return nil, err
+	}
+	if memory > 0 && info["memory"] != strconv.Itoa(memory) {
+		args = append(args, "--memory", strconv.Itoa(memory))
+	}
+
+	if len(config.Networks) == 0 {
+		return args, nil
+	}
+	if len(config.Networks) > MaxNICs {
+		return nil, fmt.Errorf("VirtualBox supports up to %d network adapters, found %d networks", MaxNICs, len(config.Networks))
+	}
+
+	for i, network := range config.Networks {
+		index := i + 1
+		current := info[fmt.Sprintf("nic%d", index)]
+		nic := fmt.Sprintf("--nic%d", index)
+
+		switch network.Type {
+		case core.NetworkNAT:
+			if network.Name != "" {
+				return nil, fmt.Errorf("VirtualBox NAT networks don't have a name, found %q", network)
+			}
+			if current != "nat" {
+				args = append(args, nic, "nat")
+			}
+		case core.NetworkHostOnly:
+			name := network.Name
+			if name == "" {
+				name = DefaultHostOnlyAdapter
+			}
+			if current != "hostonly" || info[fmt.Sprintf("hostonlyadapter%d", index)] != name {
+				args = append(args, nic, "hostonly", fmt.Sprintf("--hostonlyadapter%d", index), name)
+			}
+		case core.NetworkBridged:
+			if network.Name == "" {
+				return nil, errors.New("VirtualBox bridged networks need the name of a host interface, e.g. bridged:en0")
+			}
+			// VirtualBox may show the interface's description after its
+			// name, e.g. "en0: Wi-Fi"
+			adapter := info[fmt.Sprintf("bridgeadapter%d", index)]
+			if current != "bridged" || (adapter != network.Name && !strings.HasPrefix(adapter, network.Name+":")) {
+				args = append(args, nic, "bridged", fmt.Sprintf("--bridgeadapter%d", index), network.Name)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported network type %q", network.Type)
+		}
+	}
+
+	for index := len(config.Networks) + 1; index <= MaxNICs; index++ {
+		if current := info[fmt.Sprintf("nic%d", index)]; current != "" && current != "none" {
+			args = append(args, fmt.Sprintf("--nic%d", index), "none")
+		}
+	}
+
+	return args, nil
+}
+
+// Forward adds a port forwarding rule to the VM's NAT adapter for each of
+// MachineConfig.Forwards, and removes rules we added before that are no longer
+// listed. Our rules are named lovm-<host port>, so rules added some other way
+// (e.g. in the VirtualBox UI) are left alone.
+//
+// Rules can be changed with controlvm while the VM is running and modifyvm
+// while it is stopped. Either way VirtualBox saves them with the VM. If the VM
+// has no NAT adapter we return ErrNotImplemented.
+func (v *VirtualBox) Forward() error {
+	if !v.Found() {
+		return nil
+	}
+
+	info, err := VMInfo(v.Config.Path)
+	if err != nil {
+		return err
+	}
+
+	adapter := ""
+	for _, nic := range ReadNICs(info) {
+		if nic.Type == "nat" {
+			adapter = strings.TrimPrefix(nic.Name, "nic")
+			break
+		}
+	}
+	if adapter == "" {
+		return core.ErrNotImplemented
+	}
+
+	running := info["VMState"] == "running"
+
+	wanted := map[string]NATRule{}
+	for _, forward := range v.Config.Forwards {
+		rule := ForwardRule(forward)
+		wanted[rule.Name] = rule
+	}
+
+	for name, rule := range ReadNATRules(info) {
+		if !strings.HasPrefix(name, ForwardRulePrefix) {
+			continue
+		}
+		if want, ok := wanted[name]; ok && want == rule {
+			delete(wanted, name)
+			continue
+		}
+		if err := v.natpf(adapter, running, "delete", name); err != nil {
+			return err
+		}
+	}
+
+	for _, forward := range v.Config.Forwards {
+		rule := ForwardRule(forward)
+		if _, ok := wanted[rule.Name]; !ok {
+			continue
+		}
+		if err := v.natpf(adapter, running, rule.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// natpf adds or deletes a NAT port forwarding rule, using controlvm if the VM
+// is running or modifyvm if it is not
+func (v *VirtualBox) natpf(adapter string, running bool, rule ...string) error {
+	args := append([]string{"modifyvm", v.Config.Path, "--natpf" + adapter}, rule...)
+	if running {
+		args = append([]string{"controlvm", v.Config.Path, "natpf" + adapter}, rule...)
+	}
+
+	cmd := exec.Command("vboxmanage", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return err
+	}
+
+	return nil
+}
+
+// MountInGuest creates the mount point in the guest and mounts the named
+// shared folder there, unless something is already mounted at that path.
+func (v *VirtualBox) MountInGuest(name, guestPath string) error {
+	cmd, cleanup, err := v.GuestControl("mkdir", "--parents", guestPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return err
+	}
+
+	script := fmt.Sprintf(`mountpoint -q %[2]s || mount -t vboxsf %[1]s %[2]s`,
+		core.ShellQuote(name), core.ShellQuote(guestPath))
+
+	cmd, cleanupRun, err := v.GuestControl("run", "--exe", "/bin/sh", "--", "/bin/sh", "-c", script)
+	if err != nil {
+		return err
+	}
+	defer cleanupRun()
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return fmt.Errorf("failed to mount %q in the guest at %q; the "+
+			"guest login must be allowed to mount filesystems", name, guestPath)
+	}
+
+	return nil
+}
+
+// GuestControl builds a vboxmanage guestcontrol command that authenticates
+// with the guest OS. The password is passed in a temporary file that only the
+// current user can read, rather than on the command line where other users
+// could see it with ps. Call cleanup once the command has finished to remove
+// the file.
+func (v *VirtualBox) GuestControl(args ...string) (cmd *exec.Cmd, cleanup func(), err error) {
+	login := v.Config.GuestLogin()
+	if login == "" || v.Config.Guest.Password == "" {
+		return nil, nil, ErrNoGuestLogin
+	}
+
+	// TempFile creates the file with mode 0600
+	file, err := ioutil.TempFile("", "lovm-password")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup = func() { os.Remove(file.Name()) }
+
+	if _, err := file.WriteString(v.Config.Guest.Password); err != nil {
+		file.Close()
+		cleanup()
+		return nil, nil, err
+	}
+	if err := file.Close(); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	args = append([]string{"guestcontrol", v.Config.Path,
+		"--username", login, "--passwordfile", file.Name()}, args...)
+
+	return exec.Command("vboxmanage", args...), cleanup, nil
+}
+
+// checkGuestAdditions returns an error if the guest additions are not running
+func (v *VirtualBox) checkGuestAdditions() error {
+	if !v.Found() {
+		return errors.New("clone a virtual machine first")
+	}
+
+	info, err := VMInfo(v.Config.Path)
+	if err != nil {
+		return err
+	}
+	if level, _ := strconv.Atoi(info["GuestAdditionsRunLevel"]); level < 2 {
+		return ErrGuestAdditionsNotRunning
+	}
+
+	return nil
+}
+
+// guestControl runs a guestcontrol command (see GuestControl) against the VM,
+// after making sure the guest additions are running.
+func (v *VirtualBox) guestControl(args ...string) error {
+	if err := v.checkGuestAdditions(); err != nil {
+		return err
+	}
+
+	cmd, cleanup, err := v.GuestControl(args...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// UploadFile copies a single file into the guest. See core.GuestChannel
+func (v *VirtualBox) UploadFile(hostPath, guestPath string) error {
+	return v.guestControl("copyto", hostPath, guestPath)
+}
+
+// DownloadFile copies a single file out of the guest. See core.GuestChannel
+func (v *VirtualBox) DownloadFile(guestPath, hostPath string) error {
+	return v.guestControl("copyfrom", guestPath, hostPath)
+}
+
+// RunShell runs a script in the guest. See core.GuestChannel
+func (v *VirtualBox) RunShell(script string) error {
+	return v.guestControl("run", "--exe", "/bin/sh", "--", "/bin/sh", "-c", script)
+}
+
+// CopyToGuest copies files into the guest using the guest additions. Like
+// Mount this needs the guest login and password from GuestConfig.
+func (v *VirtualBox) CopyToGuest(hostPath, guestPath string) error {
+	return core.CopyToGuest(v, hostPath, guestPath)
+}
+
+// CopyFromGuest copies files out of the guest using the guest additions
+func (v *VirtualBox) CopyFromGuest(guestPath, hostPath string) error {
+	return core.CopyFromGuest(v, guestPath, hostPath)
+}
+
+// Exec runs the script in the guest using guestcontrol run, which streams the
+// output and exits with the script's exit code. Like Mount this needs the
+// guest login and password from GuestConfig.
+//
+// vboxmanage uses exit codes of its own if it can't run the script at all,
+// and we can't tell those apart from the script's. It prints an error in that
+// case, though.
+func (v *VirtualBox) Exec(script string, stdout, stderr io.Writer) (int, error) {
+	if err := v.checkGuestAdditions(); err != nil {
+		return 0, err
+	}
+
+	cmd, cleanup, err := v.GuestControl("run", "--exe", "/bin/sh", "--wait-stdout", "--wait-stderr",
+		"--", "/bin/sh", "-c", script)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// InstallSSHKey installs the key using the guest additions, once the VM is
+// running. Like Mount this needs the guest login and password from
+// GuestConfig.
+func (v *VirtualBox) InstallSSHKey(publicKey string) error {
+	state, err := v.State()
+	if err != nil {
+		return err
+	}
+	if state != core.StateRunning {
+		return core.ErrNotRunning
+	}
+
+	if err := v.WaitForGuestAdditions(GuestAdditionsTimeout); err != nil {
+		return err
+	}
+
+	return v.RunShell(core.AuthorizeKeyScript(v.Config.SSH.Login, publicKey))
+}
+
+// State reads VMState from showvminfo
+func (v *VirtualBox) State() (core.State, error) {
+	if !v.Found() {
+		return core.StateNotCloned, nil
+	}
+
+	info, err := VMInfo(v.Config.Path)
+	if err != nil {
+		return core.StateUnknown, err
+	}
+
+	return ParseState(info["VMState"]), nil
+}
+
+// ParseState translates VirtualBox's VMState into a core.State. VirtualBox
+// calls a suspended VM "saved". VMs that are in the middle of changing state
+// are reported as whatever state they are headed for.
+func ParseState(state string) core.State {
+	switch state {
+	case "running", "starting", "restoring":
+		return core.StateRunning
+	case "poweroff", "aborted", "stopping":
+		return core.StateStopped
+	case "paused":
+		return core.StatePaused
+	case "saved", "saving":
+		return core.StateSuspended
+	}
+	return core.StateUnknown
+}
+
+// SaveSnapshot takes a snapshot of the VM. If the VM is running the snapshot
+// includes its memory.
+func (v *VirtualBox) SaveSnapshot(name string) error {
+	return v.snapshotCommand("take", name)
+}
+
+// RestoreSnapshot restores the VM to the snapshot. VirtualBox refuses to do
+// this while the VM is running, so we'll stop it first and start it again
+// afterward.
+func (v *VirtualBox) RestoreSnapshot(name string) error {
+	running, err := v.Running()
+	if err != nil {
+		return err
+	}
+
+	if running {
+		if err := v.Stop(); err != nil {
+			return err
+		}
+	}
+
+	if err := v.snapshotCommand("restore", name); err != nil {
+		return err
+	}
+
+	if running {
+		return v.Start()
+	}
+
+	return nil
+}
+
+func (v *VirtualBox) DeleteSnapshot(name string) error {
+	return v.snapshotCommand("delete", name)
+}
+
+func (v *VirtualBox) ListSnapshots() ([]string, error) {
+	if !v.Found() {
+		return nil, errors.New("clone a virtual machine first")
+	}
+
+	cmd := exec.Command("vboxmanage",
+		"snapshot", v.Config.Path, "list", "--machinereadable")
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if bytes.Contains(out, []byte(`does not have any snapshots`)) {
+			return nil, nil
+		}
+		core.CommandError(cmd, out)
+		return nil, err
+	}
+
+	return ParseSnapshotList(out), nil
+}
+
+func (v *VirtualBox) snapshotCommand(command, name string) error {
+	if !v.Found() {
+		return errors.New("clone a virtual machine first")
+	}
+
+	cmd := exec.Command("vboxmanage", "snapshot", v.Config.Path, command, name)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// Running reports whether the virtual machine is currently powered on
+func (v *VirtualBox) Running() (bool, error) {
+	if !v.Found() {
+		return false, nil
+	}
+
+	info, err := VMInfo(v.Config.Path)
+	if err != nil {
+		return false, err
+	}
+
+	return info["VMState"] == "running", nil
+}
+
+// WaitForGuestAdditions polls the guest additions run level until guest
+// control is available or the timeout expires. Run level 2 means the guest
+// additions' userland service is running, which is what guestcontrol needs.
+func (v *VirtualBox) WaitForGuestAdditions(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		info, err := VMInfo(v.Config.Path)
+		if err != nil {
+			return err
+		}
+		level, _ := strconv.Atoi(info["GuestAdditionsRunLevel"])
+		if level >= 2 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrGuestAdditionsNotRunning
+		}
+		time.Sleep(2 * time.Second)
+	}
 }
 
 func (v *VirtualBox) Found() bool {
@@ -256,3 +1068,393 @@ func CreateSnapshot(path string) error {
 
 	return nil
 }
+
+// ParseSnapshotList parses the output of vboxmanage snapshot list
+// --machinereadable. Snapshots form a tree, and each snapshot's key records
+// its position in the tree. We flatten it in the order VirtualBox prints it,
+// which puts parents before their children. For example:
+//
+//	SnapshotName="lovm-clone"
+//	SnapshotUUID="..."
+//	SnapshotName-1="before-deploy"
+//	SnapshotUUID-1="..."
+//	CurrentSnapshotName="before-deploy"
+func ParseSnapshotList(data []byte) []string {
+	var names []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		match := reMachineReadable.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+		if match[1] == "SnapshotName" || strings.HasPrefix(match[1], "SnapshotName-") {
+			names = append(names, match[2])
+		}
+	}
+
+	return names
+}
+
+// NIC describes one of the network adapters attached to a VirtualBox VM.
+type NIC struct {
+	// Name is the adapter name used by vboxmanage, e.g. nic1
+	Name string
+
+	// Type is the attachment type, e.g. nat, hostonly, bridged
+	Type string
+
+	MAC net.HardwareAddr
+
+	// HostOnlyAdapter is the name of the host-only network (e.g. vboxnet0) if
+	// the adapter is attached to one.
+	HostOnlyAdapter string
+}
+
+// ForwardRulePrefix starts the name of the NAT rules added by Forward
+const ForwardRulePrefix = "lovm-"
+
+// NATRule is a port forwarding rule on a NAT adapter. vboxmanage writes them
+// as name,protocol,host ip,host port,guest ip,guest port, e.g.
+// ssh,tcp,127.0.0.1,2222,,22
+type NATRule struct {
+	Name      string
+	Protocol  string
+	HostIP    string
+	HostPort  int
+	GuestIP   string
+	GuestPort int
+}
+
+func (r NATRule) String() string {
+	return fmt.Sprintf("%s,%s,%s,%d,%s,%d", r.Name, r.Protocol, r.HostIP,
+		r.HostPort, r.GuestIP, r.GuestPort)
+}
+
+// ForwardRule returns the NAT rule Forward uses for a forward. It only listens
+// on the host's loopback address, like the proxy in lovm forward.
+func ForwardRule(forward core.Forward) NATRule {
+	return NATRule{
+		Name:      fmt.Sprintf("%s%d", ForwardRulePrefix, forward.HostPort),
+		Protocol:  "tcp",
+		HostIP:    "127.0.0.1",
+		HostPort:  forward.HostPort,
+		GuestPort: forward.GuestPort,
+	}
+}
+
+// ParseNATRule parses a NAT rule in the format used by vboxmanage
+func ParseNATRule(s string) (NATRule, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 6 {
+		return NATRule{}, fmt.Errorf("invalid NAT rule %q", s)
+	}
+
+	hostPort, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return NATRule{}, fmt.Errorf("invalid NAT rule %q", s)
+	}
+	guestPort, err := strconv.Atoi(parts[5])
+	if err != nil {
+		return NATRule{}, fmt.Errorf("invalid NAT rule %q", s)
+	}
+
+	return NATRule{
+		Name:      parts[0],
+		Protocol:  parts[1],
+		HostIP:    parts[2],
+		HostPort:  hostPort,
+		GuestIP:   parts[4],
+		GuestPort: guestPort,
+	}, nil
+}
+
+// ReadNATRules returns the NAT port forwarding rules found in showvminfo
+// output (the Forwarding(n) keys), keyed by name.
+func ReadNATRules(info map[string]string) map[string]NATRule {
+	rules := map[string]NATRule{}
+
+	for key, value := range info {
+		if !reNATForwarding.MatchString(key) {
+			continue
+		}
+		rule, err := ParseNATRule(value)
+		if err != nil {
+			continue
+		}
+		rules[rule.Name] = rule
+	}
+
+	return rules
+}
+
+// SharedFolder is a VirtualBox shared folder
+type SharedFolder struct {
+	Name     string
+	HostPath string
+
+	// Transient shared folders only exist until the VM is stopped
+	Transient bool
+}
+
+// ReadSharedFolders returns the shared folders found in showvminfo output,
+// keyed by name.
+func ReadSharedFolders(info map[string]string) map[string]SharedFolder {
+	shares := map[string]SharedFolder{}
+
+	for key, name := range info {
+		match := reSharedFolderName.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+		shares[name] = SharedFolder{
+			Name:      name,
+			HostPath:  info[fmt.Sprintf("SharedFolderPath%sMapping%s", match[1], match[2])],
+			Transient: match[1] == "Transient",
+		}
+	}
+
+	return shares
+}
+
+// VMInfo runs showvminfo and returns the machine-readable key / value pairs
+func VMInfo(path string) (map[string]string, error) {
+	cmd := exec.Command("vboxmanage", "showvminfo", path, "--machinereadable")
+
+	out, err := cmd.Output()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return nil, err
+	}
+
+	return ParseMachineReadable(out), nil
+}
+
+// ParseMachineReadable parses the output of vboxmanage --machinereadable. For
+// example:
+//
+//	name="example"
+//	nic1="nat"
+//	macaddress1="080027C5A9E0"
+//	"SATA-0-0"="/path/to/disk.vdi"
+func ParseMachineReadable(data []byte) map[string]string {
+	values := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		match := reMachineReadable.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+		values[match[1]] = match[2]
+	}
+
+	return values
+}
+
+// ReadNICs lists the network adapters found in showvminfo output, ordered by
+// adapter number. Adapters that are not attached to anything are omitted.
+func ReadNICs(info map[string]string) []NIC {
+	var indexes []int
+	for key, value := range info {
+		match := reNICIndex.FindStringSubmatch(key)
+		if match == nil || value == "none" {
+			continue
+		}
+		index, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var nics []NIC
+	for _, index := range indexes {
+		mac, err := ParseMAC(info[fmt.Sprintf("macaddress%d", index)])
+		if err != nil {
+			continue
+		}
+		nics = append(nics, NIC{
+			Name:            fmt.Sprintf("nic%d", index),
+			Type:            info[fmt.Sprintf("nic%d", index)],
+			MAC:             mac,
+			HostOnlyAdapter: info[fmt.Sprintf("hostonlyadapter%d", index)],
+		})
+	}
+
+	return nics
+}
+
+func FindNICByName(nics []NIC, name string) (NIC, error) {
+	for _, nic := range nics {
+		if nic.Name == name {
+			return nic, nil
+		}
+	}
+	return NIC{}, ErrInterfaceNotFound
+}
+
+// ParseMAC parses MAC addresses as VirtualBox formats them, which is to say
+// without any separators (e.g. 080027C5A9E0)
+func ParseMAC(s string) (net.HardwareAddr, error) {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q", s)
+	}
+	return net.HardwareAddr(data), nil
+}
+
+// GuestProperties returns the networking properties reported by the guest
+// additions. If the guest additions are not running this will be empty.
+func GuestProperties(path string) (map[string]string, error) {
+	cmd := exec.Command("vboxmanage", "guestproperty", "enumerate", path,
+		"--patterns", "/VirtualBox/GuestInfo/Net/*")
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return nil, err
+	}
+
+	return ParseGuestProperties(out), nil
+}
+
+// ParseGuestProperties parses the output of vboxmanage guestproperty
+// enumerate. For example:
+//
+//	Name: /VirtualBox/GuestInfo/Net/0/V4/IP, value: 10.0.2.15, timestamp: 1556000000000000000, flags:
+//
+// or, on VirtualBox 7:
+//
+//	/VirtualBox/GuestInfo/Net/0/V4/IP = '10.0.2.15' @ 2023-05-01T00:00:00.000000000Z
+func ParseGuestProperties(data []byte) map[string]string {
+	properties := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		match := reGuestPropertyOld.FindStringSubmatch(line)
+		if match == nil {
+			match = reGuestPropertyNew.FindStringSubmatch(line)
+		}
+		if match == nil {
+			continue
+		}
+		properties[match[1]] = match[2]
+	}
+
+	return properties
+}
+
+// GuestIPsByMAC correlates the /VirtualBox/GuestInfo/Net/*/MAC and
+// /VirtualBox/GuestInfo/Net/*/V4/IP guest properties. The guest's interface
+// numbering does not necessarily match VirtualBox's adapter numbering, so
+// the result is keyed by MAC address.
+func GuestIPsByMAC(properties map[string]string) map[string]net.IP {
+	ips := map[string]net.IP{}
+
+	for key, value := range properties {
+		match := reGuestNetMAC.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+		mac, err := ParseMAC(value)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(properties[fmt.Sprintf("/VirtualBox/GuestInfo/Net/%s/V4/IP", match[1])])
+		if ip == nil || ip.IsUnspecified() {
+			continue
+		}
+		ips[mac.String()] = ip
+	}
+
+	return ips
+}
+
+// Lease is an entry in one of VirtualBox's DHCP lease tables. For example:
+//
+//	<Lease mac="08:00:27:c5:a9:e0" id="01080027c5a9e0" state="acked">
+//	  <Address value="192.168.56.101"/>
+//	  <Time issued="1556000000" expiration="600"/>
+//	</Lease>
+type Lease struct {
+	MAC     string `xml:"mac,attr"`
+	State   string `xml:"state,attr"`
+	Address struct {
+		Value string `xml:"value,attr"`
+	} `xml:"Address"`
+	Time struct {
+		Issued     int64 `xml:"issued,attr"`
+		Expiration int64 `xml:"expiration,attr"`
+	} `xml:"Time"`
+}
+
+// Ends returns the time at which the lease expires
+func (l Lease) Ends() time.Time {
+	return time.Unix(l.Time.Issued+l.Time.Expiration, 0)
+}
+
+// ParseDHCPLeases parses a VirtualBox DHCP lease table
+func ParseDHCPLeases(data []byte) ([]Lease, error) {
+	leases := struct {
+		Leases []Lease `xml:"Lease"`
+	}{}
+
+	if err := xml.Unmarshal(data, &leases); err != nil {
+		return nil, err
+	}
+
+	return leases.Leases, nil
+}
+
+// FindCurrentLeaseByMAC searches the DHCP lease table for the specified host-
+// only network and returns the IP address for the newest active lease assigned
+// to the specified MAC address.
+//
+// The path argument should be a parameterized path to the DHCP leases file.
+// See DHCPLeasesFile as an example.
+//
+// If no valid lease can be found, returns ErrLeaseNotFound.
+func FindCurrentLeaseByMAC(path string, network string, addr net.HardwareAddr) (net.IP, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf(path, network))
+	if err != nil {
+		return nil, err
+	}
+
+	leases, err := ParseDHCPLeases(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var current *Lease
+	now := time.Now()
+
+	for i, lease := range leases {
+		mac, err := net.ParseMAC(lease.MAC)
+		if err != nil || mac.String() != addr.String() {
+			continue
+		}
+		if lease.State != "acked" || !now.Before(lease.Ends()) {
+			continue
+		}
+		if current == nil || lease.Time.Issued > current.Time.Issued {
+			current = &leases[i]
+		}
+	}
+
+	if current == nil {
+		return nil, ErrLeaseNotFound
+	}
+
+	ip := net.ParseIP(current.Address.Value)
+	if ip == nil {
+		return nil, fmt.Errorf("failed parsing ip address: %q", current.Address.Value)
+	}
+
+	return ip, nil
+}
@@ -0,0 +1,228 @@
+package virtualbox
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+func ReadFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("test-fixtures", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseMachineReadable(t *testing.T) {
+	info := ParseMachineReadable(ReadFixture(t, "showvminfo.txt"))
+
+	cases := map[string]string{
+		"name":             "example",
+		"VMState":          "running",
+		"memory":           "1024",
+		"hostonlyadapter2": "vboxnet0",
+		"SATA-0-0":         "/home/user/project/.lovm/example/Snapshots/{0e3c2f1a-8f6b-4b8e-9a0b-7d6c5e4f3a2b}.vdi",
+	}
+
+	for key, expected := range cases {
+		if info[key] != expected {
+			t.Errorf("Expected %s=%q, found %q", key, expected, info[key])
+		}
+	}
+}
+
+func TestReadNICs(t *testing.T) {
+	nics := ReadNICs(ParseMachineReadable(ReadFixture(t, "showvminfo.txt")))
+
+	if len(nics) != 2 {
+		t.Fatalf("Expected 2 NICs, found %#v", nics)
+	}
+
+	expected := []NIC{
+		{Name: "nic1", Type: "nat", MAC: net.HardwareAddr{0x08, 0x00, 0x27, 0xc5, 0xa9, 0xe0}},
+		{Name: "nic2", Type: "hostonly", MAC: net.HardwareAddr{0x08, 0x00, 0x27, 0x7f, 0xe0, 0x9a}, HostOnlyAdapter: "vboxnet0"},
+	}
+
+	for i, nic := range nics {
+		if nic.Name != expected[i].Name || nic.Type != expected[i].Type ||
+			nic.MAC.String() != expected[i].MAC.String() ||
+			nic.HostOnlyAdapter != expected[i].HostOnlyAdapter {
+			t.Errorf("Expected %#v, found %#v", expected[i], nic)
+		}
+	}
+
+	if _, err := FindNICByName(nics, "nic3"); err != ErrInterfaceNotFound {
+		t.Errorf("Expected %s, found %s", ErrInterfaceNotFound, err)
+	}
+}
+
+func TestGuestIPsByMAC(t *testing.T) {
+	for _, fixture := range []string{"guestproperty.txt", "guestproperty7.txt"} {
+		ips := GuestIPsByMAC(ParseGuestProperties(ReadFixture(t, fixture)))
+
+		cases := map[string]string{
+			"08:00:27:c5:a9:e0": "10.0.2.15",
+			"08:00:27:7f:e0:9a": "192.168.56.101",
+		}
+
+		for mac, expected := range cases {
+			if ips[mac].String() != expected {
+				t.Errorf("%s: expected %s for %s, found %s", fixture, expected, mac, ips[mac])
+			}
+		}
+	}
+}
+
+func TestFindCurrentLeaseByMAC(t *testing.T) {
+	path := filepath.Join("test-fixtures", DHCPLeasesFile)
+
+	mac, err := net.ParseMAC("08:00:27:7f:e0:9a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "192.168.56.101"
+	ip, err := FindCurrentLeaseByMAC(path, "vboxnet0", mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != expected {
+		t.Errorf("Expected %s, found %s", expected, ip)
+	}
+
+	// This MAC address has a lease but it has expired
+	mac, err = net.ParseMAC("08:00:27:3b:1d:42")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := FindCurrentLeaseByMAC(path, "vboxnet0", mac); err != ErrLeaseNotFound {
+		t.Errorf("Expected %s, found %s", ErrLeaseNotFound, err)
+	}
+}
+
+func TestReadSharedFolders(t *testing.T) {
+	shares := ReadSharedFolders(ParseMachineReadable(ReadFixture(t, "showvminfo.txt")))
+
+	expected := map[string]SharedFolder{
+		"srv-project": {Name: "srv-project", HostPath: "/home/user/project"},
+		"srv-logs":    {Name: "srv-logs", HostPath: "/home/user/logs", Transient: true},
+	}
+
+	if len(shares) != len(expected) {
+		t.Fatalf("Expected %#v, found %#v", expected, shares)
+	}
+	for name, share := range expected {
+		if shares[name] != share {
+			t.Errorf("Expected %#v, found %#v", share, shares[name])
+		}
+	}
+}
+
+func TestParseState(t *testing.T) {
+	cases := map[string]core.State{
+		"running":  core.StateRunning,
+		"poweroff": core.StateStopped,
+		"aborted":  core.StateStopped,
+		"paused":   core.StatePaused,
+		"saved":    core.StateSuspended,
+		"teleport": core.StateUnknown,
+	}
+
+	for input, expected := range cases {
+		if output := ParseState(input); output != expected {
+			t.Errorf("Expected %s for %q, found %s", expected, input, output)
+		}
+	}
+}
+
+func TestParseSnapshotList(t *testing.T) {
+	names := ParseSnapshotList(ReadFixture(t, "snapshots.txt"))
+
+	expected := []string{"lovm-clone", "before-deploy", "after-deploy"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected %#v, found %#v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Expected %q, found %q", expected[i], names[i])
+		}
+	}
+}
+
+func TestReadNATRules(t *testing.T) {
+	rules := ReadNATRules(ParseMachineReadable(ReadFixture(t, "showvminfo.txt")))
+
+	expected := map[string]NATRule{
+		"ssh":       {Name: "ssh", Protocol: "tcp", HostIP: "127.0.0.1", HostPort: 2222, GuestPort: 22},
+		"lovm-8080": ForwardRule(core.Forward{HostPort: 8080, GuestPort: 80}),
+	}
+
+	if len(rules) != len(expected) {
+		t.Fatalf("Expected %#v, found %#v", expected, rules)
+	}
+	for name, rule := range expected {
+		if rules[name] != rule {
+			t.Errorf("Expected %#v, found %#v", rule, rules[name])
+		}
+	}
+
+	if s := rules["lovm-8080"].String(); s != "lovm-8080,tcp,127.0.0.1,8080,,80" {
+		t.Errorf("Unexpected rule %q", s)
+	}
+
+	if _, err := ParseNATRule("ssh,tcp,,twentytwo,,22"); err == nil {
+		t.Error("Expected an error for an invalid host port")
+	}
+}
+
+func TestModifyVMArgs(t *testing.T) {
+	info := ParseMachineReadable(ReadFixture(t, "showvminfo.txt"))
+
+	cases := []struct {
+		config   core.MachineConfig
+		expected string
+	}{
+		{core.MachineConfig{}, ""},
+		{core.MachineConfig{CPUs: 1, Memory: "1G"}, ""},
+		{core.MachineConfig{CPUs: 4, Memory: "8G"}, "--cpus 4 --memory 8192"},
+		{core.MachineConfig{Networks: []core.Network{{Type: "nat"}, {Type: "hostonly"}}}, ""},
+		{core.MachineConfig{Networks: []core.Network{{Type: "nat"}, {Type: "hostonly", Name: "vboxnet1"}}},
+			"--nic2 hostonly --hostonlyadapter2 vboxnet1"},
+		{core.MachineConfig{Networks: []core.Network{{Type: "bridged", Name: "en0"}}},
+			"--nic1 bridged --bridgeadapter1 en0 --nic2 none"},
+	}
+
+	for _, c := range cases {
+		args, err := ModifyVMArgs(info, &c.config)
+		if err != nil {
+			t.Errorf("%+v: %s", c.config, err)
+			continue
+		}
+		if found := strings.Join(args, " "); found != c.expected {
+			t.Errorf("%+v: expected %q, found %q", c.config, c.expected, found)
+		}
+	}
+
+	info["nic1"], info["bridgeadapter1"] = "bridged", "en0: Wi-Fi (AirPort)"
+	args, err := ModifyVMArgs(info, &core.MachineConfig{Networks: []core.Network{{Type: "bridged", Name: "en0"}, {Type: "hostonly"}}})
+	if err != nil || len(args) != 0 {
+		t.Errorf("Expected the bridged adapter to match, found %q (%v)", args, err)
+	}
+
+	invalid := []core.MachineConfig{
+		{Memory: "lots"},
+		{Networks: []core.Network{{Type: "bridged"}}},
+		{Networks: []core.Network{{Type: "nat", Name: "natnet"}}},
+	}
+	for _, config := range invalid {
+		if _, err := ModifyVMArgs(info, &config); err == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package vmware
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lease is an entry in the lease table of one of VMware's DHCP servers, which
+// are ISC dhcpd (see dhcpd.leases(5)). For example:
+//
+//	lease 172.16.23.131 {
+//	  starts 1 2019/04/22 06:28:17;
+//	  ends 1 2019/04/22 06:58:17;
+//	  cltt 1 2019/04/22 06:28:17;
+//	  binding state active;
+//	  hardware ethernet 00:0c:29:f7:07:f2;
+//	  uid 01:00:0c:29:f7:07:f2;
+//	  client-hostname "centos-vmware";
+//	}
+//
+// Times are in UTC. A zero Starts or Ends means the file says "never", or
+// doesn't say.
+type Lease struct {
+	IP     net.IP
+	Starts time.Time
+	Ends   time.Time
+
+	// CLTT is when the client last talked to the server
+	CLTT time.Time
+
+	MAC net.HardwareAddr
+
+	// UID is the client identifier the guest sent, as colon-separated hex
+	UID string
+
+	ClientHostname string
+
+	// BindingState is e.g. active, free, or abandoned. Older versions of
+	// dhcpd don't write it, and mark abandoned leases with "abandoned;".
+	BindingState string
+}
+
+// Active returns true if the lease is in effect at now
+func (l Lease) Active(now time.Time) bool {
+	if l.BindingState != "" && l.BindingState != "active" {
+		return false
+	}
+	if !l.Starts.IsZero() && now.Before(l.Starts) {
+		return false
+	}
+	if !l.Ends.IsZero() && !now.Before(l.Ends) {
+		return false
+	}
+	return true
+}
+
+// ReadLeases reads and parses a dhcpd lease file. See ParseLeases.
+func ReadLeases(path string) (leases []Lease, warnings []error, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leases, warnings, err = ParseLeases(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	for i, warning := range warnings {
+		warnings[i] = fmt.Errorf("%s: %s", path, warning)
+	}
+	return leases, warnings, nil
+}
+
+// FindLease returns the newest active lease for mac. dhcpd appends a new
+// entry for an address each time its lease changes, so only the last entry for
+// each address counts. If more than one address has an active lease for mac,
+// the one that started last wins. ok is false if there isn't one.
+func FindLease(leases []Lease, mac net.HardwareAddr, now time.Time) (lease Lease, ok bool) {
+	latest := map[string]int{}
+	for i, l := range leases {
+		latest[l.IP.String()] = i
+	}
+
+	for i, l := range leases {
+		if latest[l.IP.String()] != i || l.MAC.String() != mac.String() || !l.Active(now) {
+			continue
+		}
+		if !ok || !l.Starts.Before(lease.Starts) {
+			lease, ok = l, true
+		}
+	}
+
+	return lease, ok
+}
+
+// leaseToken is a word, a quoted string, or one of { } ;
+type leaseToken struct {
+	text   string
+	quoted bool
+	line   int
+}
+
+// tokenizeLeases splits a lease file into tokens, dropping comments. Quoted
+// strings are unescaped.
+func tokenizeLeases(data []byte) ([]leaseToken, error) {
+	var tokens []leaseToken
+	line := 1
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\n':
+			line++
+		case c == ' ' || c == '\t' || c == '\r':
+		case c == '#':
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, leaseToken{text: string(c), line: line})
+		case c == '"':
+			start := line
+			var b strings.Builder
+			i++
+			for ; i < len(data) && data[i] != '"'; i++ {
+				switch {
+				case data[i] == '\n':
+					line++
+					b.WriteByte('\n')
+				case data[i] == '\\' && i+1 < len(data):
+					i++
+					// dhcpd writes unprintable bytes as three octal digits
+					if i+2 < len(data) && isOctal(data[i]) && isOctal(data[i+1]) && isOctal(data[i+2]) {
+						n, _ := strconv.ParseUint(string(data[i:i+3]), 8, 8)
+						b.WriteByte(byte(n))
+						i += 2
+						continue
+					}
+					if data[i] == '\n' {
+						line++
+					}
+					b.WriteByte(data[i])
+				default:
+					b.WriteByte(data[i])
+				}
+			}
+			if i >= len(data) {
+				return nil, fmt.Errorf("line %d: unterminated string", start)
+			}
+			tokens = append(tokens, leaseToken{text: b.String(), quoted: true, line: start})
+		default:
+			start := i
+			for i+1 < len(data) && !strings.ContainsRune(" \t\r\n#{};\"", rune(data[i+1])) {
+				i++
+			}
+			tokens = append(tokens, leaseToken{text: string(data[start : i+1]), line: line})
+		}
+	}
+
+	return tokens, nil
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// leaseStatement is a list of words ending with ; or a block in { }
+type leaseStatement struct {
+	words []leaseToken
+	block []leaseStatement
+
+	// hasBlock is true if the statement ended with a block, even an empty one
+	hasBlock bool
+	line     int
+}
+
+// parseStatements parses statements until the end of the tokens, or the }
+// that closes the block we're in. It returns the statements and the number of
+// tokens used, including the }.
+func parseStatements(tokens []leaseToken, nested bool) ([]leaseStatement, int, error) {
+	var statements []leaseStatement
+	current := leaseStatement{}
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.quoted {
+			if len(current.words) == 0 {
+				current.line = t.line
+			}
+			current.words = append(current.words, t)
+			continue
+		}
+
+		switch t.text {
+		case ";":
+			if len(current.words) > 0 {
+				statements = append(statements, current)
+			}
+			current = leaseStatement{}
+		case "{":
+			block, n, err := parseStatements(tokens[i+1:], true)
+			if err != nil {
+				return nil, 0, err
+			}
+			if len(current.words) == 0 {
+				current.line = t.line
+			}
+			current.block, current.hasBlock = block, true
+			statements = append(statements, current)
+			current = leaseStatement{}
+			i += n
+		case "}":
+			if !nested {
+				return nil, 0, fmt.Errorf("line %d: unexpected }", t.line)
+			}
+			if len(current.words) > 0 {
+				return nil, 0, fmt.Errorf("line %d: missing ; before }", t.line)
+			}
+			return statements, i + 1, nil
+		default:
+			if len(current.words) == 0 {
+				current.line = t.line
+			}
+			current.words = append(current.words, t)
+		}
+	}
+
+	if nested {
+		return nil, 0, fmt.Errorf("missing }")
+	}
+	if len(current.words) > 0 {
+		return nil, 0, fmt.Errorf("line %d: missing ;", current.line)
+	}
+	return statements, len(tokens), nil
+}
+
+// ParseLeases parses a dhcpd lease file and returns its leases in the order
+// they appear. Everything else in the file, such as server-duid or failover
+// state, is skipped, as are lease fields we don't use.
+//
+// Every VM on a network shares its lease file, so one lease we can't make
+// sense of mustn't hide the others. It is skipped, and the reason is added to
+// warnings. We only return an error if the file's structure is broken, e.g. a
+// missing } or an unterminated string.
+func ParseLeases(data []byte) (leases []Lease, warnings []error, err error) {
+	tokens, err := tokenizeLeases(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	statements, _, err := parseStatements(tokens, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, s := range statements {
+		if len(s.words) == 0 || s.words[0].quoted || s.words[0].text != "lease" || !s.hasBlock {
+			continue
+		}
+
+		lease, err := parseLease(s)
+		if err != nil {
+			warnings = append(warnings, fmt.Errorf("skipped lease: %s", err))
+			continue
+		}
+		leases = append(leases, lease)
+	}
+
+	return leases, warnings, nil
+}
+
+// parseLease parses a lease statement and the fields in its block
+func parseLease(s leaseStatement) (Lease, error) {
+	if len(s.words) != 2 {
+		return Lease{}, fmt.Errorf("line %d: expected lease <address> {", s.line)
+	}
+
+	lease := Lease{IP: net.ParseIP(s.words[1].text)}
+	if lease.IP == nil {
+		return Lease{}, fmt.Errorf("line %d: invalid lease address %q", s.line, s.words[1].text)
+	}
+	for _, field := range s.block {
+		if err := parseLeaseField(&lease, field); err != nil {
+			return Lease{}, err
+		}
+	}
+
+	return lease, nil
+}
+
+// parseLeaseField fills in the lease from one of the statements in its block
+func parseLeaseField(lease *Lease, s leaseStatement) error {
+	var words []string
+	for _, w := range s.words {
+		words = append(words, w.text)
+	}
+	if len(words) == 0 || s.hasBlock {
+		return nil
+	}
+
+	var err error
+	switch words[0] {
+	case "starts":
+		lease.Starts, err = parseLeaseTime(words[1:])
+	case "ends":
+		lease.Ends, err = parseLeaseTime(words[1:])
+	case "cltt":
+		lease.CLTT, err = parseLeaseTime(words[1:])
+	case "hardware":
+		if len(words) != 3 {
+			err = fmt.Errorf("expected hardware <type> <address>")
+			break
+		}
+		lease.MAC, err = net.ParseMAC(words[2])
+	case "uid":
+		if len(words) != 2 {
+			err = fmt.Errorf("expected uid <client id>")
+			break
+		}
+		lease.UID, err = parseLeaseUID(s.words[1])
+	case "client-hostname":
+		if len(words) != 2 {
+			err = fmt.Errorf("expected client-hostname <name>")
+			break
+		}
+		lease.ClientHostname = words[1]
+	case "binding":
+		if len(words) != 3 || words[1] != "state" {
+			err = fmt.Errorf("expected binding state <state>")
+			break
+		}
+		lease.BindingState = words[2]
+	case "abandoned":
+		lease.BindingState = "abandoned"
+	}
+
+	if err != nil {
+		return fmt.Errorf("line %d: %s", s.line, err)
+	}
+	return nil
+}
+
+// parseLeaseTime parses a time, which dhcpd writes as the day of the week, the
+// date and the time in UTC, e.g. "1 2019/04/22 06:24:51". It may also be
+// "never", or "epoch" and the seconds since 1970.
+func parseLeaseTime(words []string) (time.Time, error) {
+	switch {
+	case len(words) == 1 && words[0] == "never":
+		return time.Time{}, nil
+	case len(words) == 2 && words[0] == "epoch":
+		seconds, err := strconv.ParseInt(words[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q", strings.Join(words, " "))
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	case len(words) == 3:
+		return time.Parse(DHCPDateFormat, words[1]+" "+words[2])
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", strings.Join(words, " "))
+}
+
+// parseLeaseUID formats a client identifier as colon-separated hex. dhcpd
+// writes it either that way, or as a quoted string if it's mostly printable.
+func parseLeaseUID(t leaseToken) (string, error) {
+	var parts []string
+	if t.quoted {
+		for i := 0; i < len(t.text); i++ {
+			parts = append(parts, fmt.Sprintf("%02x", t.text[i]))
+		}
+		return strings.Join(parts, ":"), nil
+	}
+
+	for _, part := range strings.Split(t.text, ":") {
+		n, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid uid %q", t.text)
+		}
+		parts = append(parts, fmt.Sprintf("%02x", n))
+	}
+	return strings.Join(parts, ":"), nil
+}
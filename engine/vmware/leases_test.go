@@ -0,0 +1,176 @@
+package vmware
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLeases(t *testing.T) {
+	leases, _, err := ReadLeases(filepath.Join("test-fixtures", "dhcpd-fusion.leases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 6 {
+		t.Fatalf("Expected 6 leases, found %d", len(leases))
+	}
+
+	first := leases[0]
+	if first.IP.String() != "192.168.130.140" || first.MAC.String() != "00:50:56:2b:aa:01" {
+		t.Errorf("Unexpected lease %+v", first)
+	}
+	if first.BindingState != "active" || first.ClientHostname != "fusion-win" {
+		t.Errorf("Unexpected binding state %q or hostname %q", first.BindingState, first.ClientHostname)
+	}
+	if first.UID != "01:00:50:56:2b:aa:01" || leases[1].UID != first.UID {
+		t.Errorf("Expected both uids to be 01:00:50:56:2b:aa:01, found %q and %q", first.UID, leases[1].UID)
+	}
+	if expected := time.Date(2023, 5, 10, 9, 12, 40, 0, time.UTC); !first.CLTT.Equal(expected) {
+		t.Errorf("Expected cltt %s, found %s", expected, first.CLTT)
+	}
+
+	if leases[3].BindingState != "abandoned" {
+		t.Errorf("Expected an abandoned lease, found %q", leases[3].BindingState)
+	}
+
+	epoch := leases[4]
+	if !epoch.Starts.Equal(time.Date(2023, 5, 11, 10, 10, 0, 0, time.UTC)) || !epoch.Ends.IsZero() {
+		t.Errorf("Expected an epoch start and no end, found %s and %s", epoch.Starts, epoch.Ends)
+	}
+	if epoch.ClientHostname != `fusion "linux"` {
+		t.Errorf("Unexpected hostname %q", epoch.ClientHostname)
+	}
+
+	// The old lease files parse too
+	leases, _, err = ReadLeases(filepath.Join("test-fixtures", "dhcpd8.leases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 4 || leases[2].UID != "ff:bc:9a:4a:2d:00:02:00:00:ab:11:15:39:5e:d3:35:a2:c9:00" {
+		t.Errorf("Unexpected leases %+v", leases)
+	}
+
+	// A broken file structure is an error
+	invalid := []string{
+		`lease 192.168.130.140 {`,
+		`lease 192.168.130.140 { starts 3 2023/05/10 09:12:40; }}`,
+		`lease 192.168.130.140 { client-hostname "unterminated; }`,
+		`lease 192.168.130.140 { starts 3 2023/05/10 09:12:40 }`,
+	}
+	for _, data := range invalid {
+		if _, _, err := ParseLeases([]byte(data)); err == nil {
+			t.Errorf("Expected an error for %q", data)
+		}
+	}
+
+	// A lease we can't make sense of is skipped with a warning
+	skipped := []string{
+		`lease 192.168.130.140 { starts sometime; }`,
+		`lease 192.168.130.140 { hardware ethernet zz:zz; }`,
+		`lease 192.168.130.140 { uid 01:zz; }`,
+		`lease banana { }`,
+		`lease { }`,
+	}
+	for _, data := range skipped {
+		leases, warnings, err := ParseLeases([]byte(data))
+		if err != nil || len(leases) != 0 || len(warnings) != 1 {
+			t.Errorf("Expected %q to be skipped with a warning, found %v, %v, %v", data, leases, warnings, err)
+		}
+	}
+}
+
+func TestParseLeasesMalformed(t *testing.T) {
+	path := filepath.Join("test-fixtures", "dhcpd-malformed.leases")
+	leases, warnings, err := ReadLeases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ips []string
+	for _, lease := range leases {
+		ips = append(ips, lease.IP.String())
+	}
+	if strings.Join(ips, " ") != "172.16.23.131 172.16.23.134" {
+		t.Errorf("Expected the good leases on either side of the bad ones, found %v", ips)
+	}
+
+	if len(warnings) != 2 {
+		t.Fatalf("Expected a warning for each bad lease, found %v", warnings)
+	}
+	for i, line := range []string{"line 14", "line 21"} {
+		if !strings.Contains(warnings[i].Error(), path) || !strings.Contains(warnings[i].Error(), line) {
+			t.Errorf("Expected a warning for %s of %s, found %s", line, path, warnings[i])
+		}
+	}
+}
+
+func TestFindLease(t *testing.T) {
+	leases, _, err := ReadLeases(filepath.Join("test-fixtures", "dhcpd-fusion.leases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := map[string]string{
+		// Two active leases; the newest wins
+		"00:50:56:2b:aa:01": "192.168.130.141",
+		// The lease was freed by a later entry for the same address
+		"00:50:56:2b:aa:02": "",
+		// The newer lease was abandoned
+		"00:50:56:2b:aa:03": "192.168.130.144",
+		"00:50:56:2b:aa:04": "",
+	}
+	for s, expected := range cases {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lease, ok := FindLease(leases, mac, now)
+		found := ""
+		if ok {
+			found = lease.IP.String()
+		}
+		if found != expected {
+			t.Errorf("%s: expected %q, found %q", s, expected, found)
+		}
+	}
+
+	// Before the leases started
+	mac, _ := net.ParseMAC("00:50:56:2b:aa:01")
+	if lease, ok := FindLease(leases, mac, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)); ok {
+		t.Errorf("Expected no lease, found %s", lease.IP)
+	}
+}
+
+func FuzzParseLeases(f *testing.F) {
+	paths, err := filepath.Glob(filepath.Join("test-fixtures", "*.leases"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	mac, _ := net.ParseMAC("00:0c:29:f7:07:f2")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		leases, _, err := ParseLeases(data)
+		if err != nil {
+			return
+		}
+		for _, lease := range leases {
+			if lease.IP == nil {
+				t.Errorf("Expected every lease to have an address, found %+v", lease)
+			}
+		}
+		if lease, ok := FindLease(leases, mac, time.Now()); ok && lease.MAC.String() != mac.String() {
+			t.Errorf("Expected a lease for %s, found %+v", mac, lease)
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package vmware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cbednarski/lovm/core"
+)
+
+const (
+	// ProcNetARP is the kernel's IPv4 neighbor table on Linux
+	ProcNetARP = "/proc/net/arp"
+
+	// SweepPort is the UDP port the sweep sends to. It's the discard port, so
+	// anything that answers won't mind.
+	SweepPort = 9
+)
+
+var (
+	// SweepWait is how long we give the network to answer the ARP requests
+	// sent by the sweep before we read the neighbor table again
+	SweepWait = time.Second
+
+	// SweepMaxPrefix limits the sweep to 254 addresses. On larger networks we
+	// only sweep the /24 around the host's own address.
+	SweepMaxPrefix = 24
+)
+
+// Neighbor is an entry in the host's neighbor (ARP) table
+type Neighbor struct {
+	IP     net.IP
+	MAC    net.HardwareAddr
+	Device string
+}
+
+// ReadNeighbors returns the complete entries in the host's neighbor table,
+// which lists the MAC addresses of the machines the host has talked to
+// recently on its local networks. This includes VMs on bridged networks.
+func ReadNeighbors() ([]Neighbor, error) {
+	switch runtime.GOOS {
+	case "linux":
+		if data, err := ioutil.ReadFile(ProcNetARP); err == nil {
+			return ParseProcNetARP(data), nil
+		}
+
+		cmd := exec.Command("ip", "neigh", "show")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			core.CommandError(cmd, out)
+			return nil, err
+		}
+		return ParseIPNeigh(out), nil
+	default:
+		cmd := exec.Command("arp", "-an")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			core.CommandError(cmd, out)
+			return nil, err
+		}
+		return ParseARP(out), nil
+	}
+}
+
+// ParseProcNetARP parses /proc/net/arp. For example:
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.1.1      0x1         0x2         a0:63:91:2b:4c:10     *        enp3s0
+//	192.168.1.30     0x1         0x0         00:00:00:00:00:00     *        enp3s0
+//
+// Entries with flags 0x0 are incomplete (nobody answered) and are skipped.
+func ParseProcNetARP(data []byte) []Neighbor {
+	var neighbors []Neighbor
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 || fields[2] == "0x0" {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		mac, err := net.ParseMAC(fields[3])
+		if ip == nil || err != nil {
+			continue
+		}
+
+		neighbors = append(neighbors, Neighbor{IP: ip, MAC: mac, Device: fields[5]})
+	}
+
+	return neighbors
+}
+
+// ParseIPNeigh parses the output of ip neigh show. For example:
+//
+//	192.168.1.20 dev enp3s0 lladdr 00:0c:29:f7:07:f2 REACHABLE
+//	192.168.1.30 dev enp3s0 FAILED
+//	fe80::1 dev enp3s0 lladdr a0:63:91:2b:4c:10 router STALE
+//
+// Entries without a link layer address are skipped.
+func ParseIPNeigh(data []byte) []Neighbor {
+	var neighbors []Neighbor
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		neighbor := Neighbor{IP: net.ParseIP(fields[0])}
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "dev":
+				neighbor.Device = fields[i+1]
+			case "lladdr":
+				neighbor.MAC, _ = net.ParseMAC(fields[i+1])
+			}
+		}
+
+		if neighbor.IP == nil || neighbor.MAC == nil {
+			continue
+		}
+		neighbors = append(neighbors, neighbor)
+	}
+
+	return neighbors
+}
+
+// ParseARP parses the output of arp -an on macOS and BSD. For example:
+//
+//	? (192.168.1.20) at 0:c:29:f7:7:f2 on en0 ifscope [ethernet]
+//	? (192.168.1.30) at (incomplete) on en0 ifscope [ethernet]
+//
+// Note that leading zeros are left out of the MAC address.
+func ParseARP(data []byte) []Neighbor {
+	var neighbors []Neighbor
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[2] != "at" || fields[4] != "on" {
+			continue
+		}
+
+		ip := net.ParseIP(strings.Trim(fields[1], "()"))
+		mac, err := ParseShortMAC(fields[3])
+		if ip == nil || err != nil {
+			continue
+		}
+
+		neighbors = append(neighbors, Neighbor{IP: ip, MAC: mac, Device: fields[5]})
+	}
+
+	return neighbors
+}
+
+// ParseShortMAC parses a MAC address that may leave out leading zeros, like
+// 0:c:29:f7:7:f2
+func ParseShortMAC(s string) (net.HardwareAddr, error) {
+	parts := strings.Split(s, ":")
+	for i, part := range parts {
+		if len(part) == 1 {
+			parts[i] = "0" + part
+		}
+	}
+	return net.ParseMAC(strings.Join(parts, ":"))
+}
+
+// FindNeighborAddresses matches the MAC addresses of the VM's interfaces
+// against the neighbor table. Each interface gets the first IPv4 and IPv6
+// address listed for its MAC address.
+func FindNeighborAddresses(macs map[string]net.HardwareAddr, neighbors []Neighbor) []core.Address {
+	var addresses []core.Address
+
+	for name, mac := range macs {
+		var v4, v6 bool
+		for _, neighbor := range neighbors {
+			if neighbor.MAC.String() != mac.String() {
+				continue
+			}
+			if neighbor.IP.To4() != nil {
+				if v4 {
+					continue
+				}
+				v4 = true
+			} else {
+				if v6 {
+					continue
+				}
+				v6 = true
+			}
+			addresses = append(addresses, core.Address{
+				Interface: name,
+				MAC:       mac.String(),
+				IP:        neighbor.IP,
+				Source:    core.SourceARP,
+			})
+		}
+	}
+
+	core.SortAddresses(addresses)
+
+	return addresses
+}
+
+// BridgedSubnets returns the IPv4 subnets of the host's network interfaces
+// that are up, other than loopback and VMware's own host-only and NAT
+// adapters (vmnet1, vmnet8, etc.). VMs on a bridged network get addresses on
+// one of these.
+func BridgedSubnets() ([]*net.IPNet, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var subnets []*net.IPNet
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 ||
+			strings.HasPrefix(iface.Name, "vmnet") {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if subnet, ok := addr.(*net.IPNet); ok && subnet.IP.To4() != nil {
+				subnets = append(subnets, subnet)
+			}
+		}
+	}
+
+	return subnets, nil
+}
+
+// SubnetHosts lists the host addresses in subnet, leaving out the network and
+// broadcast addresses and the address in subnet.IP itself (ours). Subnets
+// larger than SweepMaxPrefix are narrowed to the ones around subnet.IP.
+func SubnetHosts(subnet *net.IPNet) []net.IP {
+	own := subnet.IP.To4()
+	if own == nil {
+		return nil
+	}
+
+	ones, bits := subnet.Mask.Size()
+	if ones < SweepMaxPrefix {
+		ones = SweepMaxPrefix
+	}
+	size := uint32(1) << uint(bits-ones)
+	if size < 4 {
+		// /31 and /32 don't have room for anyone else we could find this way
+		return nil
+	}
+
+	mask := net.CIDRMask(ones, bits)
+	network := binary.BigEndian.Uint32(own.Mask(mask))
+
+	var hosts []net.IP
+	for i := uint32(1); i < size-1; i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, network+i)
+		if !ip.Equal(own) {
+			hosts = append(hosts, ip)
+		}
+	}
+
+	return hosts
+}
+
+// SweepSubnet sends an empty UDP packet to every host in subnet. To send
+// them, the host has to look up each address with ARP, so whoever is there
+// ends up in the neighbor table even if they ignore the packet. This works
+// like a ping sweep, but doesn't need raw sockets, and most guests don't answer
+// broadcast pings anyway.
+func SweepSubnet(subnet *net.IPNet) {
+	for _, ip := range SubnetHosts(subnet) {
+		conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: SweepPort})
+		if err != nil {
+			continue
+		}
+		conn.Write([]byte{})
+		conn.Close()
+	}
+}
+
+// SweepBridgedSubnets sweeps each of the BridgedSubnets and then waits a
+// moment for the answers to come back
+func SweepBridgedSubnets() error {
+	subnets, err := BridgedSubnets()
+	if err != nil {
+		return err
+	}
+
+	for _, subnet := range subnets {
+		SweepSubnet(subnet)
+	}
+	time.Sleep(SweepWait)
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package vmware
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func ReadNeighborFixture(t *testing.T, name string, parse func([]byte) []Neighbor) []Neighbor {
+	data, err := ioutil.ReadFile(filepath.Join("test-fixtures", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parse(data)
+}
+
+func TestParseNeighbors(t *testing.T) {
+	cases := []struct {
+		name     string
+		parse    func([]byte) []Neighbor
+		expected []string
+	}{
+		{"proc-net-arp.txt", ParseProcNetARP, []string{
+			"192.168.1.1 a0:63:91:2b:4c:10 enp3s0",
+			"192.168.1.20 00:0c:29:f7:07:f2 enp3s0",
+			"172.16.23.131 00:0c:29:f7:07:f2 vmnet8",
+		}},
+		{"ip-neigh.txt", ParseIPNeigh, []string{
+			"192.168.1.1 a0:63:91:2b:4c:10 enp3s0",
+			"192.168.1.20 00:0c:29:f7:07:f2 enp3s0",
+			"fe80::20c:29ff:fef7:7f2 00:0c:29:f7:07:f2 enp3s0",
+			"fe80::1 a0:63:91:2b:4c:10 enp3s0",
+		}},
+		{"arp-an.txt", ParseARP, []string{
+			"192.168.1.1 a0:63:91:2b:4c:10 en0",
+			"192.168.1.20 00:0c:29:f7:07:f2 en0",
+			"224.0.0.251 01:00:5e:00:00:fb en0",
+		}},
+	}
+
+	for _, c := range cases {
+		neighbors := ReadNeighborFixture(t, c.name, c.parse)
+		if len(neighbors) != len(c.expected) {
+			t.Errorf("%s: expected %d neighbors, found %v", c.name, len(c.expected), neighbors)
+			continue
+		}
+		for i, neighbor := range neighbors {
+			found := neighbor.IP.String() + " " + neighbor.MAC.String() + " " + neighbor.Device
+			if found != c.expected[i] {
+				t.Errorf("%s: expected %q, found %q", c.name, c.expected[i], found)
+			}
+		}
+	}
+}
+
+func TestFindNeighborAddresses(t *testing.T) {
+	neighbors := ReadNeighborFixture(t, "ip-neigh.txt", ParseIPNeigh)
+
+	bridged, _ := net.ParseMAC("00:0c:29:f7:07:f2")
+	missing, _ := net.ParseMAC("00:0c:29:f7:07:06")
+	macs := map[string]net.HardwareAddr{
+		"ethernet0": bridged,
+		"ethernet1": missing,
+	}
+
+	addresses := FindNeighborAddresses(macs, neighbors)
+	if len(addresses) != 2 {
+		t.Fatalf("Expected 2 addresses, found %v", addresses)
+	}
+	if addresses[0].Interface != "ethernet0" || addresses[0].IP.String() != "192.168.1.20" {
+		t.Errorf("Expected ethernet0's IPv4 address first, found %+v", addresses[0])
+	}
+	if addresses[1].IP.String() != "fe80::20c:29ff:fef7:7f2" {
+		t.Errorf("Expected ethernet0's IPv6 address second, found %+v", addresses[1])
+	}
+}
+
+func TestSubnetHosts(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.1.0/24")
+	subnet.IP = net.ParseIP("192.168.1.20")
+
+	hosts := SubnetHosts(subnet)
+	if len(hosts) != 253 {
+		t.Fatalf("Expected 253 hosts, found %d", len(hosts))
+	}
+	if hosts[0].String() != "192.168.1.1" || hosts[252].String() != "192.168.1.254" {
+		t.Errorf("Unexpected range %s - %s", hosts[0], hosts[252])
+	}
+	for _, host := range hosts {
+		if host.String() == "192.168.1.20" {
+			t.Error("Expected the host's own address to be skipped")
+		}
+	}
+
+	// Large networks are narrowed to the /24 around the host
+	_, subnet, _ = net.ParseCIDR("10.0.0.0/8")
+	subnet.IP = net.ParseIP("10.1.2.3")
+	hosts = SubnetHosts(subnet)
+	if len(hosts) != 253 || hosts[0].String() != "10.1.2.1" {
+		t.Errorf("Expected 10.1.2.0/24, found %d hosts from %s", len(hosts), hosts[0])
+	}
+}
@@ -3,4 +3,12 @@ package vmware
 const (
 	NetworkConfigFile = "/Library/Preferences/VMware Fusion/networking"
 	DHCPLeasesFile    = "/private/var/db/vmware/vmnet-dhcpd-vmnet%d.leases"
+	DHCPConfigFile    = "/Library/Preferences/VMware Fusion/vmnet%d/dhcpd.conf"
+	NATConfigFile     = "/Library/Preferences/VMware Fusion/vmnet%d/nat.conf"
 )
+
+// NATRestartCommands restart VMware's NAT service after nat.conf changes
+var NATRestartCommands = [][]string{
+	{"/Applications/VMware Fusion.app/Contents/Library/vmnet-cli", "--stop"},
+	{"/Applications/VMware Fusion.app/Contents/Library/vmnet-cli", "--start"},
+}
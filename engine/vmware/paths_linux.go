@@ -3,4 +3,12 @@ package vmware
 const (
 	NetworkConfigFile = "/etc/vmware/networking"
 	DHCPLeasesFile    = "/etc/vmware/vmnet%d/dhcpd/dhcpd.leases"
+	DHCPConfigFile    = "/etc/vmware/vmnet%d/dhcpd/dhcpd.conf"
+	NATConfigFile     = "/etc/vmware/vmnet%d/nat/nat.conf"
 )
+
+// NATRestartCommands restart VMware's NAT service after nat.conf changes
+var NATRestartCommands = [][]string{
+	{"vmware-networks", "--stop"},
+	{"vmware-networks", "--start"},
+}
@@ -3,4 +3,12 @@ package vmware
 const (
 	NetworkConfigFile = "UNKNOWNPATH"
 	DHCPLeasesFile    = "UNKNOWNPATH/vmnet%d/dhcpd/dhcpd.leases"
+	DHCPConfigFile    = "UNKNOWNPATH/vmnet%d/dhcpd/dhcpd.conf"
+	NATConfigFile     = "UNKNOWNPATH/vmnet%d/nat/nat.conf"
 )
+
+// NATRestartCommands restart VMware's NAT service after nat.conf changes
+var NATRestartCommands = [][]string{
+	{"net", "stop", "VMware NAT Service"},
+	{"net", "start", "VMware NAT Service"},
+}
@@ -2,8 +2,12 @@ package vmware
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -11,20 +15,50 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cbednarski/lovm/core"
+	"github.com/cbednarski/lovm/engine/vmware/vmx"
 )
 
 // Note: See paths* for platform-specific constants
 const (
 	DHCPDateFormat = `2006/01/02 15:04:05`
 	Identifier     = "vmware"
+	SnapshotName   = `lovm-clone`
+
+	// MaxNICs is the number of network adapters a VMware VM can have
+	MaxNICs = 10
+
+	// DefaultVirtualDev is the network adapter hardware we use when we add
+	// one to a VM that doesn't have any
+	DefaultVirtualDev = "e1000"
+
+	// Resolvers for SSHConfig.IPResolvers. See VMware.Addresses.
+	ResolverStatic     = "static"
+	ResolverLeases     = "leases"
+	ResolverGuestTools = "guest-tools"
+	ResolverARP        = "arp"
+
+	// GuestIPTimeout is how long the guest-tools resolver waits for VMware
+	// Tools to report the guest's IP address
+	GuestIPTimeout = 10 * time.Second
+
+	// ToolsTimeout is how long Start will wait for VMware Tools to come up in
+	// the guest before it gives up on re-applying shared folders.
+	ToolsTimeout = 2 * time.Minute
 )
 
 var (
+	// DefaultResolvers is the order Addresses tries the resolvers in, unless
+	// SSHConfig.IPResolvers says otherwise. Static addresses come first since
+	// they don't need the guest to be up yet, and the ARP table comes last
+	// since it can be stale.
+	DefaultResolvers = []string{ResolverStatic, ResolverLeases, ResolverGuestTools, ResolverARP}
+
 	// ErrNotFound is returned when we were unable to find an IP or MAC address.
 	// This error is returned in different contexts, but should never be bubbled
 	// up. If a function indicates it may return ErrNotFound always check the
@@ -33,12 +67,16 @@ var (
 	ErrLeaseNotFound     = errors.New("no active lease found")
 	ErrInterfaceNotFound = errors.New("no interface found")
 	ErrIPNotFound        = errors.New("no IP address found")
-	reGeneratedAddress   = regexp.MustCompile(`(ethernet\d+)\.generatedAddress ?= ?"([0-9a-fA-F:]+)"`)
+	ErrToolsNotRunning   = errors.New("VMware Tools is not running in the guest")
+	ErrNoGuestLogin      = errors.New("guest operations require a login and password; set guest-config in " + core.MachineFile)
+	reDHCPHost           = regexp.MustCompile(`host\s+[^\s{]+\s*\{([^}]*)\}`)
+	reDHCPHardware       = regexp.MustCompile(`hardware\s+ethernet\s+([0-9a-fA-F:]+)\s*;`)
+	reDHCPFixedAddress   = regexp.MustCompile(`fixed-address\s+([^\s,;]+)`)
 	reNetworkingConfig   = regexp.MustCompile(`answer VNET_(\d+)_DHCP yes`)
-	reDHCPLeases         = regexp.MustCompile(`lease ([0-9\.]+) {\s+` +
-		`starts [0-9]+ ([0-9/: ]+);\s+` +
-		`ends [0-9]+ ([0-9/: ]+);\s+` +
-		`hardware ethernet ([0-9a-f:]+);\s+`)
+	reNATNetwork         = regexp.MustCompile(`answer VNET_(\d+)_NAT yes`)
+	reNATIncoming        = regexp.MustCompile(`^(\d+)\s*=`)
+	reVMNet              = regexp.MustCompile(`^vmnet\d+$`)
+	reHostInterface      = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
 )
 
 type VMware struct {
@@ -118,24 +156,22 @@ func (v *VMware) Clone(source string) error {
 
 	args := []string{"clone", source, target, "linked"}
 
-	if snapshot != "" {
+	if snapshot == "" {
+		// A linked clone has to be made from a powered-off snapshot. If we
+		// clone the source directly, VMware either refuses because it is
+		// running, or makes a new snapshot behind our back each time, so
+		// we'll make our own if the user didn't specify anything.
+		if err := CreateSnapshot(source); err != nil {
+			return err
+		}
+
+		// We're going to use the special snapshot but we do not write it into
+		// the config struct because the user did not explicitly specify it.
+		args = append(args, fmt.Sprintf(`-snapshot=%s`, SnapshotName))
+	} else {
 		args = append(args, fmt.Sprintf(`-snapshot=%s`, snapshot))
 	}
 
-	// TODO before we clone we need to make a snapshot while the source is in a
-	//  powered-off state. So we also need to check whether the source is
-	//  powered off at the time. If we don't do this, one of two things will
-	//  happen:
-	//  1. Clone will fail because the VM we're trying to clone is powered on
-	//  2. We'll end up with a bunch of junk clones since a new one is created
-	//     each time we clone the source again. This seems to be a linked clone
-	//     issue specifically.
-	//  The simple solution is to create our own powered-off snapshot called
-	//  "lovm" and use this as the basis for the other stuff we're doing. Once
-	//  we verify the lovm snapshot exists we can do whatever we want. If the
-	//  user creates a bad one we'll just fall back on normal error handling and
-	//  tell them to fix it.
-
 	cmd := exec.Command("vmrun", args...)
 
 	out, err := cmd.CombinedOutput()
@@ -180,15 +216,32 @@ func (v *VMware) Start() error {
 		return err
 	}
 
+	// VMware reads the hardware from the vmx file when the VM powers on, so
+	// this has to come first. If it's already running or suspended the
+	// changes will wait until it's stopped and started again.
+	if err := v.Configure(); err != nil && err != core.ErrNotStopped {
+		return err
+	}
+
 	cmd := exec.Command("vmrun", "start", v.Config.Path, "nogui")
 
 	out, err := cmd.CombinedOutput()
 
 	if err != nil {
 		core.CommandError(cmd, out)
+		return err
 	}
 
-	return err
+	// Shared folders need to be enabled every time the VM boots, but VMware
+	// Tools won't be running right away so we need to wait for it.
+	if len(v.Config.Mounts) > 0 {
+		if err := v.WaitForTools(ToolsTimeout); err != nil {
+			return err
+		}
+		return v.Mount()
+	}
+
+	return nil
 }
 
 // Stop performs a hard stop on the virtual machine. If the machine is already
@@ -215,6 +268,48 @@ func (v *VMware) Stop() error {
 	return err
 }
 
+// Suspend saves the virtual machine's memory to disk and stops it. We use a
+// hard suspend so we don't wait on VMware Tools to run suspend scripts in the
+// guest. If the machine is not running it reports success.
+func (v *VMware) Suspend() error {
+	running, err := v.Running()
+	if err != nil {
+		return err
+	}
+	if !running {
+		return nil
+	}
+
+	cmd := exec.Command("vmrun", "suspend", v.Config.Path, "hard")
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// Resume starts a suspended virtual machine. vmrun start picks up where the
+// machine left off, so this is the same as Start except that we refuse to
+// boot a machine that was stopped.
+func (v *VMware) Resume() error {
+	state, err := v.State()
+	if err != nil {
+		return err
+	}
+
+	switch state {
+	case core.StateRunning:
+		return nil
+	case core.StateSuspended:
+		return v.Start()
+	}
+
+	return core.ErrNotSuspended
+}
+
 // Restart performs a hard stop and then starts the virtual machine again. If
 // the machine is already stopped, it will be started.
 func (v *VMware) Restart() error {
@@ -227,9 +322,33 @@ func (v *VMware) Restart() error {
 	return nil
 }
 
-// IP returns the first IP address associated with the virtual machine. There
-// may be more than one. Multiple IPs is currently unhandled / undefined behavior.
+// IP returns the first address from Addresses. If SSHConfig.NetworkInterface
+// is set (e.g. ethernet1) only that interface is considered.
 func (v *VMware) IP() (net.IP, error) {
+	addresses, err := v.Addresses()
+	if err != nil {
+		return nil, err
+	}
+
+	// The user specified a specific network interface name in their SSH config
+	// so we'll only use an IP address for that one
+	if name := v.Config.SSH.NetworkInterface; name != "" {
+		if _, err := FindMACAddressByName(v.Config.Path, name); err != nil {
+			return nil, err
+		}
+		addresses = core.FilterAddresses(addresses, name)
+	}
+
+	if len(addresses) == 0 {
+		return nil, ErrIPNotFound
+	}
+
+	return addresses[0].IP, nil
+}
+
+// Addresses returns the IP addresses of each of the VM's network interfaces,
+// sorted by interface name.
+func (v *VMware) Addresses() ([]core.Address, error) {
 	// The following networking concepts will be useful for understanding the
 	// implementation which detects the VM's IP address(es). VMware Workstation
 	// can create bridged, NATed, or host-only networks, and manages DHCP. Also
@@ -307,67 +426,320 @@ func (v *VMware) IP() (net.IP, error) {
 	// So, after that very long explanation, here's what we're going to do:
 	//
 	// 1. Inspect the vmx file for any mac addresses and network interfaces.
-	// 2. Identify any static IP configuration in the vmx file
-	// 3. Inspect /etc/vmware/networking to see which networks are configured
-	//    with DHCP
-	// 4. Inspect each /etc/vmware/vmnet*/dhcpd/dhcpd.leases to find active
-	//    leases that match our mac address(es)
+	// 2. Try each resolver in SSHConfig.IPResolvers (or DefaultResolvers), in
+	//    order, for the interfaces the ones before it didn't find:
+	//    - static: identify fixed-address reservations in
+	//      /etc/vmware/vmnet*/dhcpd/dhcpd.conf for the networks
+	//      /etc/vmware/networking configures with DHCP
+	//    - leases: inspect each /etc/vmware/vmnet*/dhcpd/dhcpd.leases to find
+	//      active leases that match our mac address(es)
+	//    - guest-tools: ask VMware Tools in the guest, with vmrun
+	//      getGuestIPAddress
+	//    - arp: look for our mac address(es) in the host's neighbor (ARP)
+	//      table. This is how we find VMs on bridged networks.
 	//
-	// Depending on the particulars, we may not need to do all four steps. For
-	// example, if a VM has only one IP and it's statically defined, we don't
-	// need to query DHCP.
+	// Depending on the particulars, we may not need all of them. For example,
+	// if a VM has only one IP and it's reserved, we don't need to look for
+	// its lease. If a resolver fails, e.g. because a lease file can't be read
+	// or VMware moved it, we carry on with the next one. lovm ip --explain
+	// shows what each of them did.
 	//
-	// It's also technically possible to assign a static IP to a VM by editing
-	// the vmnet DHCP configuration in e.g. /etc/vmware/vmnet8/dhcpd/dhcpd.conf.
-	// In my experience this is not a common way to do things, so lovm does not
-	// currently support it.
+	// It's also possible to assign a static IP to a VM by editing the vmnet
+	// DHCP configuration in e.g. /etc/vmware/vmnet8/dhcpd/dhcpd.conf. This is
+	// handy for long-lived VMs, since the reservation doesn't expire like a
+	// lease does, and an interface with a reservation doesn't need to wait for
+	// a lease.
+	//
+	// Bridged networks are the odd one out, since their addresses are handed
+	// out by the local network and VMware doesn't know them. The host only
+	// knows the VM's MAC address if it has talked to it recently, so if
+	// SSHConfig.PingSweep is set we nudge every address on the host's
+	// networks to fill in the neighbor table, and look again.
 	//
 	// References:
 	// - ps aux | grep vmnet
 	// - https://www.vmware.com/support/ws55/doc/ws_net_advanced_ipaddress.html
 
-	// TODO (currently unhandled cases)
-	//  - handle static IPs -- ReadIPAddressesFromVMX
-	//  - handle static IPs assigned in dhcpd.conf
-	//  - handle bridged networks -- these are assigned by the local network,
-	//    not vmnet DHCP, but there may be a way to correlate the virtual
-	//    ethernet device with a host address in ifconfig / ip addr
-	//  - handle multiple IPs -- ...?
+	addresses, _, err := v.ExplainAddresses()
+	return addresses, err
+}
 
-	var macs map[string]net.HardwareAddr
-	var err error
+// ExplainAddresses runs the resolvers like Addresses, and also reports what
+// each of them found, or why it failed, for lovm ip --explain
+func (v *VMware) ExplainAddresses() ([]core.Address, []core.Resolution, error) {
+	resolvers, err := v.Resolvers()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// The user specified a specific network interface name in their SSH config
-	// we'll attempt to find an IP address for that one (only)
-	if v.Config.SSH.NetworkInterface != "" {
-		mac, err := FindMACAddressByName(v.Config.Path, v.Config.SSH.NetworkInterface)
-		if err != nil {
+	macs, err := ReadMACAdressesFromVMX(v.Config.Path)
+	if err == ErrInterfaceNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var addresses []core.Address
+	var resolutions []core.Resolution
+	for _, resolver := range resolvers {
+		if len(macs) == 0 {
+			break
+		}
+
+		found, err := v.resolve(resolver, macs, addresses)
+		resolutions = append(resolutions, core.Resolution{
+			Resolver: resolver,
+			Found:    found,
+			Err:      err,
+		})
+
+		for _, addr := range found {
+			delete(macs, addr.Interface)
+		}
+		addresses = append(addresses, found...)
+	}
+
+	// The MACs come from a map, so sort them to give the same answer every
+	// time
+	core.SortAddresses(addresses)
+
+	return addresses, resolutions, nil
+}
+
+// Resolvers returns the resolvers Addresses will use, in order. If any of the
+// names in SSHConfig.IPResolvers are unknown it returns an error.
+func (v *VMware) Resolvers() ([]string, error) {
+	if len(v.Config.SSH.IPResolvers) == 0 {
+		return DefaultResolvers, nil
+	}
+
+	for _, resolver := range v.Config.SSH.IPResolvers {
+		known := false
+		for _, name := range DefaultResolvers {
+			known = known || resolver == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown ip-resolvers entry %q; expected one of %s",
+				resolver, strings.Join(DefaultResolvers, ", "))
+		}
+	}
+
+	return v.Config.SSH.IPResolvers, nil
+}
+
+// resolve runs the resolver for the interfaces in macs. found lists the
+// addresses the resolvers before it found.
+func (v *VMware) resolve(resolver string, macs map[string]net.HardwareAddr, found []core.Address) ([]core.Address, error) {
+	switch resolver {
+	case ResolverStatic:
+		return FindStaticAddresses(NetworkConfigFile, DHCPConfigFile, macs)
+	case ResolverLeases:
+		return FindLeaseAddresses(NetworkConfigFile, DHCPLeasesFile, macs)
+	case ResolverGuestTools:
+		return v.findGuestToolsAddress(macs, found)
+	case ResolverARP:
+		return v.findNeighborAddresses(macs)
+	}
+	return nil, fmt.Errorf("unknown resolver %q", resolver)
+}
+
+// findGuestToolsAddress asks VMware Tools for the guest's address. vmrun only
+// reports one address, and doesn't say which interface it belongs to. See
+// GuestToolsAddress.
+func (v *VMware) findGuestToolsAddress(macs map[string]net.HardwareAddr, found []core.Address) ([]core.Address, error) {
+	running, err := v.Running()
+	if err != nil {
+		return nil, err
+	}
+	if !running {
+		return nil, core.ErrNotRunning
+	}
+
+	ip, err := v.GuestIPAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := GuestToolsAddress(ip, macs, found)
+	if err != nil {
+		return nil, err
+	}
+	return []core.Address{addr}, nil
+}
+
+// GuestToolsAddress works out which interface the address VMware Tools
+// reported belongs to. If another resolver already found it we skip it, and
+// otherwise we can only tell if there's just one interface left to find. In
+// either case the error says why, for lovm ip --explain.
+func GuestToolsAddress(ip net.IP, macs map[string]net.HardwareAddr, found []core.Address) (core.Address, error) {
+	for _, addr := range found {
+		if addr.IP.Equal(ip) {
+			return core.Address{}, fmt.Errorf("VMware Tools reported %s, which %s already has", ip, addr.Interface)
+		}
+	}
+
+	var names []string
+	for name := range macs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) != 1 {
+		return core.Address{}, fmt.Errorf("VMware Tools reported %s, but not which of %s it belongs to",
+			ip, strings.Join(names, ", "))
+	}
+
+	return core.Address{
+		Interface: names[0],
+		MAC:       macs[names[0]].String(),
+		IP:        ip,
+		Source:    core.SourceGuestTools,
+	}, nil
+}
+
+// findNeighborAddresses looks for the interfaces in the host's neighbor table,
+// sweeping the host's networks first if it has to and SSHConfig.PingSweep is
+// set
+func (v *VMware) findNeighborAddresses(macs map[string]net.HardwareAddr) ([]core.Address, error) {
+	neighbors, err := ReadNeighbors()
+	if err != nil {
+		return nil, err
+	}
+	found := FindNeighborAddresses(macs, neighbors)
+
+	if len(found) == 0 && v.Config.SSH.PingSweep {
+		if err := SweepBridgedSubnets(); err != nil {
 			return nil, err
 		}
-		macs[v.Config.SSH.NetworkInterface] = mac
-	} else {
-		macs, err = ReadMACAdressesFromVMX(v.Config.Path)
-		if err != nil {
+		if neighbors, err = ReadNeighbors(); err != nil {
 			return nil, err
 		}
+		found = FindNeighborAddresses(macs, neighbors)
 	}
 
-	for _, mac := range macs {
-		ip, err := DetectIPFromMACAddress(NetworkConfigFile, DHCPLeasesFile, mac)
-		switch err {
-		case nil:
-			// We found an ip. We're returning now, though there could be others
-			return ip, nil
-		case ErrIPNotFound:
-			// Could not find an ip address for this MAC, try the next one
+	return found, nil
+}
+
+// GuestIPAddress asks VMware Tools in the guest for its IP address. vmrun
+// getGuestIPAddress -wait waits for the guest to report one, which could be
+// forever if the tools aren't installed, so we give up after GuestIPTimeout.
+func (v *VMware) GuestIPAddress() (net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), GuestIPTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "vmrun", "getGuestIPAddress", v.Config.Path, "-wait")
+
+	// We don't use core.CommandError here because this is expected to fail
+	// when the guest doesn't have VMware Tools, and lovm ip --explain will
+	// show the error
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, ErrToolsNotRunning
+	}
+	if err != nil {
+		return nil, fmt.Errorf("vmrun getGuestIPAddress failed: %s", strings.TrimSpace(string(out)))
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(out)))
+	if ip == nil {
+		return nil, fmt.Errorf("unexpected output from vmrun getGuestIPAddress: %q", out)
+	}
+
+	return ip, nil
+}
+
+// FindStaticAddresses finds the interfaces with a fixed-address reservation
+// in the DHCP configuration of one of the DHCP networks (see
+// ReadDHCPReservations). VMware doesn't have a way to give a VM a static IP
+// address itself, so this is how it's done.
+//
+// The dhcpConfigFile argument is a parameterized path, like DHCPConfigFile.
+// If reading the DHCP configuration fails, the addresses found so far are
+// returned along with the error.
+func FindStaticAddresses(networkConfigFile, dhcpConfigFile string, macs map[string]net.HardwareAddr) ([]core.Address, error) {
+	networks, err := ListDHCPVirtualNetworks(networkConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []core.Address
+	for _, netID := range networks {
+		reservations, err := ReadDHCPReservations(dhcpConfigFile, netID)
+		if os.IsNotExist(err) {
 			continue
-		default:
-			// Something weird happened, return to the user
-			return nil, err
+		}
+		if err != nil {
+			return addresses, err
+		}
+
+		for name, mac := range macs {
+			if ip, ok := reservations[mac.String()]; ok {
+				addresses = append(addresses, core.Address{
+					Interface: name,
+					MAC:       mac.String(),
+					IP:        ip,
+					Network:   fmt.Sprintf("vmnet%d", netID),
+					Source:    core.SourceStatic,
+				})
+			}
 		}
 	}
 
-	return nil, ErrIPNotFound
+	core.SortAddresses(addresses)
+
+	return addresses, nil
+}
+
+// FindLeaseAddresses finds the interfaces with an active lease in the lease
+// table of one of the DHCP networks.
+//
+// The dhcpLeasesFile argument is a parameterized path, like DHCPLeasesFile.
+// If a lease table can't be read we try the others, and return the addresses
+// we found along with the first error.
+func FindLeaseAddresses(networkConfigFile, dhcpLeasesFile string, macs map[string]net.HardwareAddr) ([]core.Address, error) {
+	networks, err := ListDHCPVirtualNetworks(networkConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []core.Address
+	var firstErr error
+
+networks:
+	for _, netID := range networks {
+		for name, mac := range macs {
+			ip, err := FindCurrentLeaseByMAC(dhcpLeasesFile, netID, mac)
+			switch {
+			case err == nil:
+				addresses = append(addresses, core.Address{
+					Interface: name,
+					MAC:       mac.String(),
+					IP:        ip,
+					Network:   fmt.Sprintf("vmnet%d", netID),
+					Source:    core.SourceDHCP,
+				})
+			case errors.Is(err, ErrLeaseNotFound):
+				// We don't expect to find a lease in every network, but if
+				// some leases were skipped we say so
+				if err != ErrLeaseNotFound && firstErr == nil {
+					firstErr = err
+				}
+				continue
+			default:
+				// The lease table is the same for every MAC, so skip to the
+				// next network
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue networks
+			}
+		}
+	}
+
+	core.SortAddresses(addresses)
+
+	return addresses, firstErr
 }
 
 // Delete first checks that the virtual machine is stopped, and then deletes it.
@@ -397,176 +769,1159 @@ func (v *VMware) Delete() error {
 	// Remove the machine path because we don't have a VM anymore
 	if err == nil {
 		v.Config.Path = ""
+		err = core.ClearKnownHosts()
 	}
 
 	return err
 }
 
-// TODO implement Mount
+// Mount adds a shared folder for each entry in MachineConfig.Mounts and mounts
+// it at the requested path in the guest. Shares that are already configured
+// are left alone, so this is safe to call repeatedly.
+//
+// Shared folders are a runtime feature, so if the VM is not running we don't
+// do anything here. Start will call Mount again once the VM is up.
+//
+// In the guest, the share is mounted with vmhgfs-fuse, which is included with
+// open-vm-tools. This is done via guest operations, which requires the login
+// and password configured in GuestConfig.
 func (v *VMware) Mount() error {
-	// TODO check guest tools status because shared folders don't work without
-	//  those
-	return core.ErrNotImplemented
-}
+	if len(v.Config.Mounts) == 0 {
+		return nil
+	}
 
-// ReadMACAddressesFromVMX identifies both the configured interface name
-// (e.g. ethernet0) and MAC address for each network interface attached to the
-// virtual machine.
-func ReadMACAdressesFromVMX(path string) (map[string]net.HardwareAddr, error) {
-	macs := map[string]net.HardwareAddr{}
-	// example from vmx file:
-	// ethernet0.generatedAddress = "00:0c:29:05:6f:e3"
-	data, err := ioutil.ReadFile(path)
+	running, err := v.Running()
 	if err != nil {
-		return macs, err
+		return err
+	}
+	if !running {
+		return nil
 	}
 
-	matches := reGeneratedAddress.FindAllStringSubmatch(string(data), -1)
+	state, err := v.ToolsState()
+	if err != nil {
+		return err
+	}
+	if state != "running" {
+		return ErrToolsNotRunning
+	}
 
-	for _, match := range matches {
-		mac, err := net.ParseMAC(match[2])
-		if err != nil {
-			log.Printf("error parsing mac address %q from %q: %s\n", match[2], path, err)
-			continue
-		}
-		macs[match[1]] = mac
+	cmd := exec.Command("vmrun", "enableSharedFolders", v.Config.Path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return err
 	}
 
-	if len(macs) == 0 {
-		return nil, ErrInterfaceNotFound
+	shares, err := ReadSharedFoldersFromVMX(v.Config.Path)
+	if err != nil {
+		return err
 	}
 
-	return macs, nil
+	for hostPath, guestPath := range v.Config.Mounts {
+		name := core.ShareName(guestPath)
+
+		// addSharedFolder fails if the name is already in use, so if the share
+		// exists we only need to update the host path if it has changed.
+		var args []string
+		existing, ok := shares[name]
+		switch {
+		case !ok:
+			args = []string{"addSharedFolder", v.Config.Path, name, hostPath}
+		case existing != hostPath:
+			args = []string{"setSharedFolderState", v.Config.Path, name, hostPath, "writable"}
+		}
+
+		if args != nil {
+			cmd := exec.Command("vmrun", args...)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				core.CommandError(cmd, out)
+				return err
+			}
+		}
+
+		if err := v.MountInGuest(name, guestPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func FindMACAddressByName(path, name string) (net.HardwareAddr, error) {
-	macs, err := ReadMACAdressesFromVMX(path)
+// Configure edits the vmx file to match MachineConfig's CPUs, Memory and
+// Networks (see ConfigureVMX). The file is only written if something changed,
+// and only while the VM is stopped, since VMware overwrites it otherwise.
+func (v *VMware) Configure() error {
+	if !v.Found() || !v.Config.HasHardware() {
+		return nil
+	}
+
+	doc, err := vmx.ReadFile(v.Config.Path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if mac, ok := macs[name]; ok {
-		return mac, nil
+	before := doc.Bytes()
+	if err := ConfigureVMX(doc, v.Config); err != nil {
+		return err
+	}
+	if bytes.Equal(before, doc.Bytes()) {
+		return nil
 	}
 
-	return nil, ErrInterfaceNotFound
+	state, err := v.State()
+	if err != nil {
+		return err
+	}
+	if state != core.StateStopped {
+		return core.ErrNotStopped
+	}
+
+	return doc.WriteFile(v.Config.Path)
 }
 
-// ListDHCPVirtualNetworks inspects VMware's networking configuration to find a
-// list of virtual networks that have DHCP enabled. This includes NAT and host-
-// only networks, but not bridged networks, because DHCP for bridged interfaces
-// is managed by the host's local network instead.
-func ListDHCPVirtualNetworks(path string) ([]int, error) {
-	// example networking config
-	//
-	// $ cat /etc/vmware/networking
-	//
-	// VERSION=1,0
-	// answer VNET_1_DHCP yes
-	// ...
-	// answer VNET_8_DHCP yes
-	// ...
-	var networks []int
+// Forward adds MachineConfig.Forwards to the [incomingtcp] section of
+// nat.conf for the VM's NAT network, so VMware's NAT service forwards the host
+// ports to the VM. Each of our entries is marked with a comment naming the
+// VMX file, so we can replace them later without touching anything else.
+//
+// nat.conf forwards to an IP address rather than a VM, so the VM needs a DHCP
+// lease on the NAT network, and the entries need to be updated if the lease
+// changes. Run lovm forward again if that happens.
+//
+// nat.conf can only be changed by root, and VMware's NAT service has to be
+// restarted to pick up the changes, which interrupts every VM's network. So
+// if our entries are already up to date we don't touch either of them. If the
+// VM has no NAT network we return ErrNotImplemented.
+//
+// VMware's NAT service listens on every host interface, not just 127.0.0.1,
+// so the ports can be reached from other machines. Unless ExposeForwards is
+// set we only remove our old entries and return core.ErrForwardPublic, so lovm
+// forward uses its proxy instead.
+func (v *VMware) Forward() error {
+	if !v.Found() {
+		return nil
+	}
 
-	data, err := ioutil.ReadFile(path)
+	name, mac, network, err := FindNATInterface(v.Config.Path, NetworkConfigFile)
+	if err == ErrInterfaceNotFound {
+		return core.ErrNotImplemented
+	}
 	if err != nil {
-		return networks, err
+		return err
 	}
 
-	matches := reNetworkingConfig.FindAllStringSubmatch(string(data), -1)
+	forwards := v.Config.Forwards
+	if !v.Config.ExposeForwards {
+		forwards = nil
+	}
 
-	for _, match := range matches {
-		netID, err := strconv.ParseInt(match[1], 10, 0)
+	var ip net.IP
+	if len(forwards) > 0 {
+		ip, err = FindCurrentLeaseByMAC(DHCPLeasesFile, network, mac)
+		if err == ErrLeaseNotFound {
+			return fmt.Errorf("no DHCP lease found for %s; start the VM first", name)
+		}
 		if err != nil {
-			log.Printf("unexpected number format %q", match[1])
-			continue
+			return err
 		}
-		networks = append(networks, int(netID))
 	}
 
-	return networks, nil
-}
-
-// FindCurrentLeaseByMAC searches the specified DHCP lease table for an active
-// lease assigned to the specified MAC address, and returns the IP address.
+	path := fmt.Sprintf(NATConfigFile, network)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	updated, err := UpdateNATConfig(data, v.Config.Path, ip, forwards)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(data, updated) {
+		if err := ioutil.WriteFile(path, updated, 0644); err != nil {
+			if os.IsPermission(err) {
+				return fmt.Errorf("unable to update %s; VMware's NAT "+
+					"configuration can only be changed by root", path)
+			}
+			return err
+		}
+		if err := RestartNAT(); err != nil {
+			return err
+		}
+	}
+
+	if len(v.Config.Forwards) > 0 && !v.Config.ExposeForwards {
+		return core.ErrForwardPublic
+	}
+	return nil
+}
+
+// PublicForwards returns true, since VMware's NAT service listens on every
+// host interface. See core.PublicForwarder.
+func (v *VMware) PublicForwards() bool {
+	return true
+}
+
+// RestartNAT restarts VMware's NAT service so it reads nat.conf again. This
+// interrupts the network connections of every VM on the host for a moment.
+func RestartNAT() error {
+	for _, args := range NATRestartCommands {
+		cmd := exec.Command(args[0], args[1:]...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			core.CommandError(cmd, out)
+			return err
+		}
+	}
+	return nil
+}
+
+// MountInGuest creates the mount point in the guest and mounts the named
+// shared folder there, unless something is already mounted at that path.
+func (v *VMware) MountInGuest(name, guestPath string) error {
+	cmd, err := v.GuestCommand("directoryExistsInGuest", v.Config.Path, guestPath)
+	if err != nil {
+		return err
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return err
+	}
+
+	if !bytes.Contains(out, []byte("The directory exists")) {
+		cmd, err := v.GuestCommand("createDirectoryInGuest", v.Config.Path, guestPath)
+		if err != nil {
+			return err
+		}
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			core.CommandError(cmd, out)
+			return err
+		}
+	}
+
+	script := fmt.Sprintf(`mountpoint -q %[2]s || vmhgfs-fuse %[1]s %[2]s -o allow_other`,
+		core.ShellQuote(".host:/"+name), core.ShellQuote(guestPath))
+
+	cmd, err = v.GuestCommand("runProgramInGuest", v.Config.Path, "/bin/sh", "-c", script)
+	if err != nil {
+		return err
+	}
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return fmt.Errorf("failed to mount %q in the guest at %q; the "+
+			"guest login must be allowed to mount filesystems", name, guestPath)
+	}
+
+	return nil
+}
+
+// GuestCommand builds a vmrun command that authenticates with the guest OS.
+// These are needed for any of the vmrun commands that operate inside the
+// guest, like runProgramInGuest.
 //
-// The path argument should be a parameterized path to the DHCP leases file on
-// this system. See DHCPLeasesFile as an example.
+// vmrun only takes the guest password on the command line, so while the
+// command runs, other users on the host can see it with ps. Use a guest
+// account that doesn't matter much.
+func (v *VMware) GuestCommand(args ...string) (*exec.Cmd, error) {
+	login := v.Config.GuestLogin()
+	if login == "" || v.Config.Guest.Password == "" {
+		return nil, ErrNoGuestLogin
+	}
+
+	args = append([]string{"-gu", login, "-gp", v.Config.Guest.Password}, args...)
+
+	return exec.Command("vmrun", args...), nil
+}
+
+// guestOperation runs a vmrun guest operation (see GuestCommand) against the
+// VM, after making sure VMware Tools is running.
+func (v *VMware) guestOperation(operation string, args ...string) error {
+	state, err := v.ToolsState()
+	if err != nil {
+		return err
+	}
+	if state != "running" {
+		return ErrToolsNotRunning
+	}
+
+	cmd, err := v.GuestCommand(append([]string{operation, v.Config.Path}, args...)...)
+	if err != nil {
+		return err
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// UploadFile copies a single file into the guest. See core.GuestChannel
+func (v *VMware) UploadFile(hostPath, guestPath string) error {
+	return v.guestOperation("copyFileFromHostToGuest", hostPath, guestPath)
+}
+
+// DownloadFile copies a single file out of the guest. See core.GuestChannel
+func (v *VMware) DownloadFile(guestPath, hostPath string) error {
+	return v.guestOperation("copyFileFromGuestToHost", guestPath, hostPath)
+}
+
+// RunShell runs a script in the guest. See core.GuestChannel
+func (v *VMware) RunShell(script string) error {
+	return v.guestOperation("runProgramInGuest", "/bin/sh", "-c", script)
+}
+
+// CopyToGuest copies files into the guest using VMware Tools. Like Mount this
+// needs the guest login and password from GuestConfig.
+func (v *VMware) CopyToGuest(hostPath, guestPath string) error {
+	return core.CopyToGuest(v, hostPath, guestPath)
+}
+
+// CopyFromGuest copies files out of the guest using VMware Tools
+func (v *VMware) CopyFromGuest(guestPath, hostPath string) error {
+	return core.CopyFromGuest(v, guestPath, hostPath)
+}
+
+// execScript runs the user's script (1) in the guest, saving stdout, stderr
+// and the exit code to files starting with (2), since vmrun can't give them
+// to us directly.
+const execScript = `(%[1]s) >%[2]s.out 2>%[2]s.err; echo $? >%[2]s.rc`
+
+// Exec runs the script in the guest using VMware Tools. vmrun does not pass
+// on the output or exit code of programs in the guest, so we save them to
+// files and copy them back when the script is done. This means you won't see
+// any output until then. Like Mount this needs the guest login and password
+// from GuestConfig.
+func (v *VMware) Exec(script string, stdout, stderr io.Writer) (int, error) {
+	base := core.GuestTempFile("exec")
+	defer v.RunShell("rm -f " + base + ".out " + base + ".err " + base + ".rc")
+
+	if err := v.RunShell(fmt.Sprintf(execScript, script, base)); err != nil {
+		return 0, err
+	}
+
+	dir, err := ioutil.TempDir("", "lovm-exec")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	results := map[string][]byte{}
+	for _, ext := range []string{"out", "err", "rc"} {
+		file := filepath.Join(dir, ext)
+		if err := v.DownloadFile(base+"."+ext, file); err != nil {
+			return 0, err
+		}
+		if results[ext], err = ioutil.ReadFile(file); err != nil {
+			return 0, err
+		}
+	}
+
+	stdout.Write(results["out"])
+	stderr.Write(results["err"])
+
+	code, err := strconv.Atoi(strings.TrimSpace(string(results["rc"])))
+	if err != nil {
+		return 0, fmt.Errorf("unable to read the exit code from the guest: %s", err)
+	}
+	return code, nil
+}
+
+// InstallSSHKey installs the key with VMware Tools if the VM is running, using
+// the login and password from GuestConfig.
 //
-// If no valid lease can be found, returns ErrNotFound.
-func FindCurrentLeaseByMAC(path string, netID int, addr net.HardwareAddr) (net.IP, error) {
-	// example DHCP lease file
-	//
-	// $ cat /etc/vmware/vmnet8/dhcpd/dhcpd.leases
-	//
-	// lease 172.16.23.128 {
-	//   starts 2 2019/04/02 01:05:48;
-	//   ends 2 2019/04/02 01:35:48;
-	//   hardware ethernet 00:0c:29:56:7f:63;
-	//   uid ff:bc:9a:4a:2d:00:02:00:00:ab:11:15:39:5e:d3:35:a2:c9:00;
-	//   client-hostname "ubuntu";
-	// }
-	//
-	// Note: file is indented using tabs, not spaces as above
-	data, err := ioutil.ReadFile(fmt.Sprintf(path, netID))
+// If the VM is stopped and there's no guest password, we give the key to
+// cloud-init instead, using the guestinfo variables read by its VMware data
+// source. cloud-init installs it when the VM boots, if it's in the image. With
+// a guest password we wait until the VM is running and use VMware Tools, since
+// that works without cloud-init.
+func (v *VMware) InstallSSHKey(publicKey string) error {
+	state, err := v.State()
+	if err != nil {
+		return err
+	}
+
+	if state == core.StateRunning {
+		if err := v.WaitForTools(ToolsTimeout); err != nil {
+			return err
+		}
+		return v.RunShell(core.AuthorizeKeyScript(v.Config.SSH.Login, publicKey))
+	}
+
+	if v.Config.Guest.Password != "" {
+		return core.ErrNotRunning
+	}
+
+	return SetVMXValues(v.Config.Path, CloudInitGuestInfo(v.Config.SSH.Login, publicKey))
+}
+
+// CloudInitGuestInfo returns the guestinfo variables that tell cloud-init to
+// add publicKey to authorized_keys for login, or for the image's default user
+// if login is empty. The instance ID is derived from the key, so cloud-init
+// sees each clone as a new instance.
+func CloudInitGuestInfo(login, publicKey string) map[string]string {
+	publicKey = strings.TrimSpace(publicKey)
+	sum := sha256.Sum256([]byte(publicKey))
+
+	metadata := fmt.Sprintf("instance-id: lovm-%x\n", sum[:8])
+
+	var userdata string
+	switch login {
+	case "":
+		userdata = fmt.Sprintf("#cloud-config\nssh_authorized_keys:\n  - %s\n", publicKey)
+	case "root":
+		userdata = fmt.Sprintf("#cloud-config\ndisable_root: false\nssh_authorized_keys:\n  - %s\n", publicKey)
+	default:
+		userdata = fmt.Sprintf("#cloud-config\nusers:\n  - default\n  - name: %s\n"+
+			"    ssh_authorized_keys:\n      - %s\n", login, publicKey)
+	}
+
+	return map[string]string{
+		"guestinfo.metadata":          base64.StdEncoding.EncodeToString([]byte(metadata)),
+		"guestinfo.metadata.encoding": "base64",
+		"guestinfo.userdata":          base64.StdEncoding.EncodeToString([]byte(userdata)),
+		"guestinfo.userdata.encoding": "base64",
+	}
+}
+
+// SetVMXValues sets variables in a vmx file. Existing variables keep their
+// place in the file, and the others are added to the end in sorted order. The
+// VM must not be running, or VMware will overwrite the file.
+func SetVMXValues(path string, values map[string]string) error {
+	doc, err := vmx.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	setVMXValues(doc, values)
+	return doc.WriteFile(path)
+}
+
+func setVMXValues(doc *vmx.Document, values map[string]string) {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		doc.Set(key, values[key])
+	}
+}
+
+// ConfigureVMX changes the hardware in the vmx file to match the config's
+// CPUs, Memory and Networks. Anything that isn't set is left alone. Networks
+// are attached to the adapters in order, starting with ethernet0, and any
+// adapters past the end of the list are removed. New adapters get the same
+// virtual hardware as the first existing one.
+func ConfigureVMX(doc *vmx.Document, config *core.MachineConfig) error {
+	if config.CPUs > 0 {
+		doc.SetCPUs(config.CPUs)
+	}
+
+	memory, err := config.MemoryMB()
+	if err != nil {
+		return err
+	}
+	if memory > 0 {
+		doc.SetMemoryMB(memory)
+	}
+
+	if len(config.Networks) == 0 {
+		return nil
+	}
+	if len(config.Networks) > MaxNICs {
+		return fmt.Errorf("VMware supports up to %d network adapters, found %d networks", MaxNICs, len(config.Networks))
+	}
+
+	existing := doc.NICs()
+	virtualDev := DefaultVirtualDev
+	if len(existing) > 0 && existing[0].VirtualDev != "" {
+		virtualDev = existing[0].VirtualDev
+	}
+
+	wanted := map[string]bool{}
+	for i, network := range config.Networks {
+		name := fmt.Sprintf("ethernet%d", i)
+		wanted[name] = true
+
+		nic, _ := doc.NIC(name)
+		if !nic.Present {
+			// Start over rather than reviving whatever a removed adapter
+			// left behind
+			nic = vmx.NIC{Name: name, VirtualDev: virtualDev, AddressType: "generated"}
+		}
+		nic.Present = true
+		nic.ConnectionType, nic.VNet, nic.BSDName, err = VMXConnection(network)
+		if err != nil {
+			return err
+		}
+		if nic.BSDName == "" {
+			// Don't keep bridging to an interface the adapter used before
+			doc.Delete(name + ".bsdName")
+		}
+		doc.SetNIC(nic)
+	}
+
+	for _, nic := range existing {
+		if !wanted[nic.Name] {
+			doc.SetBool(nic.Name+".present", false)
+		}
+	}
+
+	return nil
+}
+
+// VMXConnection returns the connectionType, vnet and bsdName for a network
+// adapter attached to network. A network named after a vmnet, e.g.
+// hostonly:vmnet1, is attached to that vmnet, which VMware calls a custom
+// connection. A bridged network may instead name a host interface, e.g.
+// bridged:en0, which is set in bsdName. Only VMware Fusion reads bsdName;
+// Workstation bridges each vmnet to an interface in its network settings, so
+// use bridged:vmnet0 there. Without a name the adapter uses VMware's default
+// network of that type.
+func VMXConnection(network core.Network) (connectionType, vnet, bsdName string, err error) {
+	switch {
+	case network.Name == "":
+		switch network.Type {
+		case core.NetworkHostOnly:
+			return "hostonly", "", "", nil
+		case core.NetworkBridged:
+			return "bridged", "", "", nil
+		}
+		return "nat", "", "", nil
+	case reVMNet.MatchString(network.Name):
+		return "custom", network.Name, "", nil
+	case network.Type == core.NetworkBridged && reHostInterface.MatchString(network.Name):
+		return "bridged", "", network.Name, nil
+	case network.Type == core.NetworkBridged:
+		return "", "", "", fmt.Errorf("invalid host interface %q in %s", network.Name, network)
+	}
+	return "", "", "", fmt.Errorf("VMware %s networks are named like vmnet1, found %q", network.Type, network.Name)
+}
+
+// State uses vmrun list to tell if the VM is running. vmrun doesn't report
+// suspended VMs, so if it's not running we check the vmx file for a saved
+// memory state.
+func (v *VMware) State() (core.State, error) {
+	if !v.Found() {
+		return core.StateNotCloned, nil
+	}
+
+	running, err := v.Running()
+	if err != nil {
+		return core.StateUnknown, err
+	}
+	if running {
+		return core.StateRunning, nil
+	}
+
+	suspended, err := IsSuspended(v.Config.Path)
+	if err != nil {
+		return core.StateUnknown, err
+	}
+	if suspended {
+		return core.StateSuspended, nil
+	}
+
+	return core.StateStopped, nil
+}
+
+// SaveSnapshot takes a snapshot of the VM. If the VM is running the snapshot
+// includes its memory.
+func (v *VMware) SaveSnapshot(name string) error {
+	return v.snapshotCommand("snapshot", name)
+}
+
+// RestoreSnapshot reverts the VM to the snapshot. If the snapshot was taken
+// while the VM was powered off, the VM will be powered off afterward.
+func (v *VMware) RestoreSnapshot(name string) error {
+	return v.snapshotCommand("revertToSnapshot", name)
+}
+
+func (v *VMware) DeleteSnapshot(name string) error {
+	return v.snapshotCommand("deleteSnapshot", name)
+}
+
+func (v *VMware) ListSnapshots() ([]string, error) {
+	if !v.Found() {
+		return nil, errors.New("clone a virtual machine first")
+	}
+
+	cmd := exec.Command("vmrun", "listSnapshots", v.Config.Path)
+
+	out, err := cmd.CombinedOutput()
 	if err != nil {
+		core.CommandError(cmd, out)
 		return nil, err
 	}
 
-	matches := reDHCPLeases.FindAllStringSubmatch(string(data), -1)
+	return ParseSnapshotList(out), nil
+}
 
-	for _, match := range matches {
-		// Each match should contain a legit entry, but we need to find the one
-		// where starts < current time < ends and the MAC address matches.
-		// When we find any match we'll return immediately and stop processing.
-		//
-		// Note: I have seen a case where there were multiple valid leases in
-		// the lease file with different IPs. However, I also noticed that two
-		// VMs were assigned the same IP via DHCP so I think this is a bug where
-		// VMware was not tracking its own leases properly, so we'll just punt
-		// on that problem and blame VMware if it comes up.
-		//
-		// Fun fact: if two VMs on the network try to grab the same IP, one of
-		// them will win and the other will go link dead, but there's no way to
-		// control which wins. So obviously don't do that. The exciting case of
-		// Schrodinger's packets! Maybe they went somewhere. Maybe they went
-		// somewhere else. Maybe the router deleted them. You'll never know.
-		MAC, err := net.ParseMAC(match[4])
+func (v *VMware) snapshotCommand(command, name string) error {
+	if !v.Found() {
+		return errors.New("clone a virtual machine first")
+	}
+
+	cmd := exec.Command("vmrun", command, v.Config.Path, name)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+	}
+
+	return err
+}
+
+// Running reports whether the virtual machine is currently powered on
+func (v *VMware) Running() (bool, error) {
+	if !v.Found() {
+		return false, nil
+	}
+
+	running, err := ListRunning()
+	if err != nil {
+		return false, err
+	}
+
+	for _, path := range running {
+		if SamePath(path, v.Config.Path) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ToolsState returns the state of VMware Tools in the guest as reported by
+// vmrun: running, installed, or unknown.
+func (v *VMware) ToolsState() (string, error) {
+	cmd := exec.Command("vmrun", "checkToolsState", v.Config.Path)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// WaitForTools polls the state of VMware Tools until it is running or the
+// timeout expires
+func (v *VMware) WaitForTools(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		state, err := v.ToolsState()
 		if err != nil {
+			return err
+		}
+		if state == "running" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrToolsNotRunning
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// ListRunning returns the paths to the vmx files of all running VMs.
+func ListRunning() ([]string, error) {
+	cmd := exec.Command("vmrun", "list")
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return nil, err
+	}
+
+	return ParseRunningList(out), nil
+}
+
+// ParseRunningList parses the output of vmrun list. For example:
+//
+//	Total running VMs: 1
+//	/home/user/project/.lovm/project/project.vmx
+func ParseRunningList(data []byte) []string {
+	var paths []string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "Total running VMs") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+
+	return paths
+}
+
+// DetectSnapshot checks whether the VM at path has a snapshot called
+// SnapshotName
+func DetectSnapshot(path string) (bool, error) {
+	cmd := exec.Command("vmrun", "listSnapshots", path)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return false, err
+	}
+
+	for _, name := range ParseSnapshotList(out) {
+		if name == SnapshotName {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// CreateSnapshot creates a snapshot called SnapshotName for the VM at path,
+// unless it already exists. The snapshot must be taken while the VM is powered
+// off, or it can't be used for a linked clone, so if the VM is running or
+// suspended we give up and tell the user what to do about it.
+func CreateSnapshot(path string) error {
+	// If the snapshot already exists don't make another one, because that would
+	// be silly
+	found, err := DetectSnapshot(path)
+	if err != nil {
+		return err
+	}
+	if found {
+		return nil
+	}
+
+	running, err := ListRunning()
+	if err != nil {
+		return err
+	}
+	for _, runningPath := range running {
+		if SamePath(runningPath, path) {
+			return fmt.Errorf("%q is running and does not have a %q "+
+				"snapshot; shut it down so lovm can create the snapshot, or "+
+				"specify a powered-off snapshot to clone, e.g. %s:snapshot-name",
+				path, SnapshotName, path)
+		}
+	}
+
+	suspended, err := IsSuspended(path)
+	if err != nil {
+		return err
+	}
+	if suspended {
+		return fmt.Errorf("%q is suspended and does not have a %q "+
+			"snapshot; shut it down so lovm can create the snapshot", path,
+			SnapshotName)
+	}
+
+	cmd := exec.Command("vmrun", "snapshot", path, SnapshotName)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		core.CommandError(cmd, out)
+		return err
+	}
+
+	// This will only happen the first time we clone a particular VM, so we'll
+	// let the user know what's happening.
+	fmt.Fprintf(os.Stderr, "created snapshot %q for %q\n", SnapshotName, path)
+
+	return nil
+}
+
+// ParseSnapshotList parses the output of vmrun listSnapshots. For example:
+//
+//	Total snapshots: 2
+//	lovm-clone
+//	before-deploy
+func ParseSnapshotList(data []byte) []string {
+	var names []string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "Total snapshots") {
 			continue
 		}
+		names = append(names, line)
+	}
+
+	return names
+}
+
+// SamePath compares two paths to a vmx file. vmrun may report a different but
+// equivalent path from the one we have stored (e.g. through a symlink).
+func SamePath(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(fa, fb)
+}
+
+// IsSuspended checks the vmx file for a suspended memory state. When a VM is
+// suspended, VMware writes its memory to a .vmss file and records it like so:
+//
+//	checkpoint.vmState = "centos.vmss"
+//
+// When the VM is resumed the value is cleared.
+func IsSuspended(path string) (bool, error) {
+	doc, err := vmx.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	return doc.Get("checkpoint.vmState") != "", nil
+}
+
+// ReadSharedFoldersFromVMX returns a map of shared folder names to host paths
+// for each shared folder configured in the vmx file.
+func ReadSharedFoldersFromVMX(path string) (map[string]string, error) {
+	// example from vmx file:
+	// sharedFolder0.hostPath = "/home/user/src"
+	// sharedFolder0.guestName = "src"
+	doc, err := vmx.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := map[string]string{}
+	for _, folder := range doc.SharedFolders() {
+		if folder.GuestName != "" {
+			shares[folder.GuestName] = folder.HostPath
+		}
+	}
+
+	return shares, nil
+}
+
+// ReadMACAddressesFromVMX identifies both the configured interface name
+// (e.g. ethernet0) and MAC address for each network interface attached to the
+// virtual machine. A static MAC address takes precedence over a generated one.
+func ReadMACAdressesFromVMX(path string) (map[string]net.HardwareAddr, error) {
+	macs := map[string]net.HardwareAddr{}
+	// example from vmx file:
+	// ethernet0.generatedAddress = "00:0c:29:05:6f:e3"
+	// ethernet1.addressType = "static"
+	// ethernet1.address = "00:50:56:3a:12:01"
+	doc, err := vmx.ReadFile(path)
+	if err != nil {
+		return macs, err
+	}
 
-		// Compare MAC addresses before we spend CPU on anything else.
-		if MAC.String() != addr.String() {
+	for _, nic := range doc.NICs() {
+		mac, err := nic.MAC()
+		if err != nil {
+			log.Printf("error parsing mac address for %s from %q: %s\n", nic.Name, path, err)
 			continue
 		}
+		macs[nic.Name] = mac
+	}
+
+	if len(macs) == 0 {
+		return nil, ErrInterfaceNotFound
+	}
+
+	return macs, nil
+}
+
+func FindMACAddressByName(path, name string) (net.HardwareAddr, error) {
+	macs, err := ReadMACAdressesFromVMX(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mac, ok := macs[name]; ok {
+		return mac, nil
+	}
+
+	return nil, ErrInterfaceNotFound
+}
+
+// FindNATInterface looks for the first network interface in the vmx file that
+// is attached to a NAT network, and returns its name, MAC address, and the
+// number of the network (e.g. 8 for vmnet8). Interfaces are attached to the
+// default NAT network with connectionType "nat", or to a specific one with
+// connectionType "custom" and a vnet.
+func FindNATInterface(vmxPath, networkConfigFile string) (string, net.HardwareAddr, int, error) {
+	// example from vmx file:
+	// ethernet0.connectionType = "nat"
+	// ethernet1.connectionType = "custom"
+	// ethernet1.vnet = "vmnet8"
+	doc, err := vmx.ReadFile(vmxPath)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	networking, err := ioutil.ReadFile(networkConfigFile)
+	if err != nil {
+		return "", nil, 0, err
+	}
 
-		starts, err := time.Parse(DHCPDateFormat, match[2])
+	var natNetworks []int
+	for _, match := range reNATNetwork.FindAllStringSubmatch(string(networking), -1) {
+		netID, err := strconv.Atoi(match[1])
 		if err != nil {
 			continue
 		}
+		natNetworks = append(natNetworks, netID)
+	}
+	if len(natNetworks) == 0 {
+		return "", nil, 0, ErrInterfaceNotFound
+	}
 
-		ends, err := time.Parse(DHCPDateFormat, match[3])
+	for _, nic := range doc.NICs() {
+		mac, err := nic.MAC()
 		if err != nil {
 			continue
 		}
 
-		now := time.Now().UTC()
+		switch nic.ConnectionType {
+		case "nat":
+			return nic.Name, mac, natNetworks[0], nil
+		case "custom":
+			for _, netID := range natNetworks {
+				if nic.VNet == fmt.Sprintf("vmnet%d", netID) {
+					return nic.Name, mac, netID, nil
+				}
+			}
+		}
+	}
+
+	return "", nil, 0, ErrInterfaceNotFound
+}
+
+// UpdateNATConfig replaces owner's entries in the [incomingtcp] section of
+// nat.conf with one for each forward, pointing at ip. Each entry is preceded by
+// a comment naming the owner (the VMX file). If a host port is already
+// forwarded by someone else we return an error. For example:
+//
+//	[incomingtcp]
+//	# lovm /home/user/project/.lovm/project/project.vmx
+//	8080 = 172.16.23.131:80
+func UpdateNATConfig(data []byte, owner string, ip net.IP, forwards []core.Forward) ([]byte, error) {
+	marker := "# lovm " + owner
+
+	var lines []string
+	section := ""
+	end := -1
+	taken := map[int]bool{}
+
+	input := strings.Split(string(data), "\n")
+	for i := 0; i < len(input); i++ {
+		line := input[i]
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "[") {
+			section = strings.Trim(trimmed, "[]")
+			lines = append(lines, line)
+			if section == "incomingtcp" {
+				end = len(lines)
+			}
+			continue
+		}
 
-		// Time matches
-		if now.After(starts) && now.Before(ends) {
-			// For some reason the API for net.ParseIP does not return an error
-			// if there is a problem, so we need to check it ourselves before we
-			// return.
-			IP := net.ParseIP(match[1])
-			if IP != nil {
-				return IP, nil
-			} else {
-				return nil, fmt.Errorf("failed parsing ip address: %q", match[1])
+		if section == "incomingtcp" {
+			if trimmed == marker {
+				// Skip our old entry on the next line, too
+				i++
+				continue
 			}
+			if match := reNATIncoming.FindStringSubmatch(trimmed); match != nil {
+				if port, err := strconv.Atoi(match[1]); err == nil {
+					taken[port] = true
+				}
+			}
+		}
+
+		lines = append(lines, line)
+		if section == "incomingtcp" && trimmed != "" {
+			end = len(lines)
+		}
+	}
+
+	var entries []string
+	for _, forward := range forwards {
+		if taken[forward.HostPort] {
+			return nil, fmt.Errorf("host port %d is already forwarded in nat.conf", forward.HostPort)
+		}
+		entries = append(entries, marker,
+			fmt.Sprintf("%d = %s:%d", forward.HostPort, ip, forward.GuestPort))
+	}
+
+	if end < 0 {
+		if len(entries) == 0 {
+			return data, nil
+		}
+		// Add the section at the end, keeping the file's final newline
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		lines = append(lines, "", "[incomingtcp]")
+		end = len(lines)
+		lines = append(lines, "")
+	}
+
+	lines = append(lines[:end], append(entries, lines[end:]...)...)
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// ListDHCPVirtualNetworks inspects VMware's networking configuration to find a
+// list of virtual networks that have DHCP enabled. This includes NAT and host-
+// only networks, but not bridged networks, because DHCP for bridged interfaces
+// is managed by the host's local network instead.
+func ListDHCPVirtualNetworks(path string) ([]int, error) {
+	// example networking config
+	//
+	// $ cat /etc/vmware/networking
+	//
+	// VERSION=1,0
+	// answer VNET_1_DHCP yes
+	// ...
+	// answer VNET_8_DHCP yes
+	// ...
+	var networks []int
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return networks, err
+	}
+
+	matches := reNetworkingConfig.FindAllStringSubmatch(string(data), -1)
+
+	for _, match := range matches {
+		netID, err := strconv.ParseInt(match[1], 10, 0)
+		if err != nil {
+			log.Printf("unexpected number format %q", match[1])
+			continue
+		}
+		networks = append(networks, int(netID))
+	}
+
+	return networks, nil
+}
+
+// ReadDHCPReservations reads the fixed-address host declarations from the
+// DHCP server configuration for a virtual network, and returns the reserved
+// IP addresses keyed by MAC address.
+//
+// The path argument should be a parameterized path to the DHCP configuration
+// file on this system. See DHCPConfigFile as an example.
+func ReadDHCPReservations(path string, netID int) (map[string]net.IP, error) {
+	// example DHCP configuration
+	//
+	// $ cat /etc/vmware/vmnet8/dhcpd/dhcpd.conf
+	//
+	// host build01 {
+	//     hardware ethernet 00:50:56:3a:12:01;
+	//     fixed-address 172.16.23.10;
+	// }
+	//
+	// VMware's own sections are delimited with "# DO NOT MODIFY" comments,
+	// but host declarations are added by hand after them.
+	data, err := ioutil.ReadFile(fmt.Sprintf(path, netID))
+	if err != nil {
+		return nil, err
+	}
+
+	// Strip comments so commented-out hosts are ignored
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		lines = append(lines, line)
+	}
+
+	reservations := map[string]net.IP{}
+	for _, host := range reDHCPHost.FindAllStringSubmatch(strings.Join(lines, "\n"), -1) {
+		hardware := reDHCPHardware.FindStringSubmatch(host[1])
+		address := reDHCPFixedAddress.FindStringSubmatch(host[1])
+		if hardware == nil || address == nil {
+			continue
 		}
+
+		mac, err := net.ParseMAC(hardware[1])
+		if err != nil {
+			continue
+		}
+
+		// fixed-address may also be a hostname, which we skip
+		ip := net.ParseIP(address[1])
+		if ip == nil {
+			continue
+		}
+
+		reservations[mac.String()] = ip
 	}
 
+	return reservations, nil
+}
+
+// FindCurrentLeaseByMAC searches the specified DHCP lease table for an active
+// lease assigned to the specified MAC address, and returns the IP address.
+//
+// The path argument should be a parameterized path to the DHCP leases file on
+// this system. See DHCPLeasesFile as an example.
+//
+// If no valid lease can be found, returns ErrLeaseNotFound. If leases in the
+// file had to be skipped (see ParseLeases) the error wraps ErrLeaseNotFound
+// and says why.
+func FindCurrentLeaseByMAC(path string, netID int, addr net.HardwareAddr) (net.IP, error) {
+	// example DHCP lease file
+	//
+	// $ cat /etc/vmware/vmnet8/dhcpd/dhcpd.leases
+	//
+	// lease 172.16.23.128 {
+	//   starts 2 2019/04/02 01:05:48;
+	//   ends 2 2019/04/02 01:35:48;
+	//   hardware ethernet 00:0c:29:56:7f:63;
+	//   uid ff:bc:9a:4a:2d:00:02:00:00:ab:11:15:39:5e:d3:35:a2:c9:00;
+	//   client-hostname "ubuntu";
+	// }
+	//
+	// Note: file is indented using tabs, not spaces as above
+	leases, warnings, err := ReadLeases(fmt.Sprintf(path, netID))
+	if err != nil {
+		return nil, err
+	}
+
+	// Note: I have seen a case where there were multiple valid leases in the
+	// lease file with different IPs. However, I also noticed that two VMs were
+	// assigned the same IP via DHCP so I think this is a bug where VMware was
+	// not tracking its own leases properly. FindLease picks the newest one,
+	// which is the best we can do.
+	//
+	// Fun fact: if two VMs on the network try to grab the same IP, one of them
+	// will win and the other will go link dead, but there's no way to control
+	// which wins. So obviously don't do that. The exciting case of
+	// Schrodinger's packets! Maybe they went somewhere. Maybe they went
+	// somewhere else. Maybe the router deleted them. You'll never know.
+	if lease, ok := FindLease(leases, addr, time.Now().UTC()); ok {
+		return lease.IP, nil
+	}
+
+	// One of the leases we skipped may have been the one we're looking for
+	if len(warnings) > 0 {
+		return nil, fmt.Errorf("%w, but %d leases were skipped, e.g. %s", ErrLeaseNotFound, len(warnings), warnings[0])
+	}
 	return nil, ErrLeaseNotFound
 }
 
@@ -582,11 +1937,11 @@ func DetectIPFromMACAddress(networkConfigFile string, dhcpLeasesFile string, mac
 
 	for _, network := range networks {
 		ip, err := FindCurrentLeaseByMAC(dhcpLeasesFile, network, mac)
-		switch err {
-		case nil:
+		switch {
+		case err == nil:
 			// Yay we found the ip address!
 			return ip, nil
-		case ErrLeaseNotFound:
+		case errors.Is(err, ErrLeaseNotFound):
 			// We don't expect to find a match in every network so we'll just
 			// continue if we don't find it in this one.
 			continue
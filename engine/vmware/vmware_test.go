@@ -1,9 +1,17 @@
 package vmware
 
 import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
 	"net"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/cbednarski/lovm/core"
+	"github.com/cbednarski/lovm/engine/vmware/vmx"
 )
 
 func CompareIntLists(a, b []int) bool {
@@ -80,6 +88,39 @@ func TestFindCurrentLeaseByMAC_OK(t *testing.T) {
 	}
 }
 
+func TestFindCurrentLeaseByMAC_Malformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lovm-leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile(filepath.Join("test-fixtures", "dhcpd-malformed.leases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dhcpd8.leases"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "dhcpd%d.leases")
+
+	// The bad leases don't hide the good ones
+	mac, _ := net.ParseMAC("00:0c:29:56:7f:63")
+	ip, err := FindCurrentLeaseByMAC(path, 8, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "172.16.23.134" {
+		t.Errorf("Expected 172.16.23.134, found %s", ip)
+	}
+
+	// But if we don't find a lease, we say that some were skipped
+	mac, _ = net.ParseMAC("00:0c:29:aa:bb:cc")
+	_, err = FindCurrentLeaseByMAC(path, 8, mac)
+	if !errors.Is(err, ErrLeaseNotFound) || !strings.Contains(err.Error(), "2 leases were skipped") {
+		t.Errorf("Expected %s with the skipped leases, found %v", ErrLeaseNotFound, err)
+	}
+}
+
 func TestFindCurrentLeaseByMAC_MACNotFound(t *testing.T) {
 	path := filepath.Join("test-fixtures", "dhcpd%d.leases")
 
@@ -130,6 +171,172 @@ func TestDetectIPFromMACAddress(t *testing.T) {
 	}
 }
 
+func TestReadMACAdressesFromVMX_Static(t *testing.T) {
+	macs, err := ReadMACAdressesFromVMX(filepath.Join("test-fixtures", "centos-static.vmx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac := macs["ethernet1"].String(); mac != "00:50:56:3a:12:01" {
+		t.Errorf("Expected the static MAC address for ethernet1, found %q", mac)
+	}
+}
+
+func TestReadDHCPReservations(t *testing.T) {
+	reservations, err := ReadDHCPReservations(filepath.Join("test-fixtures", "dhcpd%d.conf"), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// build02 is commented out and build03 has a hostname instead of an IP
+	expected := map[string]string{
+		"00:50:56:c0:00:08": "172.16.23.1",
+		"00:50:56:3a:12:01": "172.16.23.10",
+	}
+	if len(reservations) != len(expected) {
+		t.Errorf("Expected %d reservations, found %v", len(expected), reservations)
+	}
+	for mac, ip := range expected {
+		if reservations[mac].String() != ip {
+			t.Errorf("Expected %s for %s, found %s", ip, mac, reservations[mac])
+		}
+	}
+}
+
+func CheckAddresses(t *testing.T, expected, found []core.Address) {
+	t.Helper()
+	if len(found) != len(expected) {
+		t.Fatalf("Expected %d addresses, found %v", len(expected), found)
+	}
+	for i, addr := range found {
+		e := expected[i]
+		if addr.Interface != e.Interface || addr.MAC != e.MAC || !addr.IP.Equal(e.IP) ||
+			addr.Network != e.Network || addr.Source != e.Source {
+			t.Errorf("Expected %+v, found %+v", e, addr)
+		}
+	}
+}
+
+func TestFindStaticAddresses(t *testing.T) {
+	vmx := filepath.Join("test-fixtures", "centos-static.vmx")
+	macs, err := ReadMACAdressesFromVMX(vmx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err := FindStaticAddresses(
+		filepath.Join("test-fixtures", "networking"),
+		filepath.Join("test-fixtures", "dhcpd%d.conf"),
+		macs,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	CheckAddresses(t, []core.Address{
+		{Interface: "ethernet1", MAC: "00:50:56:3a:12:01", IP: net.ParseIP("172.16.23.10"), Network: "vmnet8", Source: core.SourceStatic},
+	}, addresses)
+
+	if _, err := FindStaticAddresses(filepath.Join("test-fixtures", "missing"), "", macs); err == nil {
+		t.Error("Expected an error without the network configuration")
+	}
+}
+
+func TestFindLeaseAddresses(t *testing.T) {
+	macs, err := ReadMACAdressesFromVMX(filepath.Join("test-fixtures", "centos-static.vmx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err := FindLeaseAddresses(
+		filepath.Join("test-fixtures", "networking"),
+		filepath.Join("test-fixtures", "dhcpd%d.leases"),
+		macs,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	CheckAddresses(t, []core.Address{
+		{Interface: "ethernet0", MAC: "00:0c:29:f7:07:f2", IP: net.ParseIP("172.16.23.131"), Network: "vmnet8", Source: core.SourceDHCP},
+	}, addresses)
+
+	// A lease table we can't read doesn't stop us from reading the others
+	dir, err := ioutil.TempDir("", "lovm-leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile(filepath.Join("test-fixtures", "dhcpd8.leases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dhcpd8.leases"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err = FindLeaseAddresses(
+		filepath.Join("test-fixtures", "networking"),
+		filepath.Join(dir, "dhcpd%d.leases"),
+		macs,
+	)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected vmnet1's lease table to be missing, found %v", err)
+	}
+	if len(addresses) != 1 || addresses[0].Interface != "ethernet0" {
+		t.Errorf("Expected ethernet0's lease, found %v", addresses)
+	}
+}
+
+func TestGuestToolsAddress(t *testing.T) {
+	eth0, _ := net.ParseMAC("00:0c:29:f7:07:f2")
+	eth1, _ := net.ParseMAC("00:50:56:3a:12:01")
+	lease := core.Address{Interface: "ethernet0", MAC: eth0.String(), IP: net.ParseIP("172.16.23.131"), Source: core.SourceDHCP}
+
+	// ethernet0 is on NAT with a lease, and ethernet1 is bridged. The guest's
+	// main address is ethernet0's, so it mustn't be given to ethernet1.
+	macs := map[string]net.HardwareAddr{"ethernet1": eth1}
+	if addr, err := GuestToolsAddress(lease.IP, macs, []core.Address{lease}); err == nil {
+		t.Errorf("Expected an address that was already found to be skipped, found %+v", addr)
+	}
+
+	// With one interface left to find, a new address must be its
+	ip := net.ParseIP("192.168.1.40")
+	addr, err := GuestToolsAddress(ip, macs, []core.Address{lease})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := core.Address{Interface: "ethernet1", MAC: eth1.String(), IP: ip, Source: core.SourceGuestTools}
+	if addr.Interface != expected.Interface || addr.MAC != expected.MAC || !addr.IP.Equal(ip) || addr.Source != expected.Source {
+		t.Errorf("Expected %+v, found %+v", expected, addr)
+	}
+
+	// With two, we can't tell which
+	macs["ethernet0"] = eth0
+	if addr, err := GuestToolsAddress(ip, macs, nil); err == nil || !strings.Contains(err.Error(), "ethernet0, ethernet1") {
+		t.Errorf("Expected an error naming both interfaces, found %+v (%v)", addr, err)
+	}
+}
+
+func TestResolvers(t *testing.T) {
+	v := New(&core.MachineConfig{})
+
+	resolvers, err := v.Resolvers()
+	if err != nil || strings.Join(resolvers, ",") != "static,leases,guest-tools,arp" {
+		t.Errorf("Expected the default resolvers, found %q %v", resolvers, err)
+	}
+
+	v.Config.SSH.IPResolvers = []string{"arp", "leases"}
+	resolvers, err = v.Resolvers()
+	if err != nil || strings.Join(resolvers, ",") != "arp,leases" {
+		t.Errorf("Expected arp,leases, found %q %v", resolvers, err)
+	}
+
+	v.Config.SSH.IPResolvers = []string{"dns"}
+	if _, err := v.Resolvers(); err == nil {
+		t.Error("Expected an error for an unknown resolver")
+	}
+}
+
 func TestFindMACAddressByName(t *testing.T) {
 	path := filepath.Join("test-fixtures", "centos.vmx")
 
@@ -148,3 +355,310 @@ func TestFindMACAddressByName(t *testing.T) {
 		t.Errorf("Expected %s, found %s", ErrInterfaceNotFound, err)
 	}
 }
+
+func TestParseRunningList(t *testing.T) {
+	output := []byte("Total running VMs: 2\n" +
+		"/home/user/project/.lovm/project/project.vmx\n" +
+		"/home/user/vms/centos7/centos7.vmx\n")
+
+	expected := []string{
+		"/home/user/project/.lovm/project/project.vmx",
+		"/home/user/vms/centos7/centos7.vmx",
+	}
+
+	paths := ParseRunningList(output)
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected %#v, found %#v", expected, paths)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("Expected %q, found %q", expected[i], paths[i])
+		}
+	}
+
+	if paths := ParseRunningList([]byte("Total running VMs: 0\n")); len(paths) != 0 {
+		t.Errorf("Expected no running VMs, found %#v", paths)
+	}
+}
+
+func TestReadSharedFoldersFromVMX(t *testing.T) {
+	shares, err := ReadSharedFoldersFromVMX(filepath.Join("test-fixtures", "centos-shared.vmx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shares) != 1 || shares["srv-project"] != "/home/user/project" {
+		t.Errorf("Unexpected shared folders: %#v", shares)
+	}
+
+	shares, err = ReadSharedFoldersFromVMX(filepath.Join("test-fixtures", "centos.vmx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shares) != 0 {
+		t.Errorf("Expected no shared folders, found %#v", shares)
+	}
+}
+
+func TestIsSuspended(t *testing.T) {
+	cases := map[string]bool{
+		"centos.vmx":           false,
+		"centos-shared.vmx":    false,
+		"centos-suspended.vmx": true,
+	}
+
+	for input, expected := range cases {
+		suspended, err := IsSuspended(filepath.Join("test-fixtures", input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if suspended != expected {
+			t.Errorf("Expected %s suspended to be %t", input, expected)
+		}
+	}
+}
+
+func TestParseSnapshotList(t *testing.T) {
+	names := ParseSnapshotList([]byte("Total snapshots: 2\nlovm-clone\nbefore-deploy\n"))
+
+	expected := []string{"lovm-clone", "before-deploy"}
+	if len(names) != len(expected) || names[0] != expected[0] || names[1] != expected[1] {
+		t.Errorf("Expected %#v, found %#v", expected, names)
+	}
+}
+
+func TestFindNATInterface(t *testing.T) {
+	name, mac, network, err := FindNATInterface(filepath.Join("test-fixtures", "centos.vmx"),
+		filepath.Join("test-fixtures", "networking"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "ethernet0" || mac.String() != "00:0c:29:f7:07:f2" || network != 8 {
+		t.Errorf("Unexpected NAT interface %s %s vmnet%d", name, mac, network)
+	}
+
+	_, _, _, err = FindNATInterface(filepath.Join("test-fixtures", "centos-nonic.vmx"),
+		filepath.Join("test-fixtures", "networking"))
+	if err != ErrInterfaceNotFound {
+		t.Errorf("Expected ErrInterfaceNotFound, found %v", err)
+	}
+}
+
+func TestUpdateNATConfig(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("test-fixtures", "nat.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := "/home/user/project/.lovm/project/project.vmx"
+	ip := net.ParseIP("172.16.23.131")
+	forwards := []core.Forward{{HostPort: 5432, GuestPort: 5432}, {HostPort: 8080, GuestPort: 80}}
+
+	updated, err := UpdateNATConfig(data, owner, ip, forwards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "3389 = 172.16.23.140:3389\n" +
+		"# lovm " + owner + "\n" +
+		"5432 = 172.16.23.131:5432\n" +
+		"# lovm " + owner + "\n" +
+		"8080 = 172.16.23.131:80\n" +
+		"\n[incomingudp]\n"
+	if !strings.Contains(string(updated), expected) {
+		t.Errorf("Expected nat.conf to contain:\n%s\nFound:\n%s", expected, updated)
+	}
+
+	// Running it again with the same forwards changes nothing
+	again, err := UpdateNATConfig(updated, owner, ip, forwards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(updated) {
+		t.Errorf("Expected no changes, found:\n%s", again)
+	}
+
+	// Removing all of the forwards puts the file back the way it was
+	removed, err := UpdateNATConfig(updated, owner, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(removed) != string(data) {
+		t.Errorf("Expected the original nat.conf, found:\n%s", removed)
+	}
+
+	// Someone else's forward
+	if _, err := UpdateNATConfig(data, owner, ip, []core.Forward{{HostPort: 3389, GuestPort: 3389}}); err == nil {
+		t.Error("Expected an error for a host port that is already forwarded")
+	}
+
+	// No [incomingtcp] section
+	updated, err = UpdateNATConfig([]byte("[host]\nip = 172.16.23.2\n"), owner, ip, forwards[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "[host]\nip = 172.16.23.2\n\n[incomingtcp]\n# lovm " + owner + "\n8080 = 172.16.23.131:80\n"
+	if string(updated) != expected {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expected, updated)
+	}
+}
+
+func TestCloudInitGuestInfo(t *testing.T) {
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIEx9 lovm@project"
+
+	for login, expected := range map[string]string{
+		"":       "#cloud-config\nssh_authorized_keys:\n  - " + key + "\n",
+		"root":   "#cloud-config\ndisable_root: false\nssh_authorized_keys:\n  - " + key + "\n",
+		"ubuntu": "#cloud-config\nusers:\n  - default\n  - name: ubuntu\n    ssh_authorized_keys:\n      - " + key + "\n",
+	} {
+		info := CloudInitGuestInfo(login, key+"\n")
+		userdata, err := base64.StdEncoding.DecodeString(info["guestinfo.userdata"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(userdata) != expected {
+			t.Errorf("Expected:\n%s\nFound:\n%s", expected, userdata)
+		}
+		if info["guestinfo.userdata.encoding"] != "base64" || info["guestinfo.metadata.encoding"] != "base64" {
+			t.Errorf("Expected base64 encodings, found %v", info)
+		}
+	}
+
+	metadata, err := base64.StdEncoding.DecodeString(CloudInitGuestInfo("", key)["guestinfo.metadata"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(metadata), "instance-id: lovm-") {
+		t.Errorf("Unexpected metadata %q", metadata)
+	}
+}
+
+func TestConfigureVMX(t *testing.T) {
+	doc, err := vmx.ReadFile(filepath.Join("test-fixtures", "centos-static.vmx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing to change
+	before := doc.Bytes()
+	if err := ConfigureVMX(doc, &core.MachineConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if string(doc.Bytes()) != string(before) {
+		t.Error("Expected an empty config to change nothing")
+	}
+
+	config := &core.MachineConfig{
+		CPUs:   4,
+		Memory: "8G",
+		Networks: []core.Network{
+			{Type: core.NetworkNAT},
+			{Type: core.NetworkHostOnly, Name: "vmnet1"},
+		},
+	}
+	if err := ConfigureVMX(doc, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.CPUs() != 4 || doc.MemoryMB() != 8192 {
+		t.Errorf("Expected 4 CPUs and 8192 MB, found %d and %d", doc.CPUs(), doc.MemoryMB())
+	}
+
+	nics := doc.NICs()
+	if len(nics) != 2 {
+		t.Fatalf("Expected 2 NICs, found %v", nics)
+	}
+	if nics[0].ConnectionType != "nat" || nics[0].GeneratedAddress != "00:0c:29:f7:07:f2" {
+		t.Errorf("Expected ethernet0 to be left alone, found %+v", nics[0])
+	}
+	if nics[1].ConnectionType != "custom" || nics[1].VNet != "vmnet1" || nics[1].Address != "00:50:56:3a:12:01" {
+		t.Errorf("Expected ethernet1 on vmnet1 with its MAC, found %+v", nics[1])
+	}
+
+	// Configuring again changes nothing
+	before = doc.Bytes()
+	if err := ConfigureVMX(doc, config); err != nil {
+		t.Fatal(err)
+	}
+	if string(doc.Bytes()) != string(before) {
+		t.Error("Expected configuring twice to change nothing")
+	}
+
+	// Adapters are added to a VM without any
+	doc, err = vmx.ReadFile(filepath.Join("test-fixtures", "centos-nonic.vmx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = &core.MachineConfig{Networks: []core.Network{{Type: core.NetworkBridged}}}
+	if err := ConfigureVMX(doc, config); err != nil {
+		t.Fatal(err)
+	}
+	nic, _ := doc.NIC("ethernet0")
+	expected := vmx.NIC{Name: "ethernet0", Present: true, ConnectionType: "bridged", VirtualDev: DefaultVirtualDev, AddressType: "generated"}
+	if nic != expected {
+		t.Errorf("Expected %+v, found %+v", expected, nic)
+	}
+
+	// Bridging to a host interface, and then back to the default
+	config = &core.MachineConfig{Networks: []core.Network{{Type: core.NetworkBridged, Name: "en0"}}}
+	if err := ConfigureVMX(doc, config); err != nil {
+		t.Fatal(err)
+	}
+	nic, _ = doc.NIC("ethernet0")
+	if nic.ConnectionType != "bridged" || nic.BSDName != "en0" || nic.VNet != "" {
+		t.Errorf("Expected ethernet0 bridged to en0, found %+v", nic)
+	}
+	config = &core.MachineConfig{Networks: []core.Network{{Type: core.NetworkBridged}}}
+	if err := ConfigureVMX(doc, config); err != nil {
+		t.Fatal(err)
+	}
+	if nic, _ = doc.NIC("ethernet0"); nic != expected {
+		t.Errorf("Expected %+v, found %+v", expected, nic)
+	}
+
+	config = &core.MachineConfig{Memory: "lots"}
+	if err := ConfigureVMX(doc, config); err == nil {
+		t.Error("Expected an error for invalid memory")
+	}
+
+	config = &core.MachineConfig{Networks: []core.Network{{Type: core.NetworkHostOnly, Name: "en0"}}}
+	if err := ConfigureVMX(doc, config); err == nil {
+		t.Error("Expected an error for a host-only network named after a host interface")
+	}
+}
+
+func TestVMXConnection(t *testing.T) {
+	cases := map[string][3]string{
+		"nat":            {"nat", "", ""},
+		"hostonly":       {"hostonly", "", ""},
+		"bridged":        {"bridged", "", ""},
+		"nat:vmnet8":     {"custom", "vmnet8", ""},
+		"bridged:vmnet0": {"custom", "vmnet0", ""},
+		"bridged:en0":    {"bridged", "", "en0"},
+	}
+	for s, expected := range cases {
+		network, err := core.ParseNetwork(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		connectionType, vnet, bsdName, err := VMXConnection(network)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		if found := [3]string{connectionType, vnet, bsdName}; found != expected {
+			t.Errorf("%q: expected %q, found %q", s, expected, found)
+		}
+	}
+
+	for _, s := range []string{"hostonly:en0", "nat:vboxnet0", "bridged:en0\"\nfoo"} {
+		network, err := core.ParseNetwork(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := VMXConnection(network); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
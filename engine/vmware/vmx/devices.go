@@ -0,0 +1,254 @@
+package vmx
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	reNICKey          = regexp.MustCompile(`(?i)^ethernet(\d+)\.`)
+	reDiskKey         = regexp.MustCompile(`(?i)^(ide|scsi|sata|nvme)(\d+):(\d+)\.filename$`)
+	reSharedFolderKey = regexp.MustCompile(`(?i)^sharedFolder(\d+)\.`)
+)
+
+// CPUs returns the number of virtual CPUs. VMware's default is 1.
+func (d *Document) CPUs() int {
+	if n, ok := d.Int("numvcpus"); ok && n > 0 {
+		return n
+	}
+	return 1
+}
+
+// SetCPUs sets the number of virtual CPUs. If the cores per socket no longer
+// divide evenly into them, all of the CPUs are put in one socket.
+func (d *Document) SetCPUs(n int) {
+	d.SetInt("numvcpus", n)
+	if cores, ok := d.Int("cpuid.coresPerSocket"); ok && (cores <= 0 || n%cores != 0) {
+		d.SetInt("cpuid.coresPerSocket", n)
+	}
+}
+
+// MemoryMB returns the VM's memory in megabytes, or 0 if it isn't set
+func (d *Document) MemoryMB() int {
+	n, _ := d.Int("memsize")
+	return n
+}
+
+// SetMemoryMB sets the VM's memory in megabytes. VMware wants a multiple of
+// 4, so it's rounded up.
+func (d *Document) SetMemoryMB(n int) {
+	if n%4 != 0 {
+		n += 4 - n%4
+	}
+	d.SetInt("memsize", n)
+}
+
+// indexes returns the numbers of the devices with keys matching re, in order
+func (d *Document) indexes(re *regexp.Regexp) []int {
+	seen := map[int]bool{}
+	var indexes []int
+	for _, key := range d.Keys() {
+		match := re.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+		n, err := strconv.Atoi(match[1])
+		if err != nil || seen[n] {
+			continue
+		}
+		seen[n] = true
+		indexes = append(indexes, n)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// NIC is a virtual network adapter, e.g. ethernet0
+type NIC struct {
+	// Name is the prefix of the adapter's keys, e.g. ethernet0
+	Name    string
+	Present bool
+
+	// ConnectionType is e.g. nat, hostonly, bridged, or custom. Custom
+	// adapters are attached to the network in VNet.
+	ConnectionType string
+	VNet           string
+
+	// BSDName is the host interface a bridged adapter uses, e.g. en0. Only
+	// VMware Fusion reads it.
+	BSDName string
+
+	// VirtualDev is the emulated hardware, e.g. e1000 or vmxnet3
+	VirtualDev string
+
+	// AddressType is generated, static, or vpx. Static adapters use Address
+	// for their MAC address, and the others use GeneratedAddress.
+	AddressType      string
+	Address          string
+	GeneratedAddress string
+}
+
+// MAC returns the adapter's MAC address, preferring a static one
+func (n NIC) MAC() (net.HardwareAddr, error) {
+	if n.Address != "" {
+		return net.ParseMAC(n.Address)
+	}
+	if n.GeneratedAddress != "" {
+		return net.ParseMAC(n.GeneratedAddress)
+	}
+	return nil, fmt.Errorf("%s has no MAC address", n.Name)
+}
+
+// NICs returns the network adapters that are present, in order. Removing an
+// adapter in VMware can leave some of its keys behind, so the others are
+// skipped.
+func (d *Document) NICs() []NIC {
+	var nics []NIC
+	for _, i := range d.indexes(reNICKey) {
+		nic, _ := d.NIC(fmt.Sprintf("ethernet%d", i))
+		if nic.Present {
+			nics = append(nics, nic)
+		}
+	}
+	return nics
+}
+
+// NIC returns the network adapter with the given name, e.g. ethernet0. ok is
+// false if it has no keys in the file.
+func (d *Document) NIC(name string) (nic NIC, ok bool) {
+	for _, key := range d.Keys() {
+		if strings.HasPrefix(strings.ToLower(key), strings.ToLower(name)+".") {
+			ok = true
+			break
+		}
+	}
+
+	return NIC{
+		Name:             name,
+		Present:          d.Bool(name + ".present"),
+		ConnectionType:   d.Get(name + ".connectionType"),
+		VNet:             d.Get(name + ".vnet"),
+		BSDName:          d.Get(name + ".bsdName"),
+		VirtualDev:       d.Get(name + ".virtualDev"),
+		AddressType:      d.Get(name + ".addressType"),
+		Address:          d.Get(name + ".address"),
+		GeneratedAddress: d.Get(name + ".generatedAddress"),
+	}, ok
+}
+
+// SetNIC writes the adapter's settings. Empty fields are left out, and the
+// generated address is left to VMware.
+func (d *Document) SetNIC(nic NIC) {
+	d.SetBool(nic.Name+".present", nic.Present)
+
+	values := []struct{ key, value string }{
+		{".connectionType", nic.ConnectionType},
+		{".vnet", nic.VNet},
+		{".bsdName", nic.BSDName},
+		{".virtualDev", nic.VirtualDev},
+		{".addressType", nic.AddressType},
+		{".address", nic.Address},
+	}
+	for _, v := range values {
+		if v.value != "" {
+			d.Set(nic.Name+v.key, v.value)
+		}
+	}
+}
+
+// Disk is a virtual disk or CD/DVD drive, e.g. nvme0:0
+type Disk struct {
+	// Name is the prefix of the device's keys, e.g. scsi0:1
+	Name    string
+	Bus     string
+	Present bool
+
+	// FileName is the disk image, e.g. a .vmdk or .iso, relative to the .vmx
+	// file unless it's absolute
+	FileName string
+
+	// DeviceType is e.g. cdrom-image. It's empty for most hard disks.
+	DeviceType string
+
+	controller, unit int
+}
+
+// CDROM returns true if the device is a CD/DVD drive rather than a disk
+func (disk Disk) CDROM() bool {
+	return strings.HasPrefix(disk.DeviceType, "cdrom")
+}
+
+// Disks returns the disks and CD/DVD drives with a file, ordered by bus,
+// controller and unit
+func (d *Document) Disks() []Disk {
+	seen := map[string]bool{}
+	var disks []Disk
+	for _, key := range d.Keys() {
+		match := reDiskKey.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+		controller, _ := strconv.Atoi(match[2])
+		unit, _ := strconv.Atoi(match[3])
+		name := key[:len(key)-len(".fileName")]
+		if seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+
+		disks = append(disks, Disk{
+			Name:       name,
+			Bus:        strings.ToLower(match[1]),
+			Present:    d.Bool(name + ".present"),
+			FileName:   d.Get(key),
+			DeviceType: d.Get(name + ".deviceType"),
+			controller: controller,
+			unit:       unit,
+		})
+	}
+
+	sort.SliceStable(disks, func(i, j int) bool {
+		a, b := disks[i], disks[j]
+		if a.Bus != b.Bus {
+			return a.Bus < b.Bus
+		}
+		if a.controller != b.controller {
+			return a.controller < b.controller
+		}
+		return a.unit < b.unit
+	})
+
+	return disks
+}
+
+// SharedFolder is a host folder shared with the guest, e.g. sharedFolder0
+type SharedFolder struct {
+	// Name is the prefix of the folder's keys, e.g. sharedFolder0
+	Name      string
+	Present   bool
+	Enabled   bool
+	HostPath  string
+	GuestName string
+	Writable  bool
+}
+
+// SharedFolders returns the shared folders in the file, in order
+func (d *Document) SharedFolders() []SharedFolder {
+	var folders []SharedFolder
+	for _, i := range d.indexes(reSharedFolderKey) {
+		name := fmt.Sprintf("sharedFolder%d", i)
+		folders = append(folders, SharedFolder{
+			Name:      name,
+			Present:   d.Bool(name + ".present"),
+			Enabled:   d.Bool(name + ".enabled"),
+			HostPath:  d.Get(name + ".hostPath"),
+			GuestName: d.Get(name + ".guestName"),
+			Writable:  d.Bool(name + ".writeAccess"),
+		})
+	}
+	return folders
+}
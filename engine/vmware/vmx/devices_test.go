@@ -0,0 +1,114 @@
+package vmx
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func ReadFixture(t *testing.T, name string) *Document {
+	doc, err := ReadFile(filepath.Join("..", "test-fixtures", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestHardware(t *testing.T) {
+	doc := ReadFixture(t, "centos.vmx")
+
+	if doc.CPUs() != 2 || doc.MemoryMB() != 2048 {
+		t.Errorf("Expected 2 CPUs and 2048 MB, found %d and %d", doc.CPUs(), doc.MemoryMB())
+	}
+
+	doc.SetCPUs(3)
+	doc.SetMemoryMB(3000)
+	if doc.CPUs() != 3 || doc.Get("cpuid.coresPerSocket") != "3" {
+		t.Errorf("Expected 3 CPUs in one socket, found %d and %s", doc.CPUs(), doc.Get("cpuid.coresPerSocket"))
+	}
+	if doc.MemoryMB() != 3000 {
+		t.Errorf("Expected 3000 MB, found %d", doc.MemoryMB())
+	}
+
+	doc.SetCPUs(6)
+	doc.SetMemoryMB(1023)
+	if doc.Get("cpuid.coresPerSocket") != "3" || doc.MemoryMB() != 1024 {
+		t.Errorf("Expected 2 sockets of 3 cores and 1024 MB, found %s and %d", doc.Get("cpuid.coresPerSocket"), doc.MemoryMB())
+	}
+}
+
+func TestNICs(t *testing.T) {
+	nics := ReadFixture(t, "centos-static.vmx").NICs()
+	if len(nics) != 3 {
+		t.Fatalf("Expected 3 NICs, found %v", nics)
+	}
+
+	expected := []struct {
+		name, connectionType, mac string
+	}{
+		{"ethernet0", "nat", "00:0c:29:f7:07:f2"},
+		{"ethernet1", "custom", "00:50:56:3a:12:01"},
+		{"ethernet2", "hostonly", "00:0c:29:f7:07:06"},
+	}
+	for i, e := range expected {
+		nic := nics[i]
+		mac, err := nic.MAC()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nic.Name != e.name || nic.ConnectionType != e.connectionType || mac.String() != e.mac || !nic.Present {
+			t.Errorf("Expected %s %s %s, found %+v", e.name, e.connectionType, e.mac, nic)
+		}
+	}
+	if nics[1].VNet != "vmnet8" || nics[1].AddressType != "static" {
+		t.Errorf("Unexpected ethernet1 %+v", nics[1])
+	}
+
+	if nics := ReadFixture(t, "centos-nonic.vmx").NICs(); len(nics) != 0 {
+		t.Errorf("Expected no NICs, found %v", nics)
+	}
+
+	doc := Parse(nil)
+	doc.SetNIC(NIC{Name: "ethernet1", Present: true, ConnectionType: "bridged", VirtualDev: "vmxnet3"})
+	expectedFile := "ethernet1.present = \"TRUE\"\n" +
+		"ethernet1.connectionType = \"bridged\"\n" +
+		"ethernet1.virtualDev = \"vmxnet3\"\n"
+	if string(doc.Bytes()) != expectedFile {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expectedFile, doc.Bytes())
+	}
+	if _, ok := doc.NIC("ethernet2"); ok {
+		t.Error("Expected no ethernet2")
+	}
+}
+
+func TestDisks(t *testing.T) {
+	disks := ReadFixture(t, "centos.vmx").Disks()
+	if len(disks) != 2 {
+		t.Fatalf("Expected 2 disks, found %v", disks)
+	}
+
+	if disks[0].Name != "ide1:0" || !disks[0].CDROM() || disks[0].FileName != "/home/cbednarski/Downloads/CentOS-7-x86_64-Minimal-1810.iso" {
+		t.Errorf("Expected the CD drive first, found %+v", disks[0])
+	}
+	if disks[1].Name != "nvme0:0" || disks[1].CDROM() || disks[1].FileName != "centos7-cl1.vmdk" || !disks[1].Present {
+		t.Errorf("Expected the NVMe disk, found %+v", disks[1])
+	}
+}
+
+func TestSharedFolders(t *testing.T) {
+	folders := ReadFixture(t, "centos-shared.vmx").SharedFolders()
+	if len(folders) != 1 {
+		t.Fatalf("Expected 1 shared folder, found %v", folders)
+	}
+
+	expected := SharedFolder{
+		Name:      "sharedFolder0",
+		Present:   true,
+		Enabled:   true,
+		HostPath:  "/home/user/project",
+		GuestName: "srv-project",
+		Writable:  true,
+	}
+	if folders[0] != expected {
+		t.Errorf("Expected %+v, found %+v", expected, folders[0])
+	}
+}
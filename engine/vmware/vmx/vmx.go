@@ -0,0 +1,290 @@
+// Package vmx reads and writes VMware's .vmx configuration files.
+//
+// A .vmx file is a list of key = "value" lines. VMware treats keys as
+// case-insensitive and keeps comments, blank lines and the #! line at the top,
+// so we do too. A Document remembers every line as it was read, and only
+// rewrites the lines whose values change, so writing an unchanged document
+// produces exactly the same bytes. For example:
+//
+//	#!/usr/bin/vmware
+//	.encoding = "UTF-8"
+//	numvcpus = "2"
+//	memsize = "2048"
+//	ethernet0.connectionType = "nat"
+//
+// Values are stored in the file's .encoding, which we leave alone. Quotes and
+// other special characters in values are escaped as |XX, with XX in hex, e.g.
+// |22 for ". Get and Set do the escaping for you.
+package vmx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// line is one line of the file, without the \n. Entries have a key; comments,
+// blank lines and anything we don't understand don't, and are kept as is.
+type line struct {
+	raw string
+
+	key   string
+	value string
+
+	// prefix and suffix surround the value in raw, so we can replace the value
+	// without changing the spacing or quoting around it
+	prefix string
+	suffix string
+}
+
+// Document is a parsed .vmx file
+type Document struct {
+	lines []*line
+
+	// crlf is true if the file uses Windows line endings
+	crlf bool
+
+	// noFinalNewline is true if the last line doesn't end with a newline
+	noFinalNewline bool
+}
+
+// Parse parses the contents of a .vmx file. Lines that aren't key = value
+// pairs are kept, so parsing can't fail.
+func Parse(data []byte) *Document {
+	d := &Document{}
+	if len(data) == 0 {
+		return d
+	}
+
+	rows := strings.Split(string(data), "\n")
+	if rows[len(rows)-1] == "" {
+		rows = rows[:len(rows)-1]
+	} else {
+		d.noFinalNewline = true
+	}
+	d.crlf = len(rows) > 0 && strings.HasSuffix(rows[0], "\r")
+
+	for _, row := range rows {
+		d.lines = append(d.lines, parseLine(row))
+	}
+
+	return d
+}
+
+func parseLine(raw string) *line {
+	l := &line{raw: raw}
+
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return l
+	}
+
+	eq := strings.Index(raw, "=")
+	if eq < 0 {
+		return l
+	}
+	key := strings.TrimSpace(raw[:eq])
+	if key == "" {
+		return l
+	}
+
+	// Find where the value starts, after the = and any spaces
+	start := eq + 1
+	for start < len(raw) && (raw[start] == ' ' || raw[start] == '\t') {
+		start++
+	}
+
+	if start < len(raw) && raw[start] == '"' {
+		end := strings.Index(raw[start+1:], `"`)
+		if end < 0 {
+			// An unterminated quote; leave the line alone
+			return l
+		}
+		end += start + 1
+		l.prefix, l.value, l.suffix = raw[:start+1], raw[start+1:end], raw[end:]
+	} else {
+		// Unquoted values run to the end of the line, minus trailing spaces
+		end := len(strings.TrimRight(raw, " \t\r"))
+		if end < start {
+			end = start
+		}
+		l.prefix, l.value, l.suffix = raw[:start], raw[start:end], raw[end:]
+	}
+
+	l.key = key
+	return l
+}
+
+// ReadFile reads and parses a .vmx file
+func ReadFile(path string) (*Document, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data), nil
+}
+
+// WriteFile writes the document to path, keeping the file's mode if it
+// already exists. The VM must not be running, or VMware will overwrite it.
+func (d *Document) WriteFile(path string) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode()
+	}
+	return ioutil.WriteFile(path, d.Bytes(), mode)
+}
+
+// Bytes returns the contents of the .vmx file
+func (d *Document) Bytes() []byte {
+	if len(d.lines) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	for i, l := range d.lines {
+		b.WriteString(l.raw)
+		if i < len(d.lines)-1 || !d.noFinalNewline {
+			b.WriteString("\n")
+		}
+	}
+	return []byte(b.String())
+}
+
+// Keys returns the keys in the order they appear in the file
+func (d *Document) Keys() []string {
+	var keys []string
+	for _, l := range d.lines {
+		if l.key != "" {
+			keys = append(keys, l.key)
+		}
+	}
+	return keys
+}
+
+// Lookup returns the value for key, ignoring case. If the key appears more than
+// once the last one wins, like in VMware.
+func (d *Document) Lookup(key string) (string, bool) {
+	for i := len(d.lines) - 1; i >= 0; i-- {
+		if strings.EqualFold(d.lines[i].key, key) {
+			return Unescape(d.lines[i].value), true
+		}
+	}
+	return "", false
+}
+
+// Get returns the value for key, or "" if there isn't one
+func (d *Document) Get(key string) string {
+	value, _ := d.Lookup(key)
+	return value
+}
+
+// Set changes the value for key, ignoring case, on every line it appears. If
+// the key isn't in the document it is added at the end.
+func (d *Document) Set(key, value string) {
+	escaped := Escape(value)
+
+	found := false
+	for _, l := range d.lines {
+		if !strings.EqualFold(l.key, key) {
+			continue
+		}
+		found = true
+		if l.value != escaped {
+			l.value = escaped
+			l.raw = l.prefix + escaped + l.suffix
+		}
+	}
+	if found {
+		return
+	}
+
+	eol := ""
+	if d.crlf {
+		eol = "\r"
+	}
+	d.lines = append(d.lines, parseLine(fmt.Sprintf(`%s = "%s"%s`, key, escaped, eol)))
+}
+
+// Delete removes every line with key, ignoring case. It returns false if there
+// weren't any.
+func (d *Document) Delete(key string) bool {
+	var kept []*line
+	for _, l := range d.lines {
+		if !strings.EqualFold(l.key, key) {
+			kept = append(kept, l)
+		}
+	}
+	deleted := len(kept) != len(d.lines)
+	d.lines = kept
+	return deleted
+}
+
+// Bool returns true if the value for key is TRUE, ignoring case
+func (d *Document) Bool(key string) bool {
+	return strings.EqualFold(d.Get(key), "TRUE")
+}
+
+// SetBool sets key to TRUE or FALSE
+func (d *Document) SetBool(key string, value bool) {
+	if value {
+		d.Set(key, "TRUE")
+	} else {
+		d.Set(key, "FALSE")
+	}
+}
+
+// Int returns the value for key as a number. ok is false if there isn't one
+// or it's not a number.
+func (d *Document) Int(key string) (n int, ok bool) {
+	n, err := strconv.Atoi(d.Get(key))
+	return n, err == nil
+}
+
+// SetInt sets key to a number
+func (d *Document) SetInt(key string, value int) {
+	d.Set(key, strconv.Itoa(value))
+}
+
+// Encoding returns the character set the file's values are stored in, e.g.
+// UTF-8. Older files may not say, which means the host's default.
+func (d *Document) Encoding() string {
+	return d.Get(".encoding")
+}
+
+// Unescape decodes the |XX escapes VMware uses for special characters in
+// values. Anything that doesn't look like an escape is left alone.
+func Unescape(s string) string {
+	if !strings.Contains(s, "|") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '|' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Escape encodes quotes, | and control characters in a value the way VMware
+// does
+func Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' || c == '|' || c < 0x20 || c == 0x7f {
+			fmt.Fprintf(&b, "|%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
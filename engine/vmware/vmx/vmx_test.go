@@ -0,0 +1,125 @@
+package vmx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// The engine's test fixtures are real .vmx files
+func Fixtures(t *testing.T) []string {
+	paths, err := filepath.Glob(filepath.Join("..", "test-fixtures", "*.vmx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("Expected some .vmx fixtures")
+	}
+	return paths
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, path := range Fixtures(t) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		doc := Parse(data)
+		if !bytes.Equal(doc.Bytes(), data) {
+			t.Errorf("%s: expected the same bytes back", path)
+		}
+
+		// Setting a value to what it already is changes nothing
+		for _, key := range doc.Keys() {
+			doc.Set(key, doc.Get(key))
+		}
+		if !bytes.Equal(doc.Bytes(), data) {
+			t.Errorf("%s: expected the same bytes back after setting every key", path)
+		}
+	}
+
+	// Odd files survive too
+	odd := []string{
+		"",
+		"no newline = \"at the end\"",
+		"#!/usr/bin/vmware\r\n.encoding = \"windows-1252\"\r\nmemsize = \"1024\"\r\n",
+		"  spaced=\"value\"   \n\n# comment\nunquoted = TRUE\ngarbage\nbroken = \"quote\n",
+	}
+	for _, data := range odd {
+		if found := string(Parse([]byte(data)).Bytes()); found != data {
+			t.Errorf("Expected %q, found %q", data, found)
+		}
+	}
+}
+
+func TestDocument(t *testing.T) {
+	data := "#!/usr/bin/vmware\n" +
+		".encoding = \"UTF-8\"\n" +
+		"displayName = \"Clone of centos7\"\n" +
+		"memsize = \"1024\"\n" +
+		"  spaced=\"value\"  \n" +
+		"unquoted = TRUE\n" +
+		"annotation = \"say |22hi|22|0Afoo|7Cbar\"\n"
+	doc := Parse([]byte(data))
+
+	if doc.Encoding() != "UTF-8" {
+		t.Errorf("Unexpected encoding %q", doc.Encoding())
+	}
+	if doc.Get("DISPLAYNAME") != "Clone of centos7" {
+		t.Errorf("Expected keys to be case-insensitive, found %q", doc.Get("DISPLAYNAME"))
+	}
+	if doc.Get("spaced") != "value" || !doc.Bool("unquoted") {
+		t.Errorf("Unexpected values %q %q", doc.Get("spaced"), doc.Get("unquoted"))
+	}
+	if doc.Get("annotation") != "say \"hi\"\nfoo|bar" {
+		t.Errorf("Unexpected annotation %q", doc.Get("annotation"))
+	}
+	if _, ok := doc.Lookup("missing"); ok {
+		t.Error("Expected missing to be missing")
+	}
+
+	doc.Set("memsize", "2048")
+	doc.Set("spaced", "new")
+	doc.Set("guestinfo.note", `a "quoted" note`)
+	if !doc.Delete("unquoted") || doc.Delete("unquoted") {
+		t.Error("Expected unquoted to be deleted once")
+	}
+
+	expected := "#!/usr/bin/vmware\n" +
+		".encoding = \"UTF-8\"\n" +
+		"displayName = \"Clone of centos7\"\n" +
+		"memsize = \"2048\"\n" +
+		"  spaced=\"new\"  \n" +
+		"annotation = \"say |22hi|22|0Afoo|7Cbar\"\n" +
+		"guestinfo.note = \"a |22quoted|22 note\"\n"
+	if string(doc.Bytes()) != expected {
+		t.Errorf("Expected:\n%s\nFound:\n%s", expected, doc.Bytes())
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	doc := Parse([]byte("memsize = \"1024\"\nMEMSIZE = \"2048\"\n"))
+
+	// The last one wins
+	if doc.MemoryMB() != 2048 {
+		t.Errorf("Expected 2048, found %d", doc.MemoryMB())
+	}
+
+	doc.SetMemoryMB(4096)
+	if string(doc.Bytes()) != "memsize = \"4096\"\nMEMSIZE = \"4096\"\n" {
+		t.Errorf("Expected both lines to change, found %q", doc.Bytes())
+	}
+}
+
+func TestWindowsLineEndings(t *testing.T) {
+	doc := Parse([]byte(".encoding = \"UTF-8\"\r\nmemsize = \"1024\"\r\n"))
+	doc.Set("memsize", "2048")
+	doc.Set("numvcpus", "2")
+
+	expected := ".encoding = \"UTF-8\"\r\nmemsize = \"2048\"\r\nnumvcpus = \"2\"\r\n"
+	if string(doc.Bytes()) != expected {
+		t.Errorf("Expected %q, found %q", expected, doc.Bytes())
+	}
+}
@@ -14,6 +14,11 @@ import (
 
 func main() {
 	if err := commands.Main(); err != nil {
+		// The command in the VM has already shown its own error, so just
+		// pass its exit status along.
+		if exitErr, ok := err.(*commands.ExitError); ok {
+			os.Exit(exitErr.Code)
+		}
 		cli.ExitWithError(err)
 	}
 	os.Exit(0)